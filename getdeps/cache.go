@@ -0,0 +1,162 @@
+// Copyright (c) Facebook, Inc. and its affiliates.
+//
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+
+package main
+
+import (
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// downloadCache is the cache used by fetchAndVerify. It is nil if caching is
+// disabled.
+var downloadCache *DownloadCache
+
+// DownloadCache is a content-addressed store for downloaded artifacts. Entries
+// are keyed by the hash specified in the configuration (e.g.
+// `sha256:<hex digest>`) and stored as `<dir>/<hash type>/<hex digest>`, so the
+// same cache directory can be shared between multiple build directories and CI
+// workers.
+type DownloadCache struct {
+	Dir string
+}
+
+// originSuffix is the suffix of the files recording where cache entries were
+// downloaded from, see SetOrigin.
+const originSuffix = ".url"
+
+// NewDownloadCache returns a DownloadCache rooted at the specified directory,
+// creating it if necessary.
+func NewDownloadCache(dir string) (*DownloadCache, error) {
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		return nil, fmt.Errorf("failed to create cache directory '%s': %w", dir, err)
+	}
+	return &DownloadCache{Dir: dir}, nil
+}
+
+// defaultCacheDir returns the default cache directory. The GETDEPS_CACHE_DIR
+// environment variable takes precedence over the user's cache directory.
+func defaultCacheDir() string {
+	if dir, ok := os.LookupEnv("GETDEPS_CACHE_DIR"); ok {
+		return dir
+	}
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(dir, "getdeps")
+}
+
+// path returns the path of the cache entry for the specified hash. If
+// multiple hashes are specified, the entry is keyed by the first one.
+func (c *DownloadCache) path(hash string) (string, error) {
+	hashes := splitHashes(hash)
+	if len(hashes) == 0 {
+		return "", fmt.Errorf("unsupported hash format %q", hash)
+	}
+	parts := strings.Split(strings.ToLower(hashes[0]), ":")
+	if len(parts) != 2 || parts[0] == "" {
+		return "", fmt.Errorf("unsupported hash format %q", hash)
+	}
+	// the type is a directory name.
+	if err := checkHashTypes(parts[:1]); err != nil {
+		return "", err
+	}
+	if _, err := hex.DecodeString(parts[1]); err != nil || parts[1] == "" {
+		return "", fmt.Errorf("invalid hash digest %q", hash)
+	}
+	return filepath.Join(c.Dir, parts[0], parts[1]), nil
+}
+
+// Open returns the entry for the specified hash, opened for reading. If there
+// is no such entry, nil is returned without error. The returned data is not
+// verified, it is up to the caller to check it against the hash.
+func (c *DownloadCache) Open(hash string) (*os.File, error) {
+	p, err := c.path(hash)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Open(p)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	return f, err
+}
+
+// TempFile creates a temporary file in the cache directory, suitable for
+// being committed to the cache with Commit.
+func (c *DownloadCache) TempFile() (*os.File, error) {
+	return ioutil.TempFile(c.Dir, ".tmp-")
+}
+
+// Commit moves the specified file into the cache as the entry for the
+// specified hash. The file must be on the same file system as the cache, see
+// TempFile. The rename is atomic, so concurrent readers never see a partially
+// written entry.
+func (c *DownloadCache) Commit(hash, name string) error {
+	p, err := c.path(hash)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(p), os.ModePerm); err != nil {
+		return err
+	}
+	return os.Rename(name, p)
+}
+
+// SetOrigin records the URL the entry for the specified hash was downloaded
+// from, next to the entry.
+func (c *DownloadCache) SetOrigin(hash, urlStr string) error {
+	p, err := c.path(hash)
+	if err != nil {
+		return err
+	}
+	tmp, err := c.TempFile()
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.WriteString(urlStr); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), p+originSuffix)
+}
+
+// Origin returns the URL recorded with SetOrigin for the entry of the
+// specified hash, or an empty string if there is none.
+func (c *DownloadCache) Origin(hash string) string {
+	p, err := c.path(hash)
+	if err != nil {
+		return ""
+	}
+	data, err := ioutil.ReadFile(p + originSuffix)
+	if err != nil {
+		return ""
+	}
+	return string(data)
+}
+
+// Remove deletes the entry for the specified hash, if any.
+func (c *DownloadCache) Remove(hash string) error {
+	p, err := c.path(hash)
+	if err != nil {
+		return err
+	}
+	for _, name := range []string{p, p + originSuffix} {
+		if err := os.Remove(name); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,69 @@
+// Copyright (c) Facebook, Inc. and its affiliates.
+//
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const testHash = "sha256:2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824"
+
+func TestDownloadCache(t *testing.T) {
+	dir, err := ioutil.TempDir("", "getdeps-cache")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	c, err := NewDownloadCache(dir)
+	require.NoError(t, err)
+
+	// miss
+	f, err := c.Open(testHash)
+	require.NoError(t, err)
+	assert.Nil(t, f)
+
+	// hit
+	tmp, err := c.TempFile()
+	require.NoError(t, err)
+	_, err = tmp.Write([]byte("hello"))
+	require.NoError(t, err)
+	require.NoError(t, tmp.Close())
+	require.NoError(t, c.Commit(testHash, tmp.Name()))
+	f, err = c.Open(testHash)
+	require.NoError(t, err)
+	require.NotNil(t, f)
+	data, err := ioutil.ReadAll(f)
+	f.Close()
+	require.NoError(t, err)
+	assert.Equal(t, []byte("hello"), data)
+	assert.FileExists(t, filepath.Join(dir, "sha256", "2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824"))
+	assert.NoFileExists(t, tmp.Name())
+	assert.Empty(t, c.Origin(testHash))
+	require.NoError(t, c.SetOrigin(testHash, "https://example.com/hello"))
+	assert.Equal(t, "https://example.com/hello", c.Origin(testHash))
+
+	require.NoError(t, c.Remove(testHash))
+	assert.Empty(t, c.Origin(testHash))
+	f, err = c.Open(testHash)
+	require.NoError(t, err)
+	assert.Nil(t, f)
+
+	// malformed hashes must not escape the cache directory
+	_, err = c.Open("sha256:../../etc/passwd")
+	assert.Error(t, err)
+	_, err = c.Open("")
+	assert.Error(t, err)
+	for _, hash := range []string{"..:2cf24dba", "../../x:2cf24dba", "md5:2cf24dba"} {
+		_, err = c.Open(hash)
+		assert.ErrorContains(t, err, "unsupported hash type", hash)
+		assert.Error(t, c.Remove(hash), hash)
+	}
+}
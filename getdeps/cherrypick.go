@@ -0,0 +1,152 @@
+// Copyright (c) Facebook, Inc. and its affiliates.
+//
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"os/exec"
+	"strings"
+)
+
+// CherryPick is a change applied on top of the checkout of a Git entry.
+type CherryPick struct {
+	// Ref to fetch from the repository, e.g. a Gerrit change such as
+	// refs/changes/45/12345/3, a branch, or a commit hash.
+	Ref string `json:"ref"`
+	// Commit cherry-picked. Set by Get in update mode, or if missing.
+	Hash *string `json:"hash,omitempty"`
+}
+
+// gitIdentity is the committer of the commits created by getdeps, when
+// cherry-picking or applying patches, so that it does not depend on the Git
+// configuration of the user.
+var gitIdentity = []string{"-c", "user.name=getdeps", "-c", "user.email=getdeps@localhost"}
+
+// cherryPick applies the changes listed in CherryPicks, in order, on top of
+// the checkout at dest, and records their commits. Changes which cannot be
+// applied are reported, and the following ones are still tried, so that all
+// the conflicts are reported at once.
+func (g *Git) cherryPick(projectDir, dest string, hashMode HashMode, urlOverrides *URLOverrides) error {
+	if len(g.CherryPicks) == 0 {
+		return nil
+	}
+	repo := resolveRepo(projectDir, g.URL, urlOverrides)
+	out, err := exec.Command("git", "-C", dest, "rev-parse", "--is-shallow-repository").Output()
+	if err != nil {
+		return fmt.Errorf("%s: %w", g.Label, err)
+	}
+	shallow := strings.TrimSpace(string(out)) == "true"
+
+	var errs errorList
+	for i := range g.CherryPicks {
+		cp := &g.CherryPicks[i]
+		if cp.Ref == "" {
+			errs = append(errs, fmt.Errorf("%s: cherry-pick %d: ref not specified", g.Label, i))
+			continue
+		}
+		hash := ""
+		if cp.Hash != nil && hashMode != hashModeUpdate {
+			hash = *cp.Hash
+		}
+		commit, err := fetchCommit(g.Label, repo, dest, cp.Ref, hash, shallow)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		log.Printf("%s: Cherry-picking %s (%s)...", g.Label, cp.Ref, commit)
+		args := append([]string{"-C", dest}, gitIdentity...)
+		args = append(args, "cherry-pick", "--keep-redundant-commits", commit)
+		if err := runCommand(g.Label, "git", args...); err != nil {
+			out, _ := exec.Command("git", "-C", dest, "diff", "--name-only", "--diff-filter=U").Output()
+			if abortErr := runCommand(g.Label, "git", "-C", dest, "cherry-pick", "--abort"); abortErr != nil {
+				// no further changes can be applied.
+				return append(errs, fmt.Errorf("%s: cherry-pick of %s (%s) failed: %w", g.Label, cp.Ref, commit, err))
+			}
+			if conflicts := strings.Fields(string(out)); len(conflicts) > 0 {
+				errs = append(errs, fmt.Errorf("%s: cherry-pick of %s (%s) conflicts in %s", g.Label, cp.Ref, commit, strings.Join(conflicts, ", ")))
+			} else {
+				errs = append(errs, fmt.Errorf("%s: cherry-pick of %s (%s) failed: %w", g.Label, cp.Ref, commit, err))
+			}
+			continue
+		}
+		cp.Hash = &commit
+		if hashMode == hashModeStrict && hash == "" {
+			errs = append(errs, fmt.Errorf("%s: cherry-pick of %s: hash mode is strict and no hash supplied (current is %s)", g.Label, cp.Ref, commit))
+		}
+	}
+	return errs.errorOrNil()
+}
+
+// missingCherryPicksOffline returns a description of every change to
+// cherry-pick whose commit is neither in the local repository nor in the Git
+// cache, and thus cannot be fetched without network access.
+func (g *Git) missingCherryPicksOffline(projectDir string, urlOverrides *URLOverrides, hashMode HashMode) []string {
+	repo := resolveRepo(projectDir, g.URL, urlOverrides)
+	dir := localRepoPath(repo)
+	var missing []string
+	for _, cp := range g.CherryPicks {
+		hash := ""
+		if cp.Hash != nil && hashMode != hashModeUpdate {
+			hash = *cp.Hash
+		}
+		available := false
+		switch {
+		case dir != "" && hash != "":
+			available = exec.Command("git", "-C", dir, "cat-file", "-e", hash+"^{commit}").Run() == nil
+		case dir != "":
+			available = exec.Command("git", "-C", dir, "rev-parse", "--verify", "-q", cp.Ref+"^{commit}").Run() == nil
+		case gitCache != nil && hash != "":
+			available = gitCache.has(repo, hash)
+		}
+		if !available {
+			missing = append(missing, fmt.Sprintf("git %s: cherry-pick %s", g.Label, cp.Ref))
+		}
+	}
+	return missing
+}
+
+// fetchCommit fetches the commit of the repository to cherry-pick into the
+// checkout at dest: the hash if known, or the one ref points at. In a shallow
+// checkout, its parent is fetched too, as cherry-picking needs it. The
+// commit is returned.
+func fetchCommit(label, repo, dest, ref, hash string, shallow bool) (string, error) {
+	source, fetchRef := repo, ref
+	if gitCache != nil && !isLocalRepoPath(repo) {
+		p, commit, err := gitCache.update(label, repo, ref, hash)
+		if err != nil {
+			return "", err
+		}
+		source, fetchRef = "file://"+p, commit
+	} else if offline && localRepoPath(repo) == "" {
+		return "", fmt.Errorf("%s: cannot fetch %s from %s: %w", label, ref, redactURL(repo), errOffline)
+	}
+
+	args := []string{"-C", dest, "fetch", "-q"}
+	if shallow {
+		args = append(args, "--depth=2")
+	}
+	if err := runCommand(label, "git", append(args, source, fetchRef)...); err != nil {
+		return "", fmt.Errorf("%s: cannot fetch %s: %w", label, ref, err)
+	}
+	out, err := exec.Command("git", "-C", dest, "rev-parse", "--verify", "-q", "FETCH_HEAD^{commit}").Output()
+	if err != nil {
+		return "", fmt.Errorf("%s: %s is not a commit", label, ref)
+	}
+	commit := strings.TrimSpace(string(out))
+	if hash == "" || strings.HasPrefix(commit, hash) {
+		return commit, nil
+	}
+
+	// the ref moved since the hash was recorded, fetch the pinned commit
+	// itself, which requires uploadpack.allowReachableSHA1InWant on the
+	// server.
+	log.Printf("%s: %s now points at %s, fetching the pinned %s", label, ref, commit, hash)
+	if err := runCommand(label, "git", append(args, source, hash)...); err != nil {
+		return "", fmt.Errorf("%s: cannot fetch %s (%s): %w", label, ref, hash, err)
+	}
+	return hash, nil
+}
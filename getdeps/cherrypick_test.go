@@ -0,0 +1,99 @@
+// Copyright (c) Facebook, Inc. and its affiliates.
+//
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCherryPick(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not found")
+	}
+	repo := newTestGitRepo(t, map[string]string{"a.txt": "a\n"})
+	base := runTestGit(t, repo, "rev-parse", "HEAD")
+	// Gerrit changes are only reachable from refs/changes.
+	change := func(ref, name, content string) {
+		runTestGit(t, repo, "checkout", "-q", "--detach", base)
+		require.NoError(t, ioutil.WriteFile(filepath.Join(repo, name), []byte(content), 0644))
+		runTestGit(t, repo, "add", name)
+		runTestGit(t, repo, "commit", "-q", "-m", ref)
+		runTestGit(t, repo, "update-ref", ref, "HEAD")
+	}
+	change("refs/changes/01/1/1", "a.txt", "a1\n")
+	change("refs/changes/02/2/1", "b.txt", "b\n")
+	change("refs/changes/03/3/1", "a.txt", "a3\n")
+	runTestGit(t, repo, "checkout", "-q", "master")
+
+	get := func(g *Git, hashMode HashMode) (string, error) {
+		workDir, err := ioutil.TempDir("", "getdeps-work")
+		require.NoError(t, err)
+		t.Cleanup(func() { os.RemoveAll(workDir) })
+		return workDir, g.Get("", workDir, nil, hashMode, nil)
+	}
+
+	for _, cached := range []bool{false, true} {
+		if cached {
+			dir, err := ioutil.TempDir("", "getdeps-gitcache")
+			require.NoError(t, err)
+			defer os.RemoveAll(dir)
+			gitCache, err = NewGitCache(dir)
+			require.NoError(t, err)
+			defer func() { gitCache = nil }()
+		}
+
+		g := &Git{Label: "coreboot", URL: "file://" + repo, Hash: &base, CherryPicks: []CherryPick{
+			{Ref: "refs/changes/01/1/1"},
+			{Ref: "refs/changes/02/2/1"},
+		}}
+		workDir, err := get(g, hashModePermissive)
+		require.NoError(t, err)
+		data, err := ioutil.ReadFile(filepath.Join(workDir, "a.txt"))
+		require.NoError(t, err)
+		assert.Equal(t, "a1\n", string(data))
+		assert.FileExists(t, filepath.Join(workDir, "b.txt"))
+		assert.Equal(t, base, *g.Hash)
+		for _, cp := range g.CherryPicks {
+			require.NotNil(t, cp.Hash)
+			assert.Equal(t, runTestGit(t, repo, "rev-parse", cp.Ref), *cp.Hash)
+		}
+
+		// the hashes are required in strict mode.
+		g.CherryPicks[1].Hash = nil
+		_, err = get(g, hashModeStrict)
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "hash mode is strict")
+		_, err = get(g, hashModeStrict)
+		require.NoError(t, err)
+
+		// conflicts are reported per change, and do not prevent applying the
+		// others.
+		g.CherryPicks = []CherryPick{{Ref: "refs/changes/01/1/1"}, {Ref: "refs/changes/03/3/1"}, {Ref: "refs/changes/02/2/1"}}
+		workDir, err = get(g, hashModeUpdate)
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "cherry-pick of refs/changes/03/3/1")
+		assert.Contains(t, err.Error(), "conflicts in a.txt")
+		assert.NotContains(t, err.Error(), "refs/changes/02/2/1")
+		assert.FileExists(t, filepath.Join(workDir, "b.txt"))
+		assert.Nil(t, g.CherryPicks[1].Hash)
+		assert.NotNil(t, g.CherryPicks[2].Hash)
+	}
+
+	// in offline mode, the changes must be in the local repository.
+	overrides := URLOverrides{"https://review.coreboot.org/coreboot": "file://" + repo}
+	n := Node{Git: []Git{{Label: "coreboot", URL: "https://review.coreboot.org/coreboot", Hash: &base, CherryPicks: []CherryPick{
+		{Ref: "refs/changes/01/1/1"},
+		{Ref: "refs/changes/09/9/1"},
+	}}}}
+	assert.Equal(t, []string{"git coreboot: cherry-pick refs/changes/09/9/1"}, n.missingOffline("", &overrides, hashModeStrict))
+}
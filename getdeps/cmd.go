@@ -6,18 +6,91 @@
 package main
 
 import (
+	"bytes"
 	"fmt"
+	"io"
 	"log"
 	"os"
 	"os/exec"
+	"strings"
+	"sync"
 )
 
-func runCommand(bin string, args ...string) error {
+// runCommand runs the specified command. Its output is logged line by line,
+// prefixed by the label, so that it stays readable when multiple commands run
+// concurrently. git commands get the network settings via gitEnv and
+// gitConfig, hg commands the environment of hgCommandEnv.
+func runCommand(label, bin string, args ...string) error {
+	return runCommandInput(label, os.Stdin, bin, args...)
+}
+
+// runCommandInput is like runCommand, with the standard input of the command
+// read from stdin.
+func runCommandInput(label string, stdin io.Reader, bin string, args ...string) error {
 	cmd := exec.Command(bin, args...)
-	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
-	log.Printf("Running %v", cmd)
-	if err := cmd.Run(); err != nil {
-		return fmt.Errorf("error running %v: %w", cmd, err)
+	switch bin {
+	case "git":
+		cmd.Env = gitCommandEnv()
+	case "hg":
+		cmd.Env = hgCommandEnv()
+	}
+	out := &logWriter{prefix: label}
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = stdin, out, out
+	// repository URLs may contain credentials.
+	args = append([]string{cmd.Path}, args...)
+	for i := range args {
+		args[i] = redactURL(args[i])
+	}
+	cmdline := strings.Join(args, " ")
+	log.Printf("%s: Running %s", label, cmdline)
+	err := cmd.Run()
+	out.Flush()
+	if err != nil {
+		return fmt.Errorf("error running %s: %w", cmdline, err)
 	}
 	return nil
 }
+
+// gitCommandEnv returns the environment of git commands accessing remotes,
+// with the network settings of gitEnv and gitConfig, or nil for the default
+// environment.
+func gitCommandEnv() []string {
+	if len(gitEnv) == 0 && len(gitConfig) == 0 {
+		return nil
+	}
+	return append(append(os.Environ(), gitEnv...), gitConfigEnv(gitConfig)...)
+}
+
+// logWriter is an io.Writer that logs every line written to it.
+type logWriter struct {
+	prefix string
+	mu     sync.Mutex
+	buf    bytes.Buffer
+}
+
+func (w *logWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.buf.Write(p)
+	for {
+		i := bytes.IndexAny(w.buf.Bytes(), "\r\n")
+		if i < 0 {
+			break
+		}
+		line := w.buf.Next(i + 1)
+		if line = bytes.TrimRight(line, "\r\n"); len(line) > 0 {
+			log.Printf("%s: %s", w.prefix, line)
+		}
+	}
+	return len(p), nil
+}
+
+// Flush logs any incomplete line left in the buffer.
+func (w *logWriter) Flush() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.buf.Len() > 0 {
+		log.Printf("%s: %s", w.prefix, w.buf.String())
+		w.buf.Reset()
+	}
+}
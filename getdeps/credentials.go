@@ -0,0 +1,300 @@
+// Copyright (c) Facebook, Inc. and its affiliates.
+//
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// HostCredentials are the credentials sent to a host.
+type HostCredentials struct {
+	// Headers added to every request to the host.
+	Headers map[string]string `json:"headers,omitempty"`
+	// Name of the environment variable containing a bearer token, sent in
+	// the Authorization header. Tokens are not stored in the file so that it
+	// can be shared.
+	BearerTokenEnv string `json:"bearer_token_env,omitempty"`
+}
+
+// Credentials maps host names, optionally with a port, to their credentials.
+type Credentials map[string]HostCredentials
+
+// NewCredentials creates a new Credentials object after parsing the specified
+// credentials file.
+func NewCredentials(data []byte) (Credentials, error) {
+	var creds Credentials
+	if err := json.Unmarshal(data, &creds); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal credentials JSON: %v", err)
+	}
+	return creds, nil
+}
+
+// netrcEntry is a machine or the default entry of a netrc file.
+type netrcEntry struct {
+	login, password string
+}
+
+// hostAuth holds the resolved credentials of every host. The values must
+// never be logged, nor written to the configuration.
+type hostAuth struct {
+	headers map[string]http.Header
+	netrc   map[string]netrcEntry
+	// default netrc entry, if any.
+	netrcDefault *netrcEntry
+}
+
+// defaultNetrcFile returns the netrc file used by default, from the NETRC
+// environment variable or the home directory.
+func defaultNetrcFile() string {
+	if f := os.Getenv("NETRC"); f != "" {
+		return f
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(home, ".netrc")
+}
+
+// setupCredentials loads the credentials file and the netrc file, both
+// optional, and applies them to httpTransport, gitHTTPTransport and
+// gitConfig. A missing netrc file is not an error.
+func setupCredentials(credentialsFile, netrcFile string) error {
+	a := &hostAuth{headers: map[string]http.Header{}, netrc: map[string]netrcEntry{}}
+	if credentialsFile != "" {
+		data, err := ioutil.ReadFile(credentialsFile)
+		if err != nil {
+			return fmt.Errorf("failed to read credentials file '%s': %w", credentialsFile, err)
+		}
+		creds, err := NewCredentials(data)
+		if err != nil {
+			return err
+		}
+		for host, hc := range creds {
+			h := http.Header{}
+			for k, v := range hc.Headers {
+				h.Set(k, v)
+			}
+			if hc.BearerTokenEnv != "" {
+				token := os.Getenv(hc.BearerTokenEnv)
+				if token == "" {
+					return fmt.Errorf("bearer token for %s: environment variable %s is not set", host, hc.BearerTokenEnv)
+				}
+				h.Set("Authorization", "Bearer "+token)
+			}
+			a.headers[strings.ToLower(host)] = h
+		}
+	}
+	if netrcFile != "" {
+		data, err := ioutil.ReadFile(netrcFile)
+		if err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("failed to read netrc file '%s': %w", netrcFile, err)
+		}
+		if err == nil {
+			a.netrc, a.netrcDefault = parseNetrc(data)
+		}
+	}
+	if len(a.headers) == 0 && len(a.netrc) == 0 && a.netrcDefault == nil {
+		return nil
+	}
+
+	for _, t := range []*http.RoundTripper{&httpTransport, &gitHTTPTransport} {
+		base := *t
+		if base == nil {
+			base = http.DefaultTransport
+		}
+		*t = &authTransport{base: base, auth: a}
+	}
+	gitConfig = append(gitConfig, a.gitConfig()...)
+	return nil
+}
+
+// parseNetrc parses the machine and default entries of a netrc file. Macro
+// definitions are skipped.
+func parseNetrc(data []byte) (map[string]netrcEntry, *netrcEntry) {
+	machines := map[string]netrcEntry{}
+	var (
+		def     *netrcEntry
+		current *netrcEntry
+		machine string
+	)
+	flush := func() {
+		if current == nil {
+			return
+		}
+		if machine == "" {
+			def = current
+		} else if _, ok := machines[machine]; !ok {
+			// like curl, the first matching entry wins.
+			machines[machine] = *current
+		}
+		current = nil
+	}
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	inMacro := false
+	for scanner.Scan() {
+		line := scanner.Text()
+		if inMacro {
+			// a macro definition ends at the first empty line.
+			inMacro = strings.TrimSpace(line) != ""
+			continue
+		}
+		fields := strings.Fields(line)
+		for i := 0; i < len(fields); i++ {
+			next := func() string {
+				if i+1 < len(fields) {
+					i++
+					return fields[i]
+				}
+				return ""
+			}
+			switch fields[i] {
+			case "machine":
+				flush()
+				machine = strings.ToLower(next())
+				current = &netrcEntry{}
+			case "default":
+				flush()
+				machine = ""
+				current = &netrcEntry{}
+			case "login":
+				if current != nil {
+					current.login = next()
+				}
+			case "password":
+				if current != nil {
+					current.password = next()
+				}
+			case "account":
+				next()
+			case "macdef":
+				flush()
+				inMacro = true
+				i = len(fields)
+			default:
+				if strings.HasPrefix(fields[i], "#") {
+					i = len(fields)
+				}
+			}
+		}
+	}
+	flush()
+	return machines, def
+}
+
+// headersFor returns the headers to add to requests to the specified host,
+// which may include a port, with the URL scheme.
+func (a *hostAuth) headersFor(scheme, host string) http.Header {
+	host = strings.ToLower(host)
+	hostname := host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		hostname = h
+	}
+	h, configured := a.headers[host]
+	if !configured {
+		h, configured = a.headers[hostname]
+	}
+	if h.Get("Authorization") != "" {
+		return h
+	}
+	entry, ok := a.netrc[hostname]
+	if !ok {
+		// the default entry would otherwise go to every host, including public
+		// mirrors, so it is only sent over HTTPS to the hosts of the
+		// credentials file.
+		if a.netrcDefault == nil || !configured || scheme != "https" {
+			return h
+		}
+		entry = *a.netrcDefault
+	}
+	h = h.Clone()
+	if h == nil {
+		h = http.Header{}
+	}
+	h.Set("Authorization", basicAuth(entry))
+	return h
+}
+
+func basicAuth(entry netrcEntry) string {
+	return "Basic " + base64.StdEncoding.EncodeToString([]byte(entry.login+":"+entry.password))
+}
+
+// gitConfig returns the git configuration sending the credentials to HTTPS
+// remotes. The default netrc entry is not passed, git reads ~/.netrc itself.
+func (a *hostAuth) gitConfig() [][2]string {
+	hosts := make([]string, 0, len(a.headers)+len(a.netrc))
+	seen := map[string]bool{}
+	for host := range a.headers {
+		hosts = append(hosts, host)
+		seen[host] = true
+	}
+	for host := range a.netrc {
+		if !seen[host] {
+			hosts = append(hosts, host)
+		}
+	}
+	sort.Strings(hosts)
+	var config [][2]string
+	for _, host := range hosts {
+		h, ok := a.headers[host]
+		if !ok || h.Get("Authorization") == "" {
+			if entry, ok := a.netrc[host]; ok {
+				h = h.Clone()
+				if h == nil {
+					h = http.Header{}
+				}
+				h.Set("Authorization", basicAuth(entry))
+			}
+		}
+		keys := make([]string, 0, len(h))
+		for k := range h {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			config = append(config, [2]string{
+				fmt.Sprintf("http.https://%s/.extraHeader", host),
+				fmt.Sprintf("%s: %s", k, h.Get(k)),
+			})
+		}
+	}
+	return config
+}
+
+// authTransport adds the credentials of the destination host to every
+// request. Since this is done per request, credentials are not leaked to
+// other hosts on redirects.
+type authTransport struct {
+	base http.RoundTripper
+	auth *hostAuth
+}
+
+func (t *authTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	h := t.auth.headersFor(req.URL.Scheme, req.URL.Host)
+	if len(h) == 0 {
+		return t.base.RoundTrip(req)
+	}
+	req = req.Clone(req.Context())
+	for k, v := range h {
+		if k == "Authorization" && req.Header.Get(k) != "" {
+			// credentials in the URL take precedence.
+			continue
+		}
+		req.Header[k] = v
+	}
+	return t.base.RoundTrip(req)
+}
@@ -0,0 +1,283 @@
+// Copyright (c) Facebook, Inc. and its affiliates.
+//
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// clampMtime is the latest modification time of extracted files, if not
+// zero. Later times are replaced by it, so that the extracted tree does not
+// depend on when the archive was created. See the --clamp-mtime flag.
+var clampMtime time.Time
+
+// defaultClampMtime returns the default of the --clamp-mtime flag, from the
+// SOURCE_DATE_EPOCH environment variable, see
+// https://reproducible-builds.org/specs/source-date-epoch/ .
+func defaultClampMtime() int64 {
+	epoch, err := strconv.ParseInt(os.Getenv("SOURCE_DATE_EPOCH"), 10, 64)
+	if err != nil {
+		return 0
+	}
+	return epoch
+}
+
+// errUnsafePath is returned for archive entries which would be written
+// outside of the destination directory.
+var errUnsafePath = errors.New("path escapes the destination directory")
+
+// archiveEntry is an entry of a tar or zip archive.
+type archiveEntry struct {
+	// path in the archive, slash-separated.
+	name string
+	// file mode, including the type bits.
+	mode  os.FileMode
+	mtime time.Time
+	// target of a symbolic link, or path in the archive of the target of a
+	// hard link.
+	linkname string
+	hardlink bool
+	// content of a regular file.
+	r io.Reader
+}
+
+// extractor writes archive entries into a destination directory. Entries
+// which would end up outside of it, either directly or through symbolic
+// links, are rejected.
+type extractor struct {
+	label string
+	// destination directory, with symbolic links resolved.
+	root string
+	// directories whose mode and modification time are applied at the end,
+	// as writing their content changes them.
+	dirs []archiveEntry
+}
+
+func newExtractor(label, dest string) (*extractor, error) {
+	root, err := filepath.EvalSymlinks(dest)
+	if err != nil {
+		return nil, err
+	}
+	return &extractor{label: label, root: root}, nil
+}
+
+// cleanEntryName returns the cleaned, slash-separated name of an archive
+// entry, or an error if it is absolute or refers to a parent directory.
+func cleanEntryName(name string) (string, error) {
+	clean := path.Clean(strings.ReplaceAll(name, "\\", "/"))
+	if path.IsAbs(clean) || filepath.IsAbs(name) || clean == ".." || strings.HasPrefix(clean, "../") {
+		return "", fmt.Errorf("%s: %w", name, errUnsafePath)
+	}
+	return clean, nil
+}
+
+// resolve returns the path of the entry with the specified cleaned name,
+// relative to the destination directory. The symbolic links in its existing
+// parent directories are resolved, and the result is checked to be within
+// the destination directory.
+func (x *extractor) resolve(name string) (string, error) {
+	p := filepath.Join(x.root, filepath.FromSlash(name))
+	// find the longest existing parent, the missing directories cannot be
+	// symbolic links.
+	existing, missing := filepath.Dir(p), ""
+	for {
+		if _, err := os.Lstat(existing); err == nil {
+			break
+		}
+		if existing == x.root {
+			return "", fmt.Errorf("%s: destination directory not found", name)
+		}
+		missing = filepath.Join(filepath.Base(existing), missing)
+		existing = filepath.Dir(existing)
+	}
+	real, err := filepath.EvalSymlinks(existing)
+	if err != nil {
+		return "", err
+	}
+	if !isWithin(real, x.root) {
+		return "", fmt.Errorf("%s: %w", name, errUnsafePath)
+	}
+	return filepath.Join(real, missing, filepath.Base(p)), nil
+}
+
+// maxLinkHops is the maximum number of symbolic links followed when resolving
+// the target of a symbolic link, like the limit of Linux.
+const maxLinkHops = 40
+
+// checkLink returns an error if the target of a symbolic link in the
+// directory dir, with symbolic links resolved, is outside of the destination
+// directory. Like the kernel does, the target is resolved component by
+// component, following the symbolic links already extracted, so that links
+// going through other links are checked too. Components which do not exist
+// yet may be created as symbolic links by later entries, so they cannot be
+// followed by "..".
+func (x *extractor) checkLink(dir, target string) error {
+	if filepath.IsAbs(target) {
+		return errUnsafePath
+	}
+	cur := dir
+	parts := strings.Split(filepath.ToSlash(target), "/")
+	hops := 0
+	missing := false
+	for len(parts) > 0 {
+		part := parts[0]
+		parts = parts[1:]
+		switch part {
+		case "", ".":
+			continue
+		case "..":
+			if missing {
+				return errUnsafePath
+			}
+			cur = filepath.Dir(cur)
+			if !isWithin(cur, x.root) {
+				return errUnsafePath
+			}
+			continue
+		}
+		next := filepath.Join(cur, part)
+		fi, err := os.Lstat(next)
+		if err != nil || missing {
+			missing = true
+			cur = next
+			continue
+		}
+		if fi.Mode()&os.ModeSymlink == 0 {
+			cur = next
+			continue
+		}
+		if hops++; hops > maxLinkHops {
+			return fmt.Errorf("too many levels of symbolic links")
+		}
+		link, err := os.Readlink(next)
+		if err != nil {
+			return err
+		}
+		if filepath.IsAbs(link) {
+			// e.g. a link created by another entry in the same directory.
+			if cur, err = filepath.EvalSymlinks(next); err != nil || !isWithin(cur, x.root) {
+				return errUnsafePath
+			}
+			continue
+		}
+		// the target of the link is resolved from the directory of the link.
+		parts = append(strings.Split(filepath.ToSlash(link), "/"), parts...)
+	}
+	return nil
+}
+
+// write extracts an entry. The name, and the link name of hard links, must
+// have been cleaned with cleanEntryName.
+func (x *extractor) write(e archiveEntry) error {
+	if e.name == "." {
+		// the destination directory itself.
+		return nil
+	}
+	p, err := x.resolve(e.name)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(p), 0o755); err != nil {
+		return err
+	}
+
+	if e.mode.IsDir() {
+		if fi, err := os.Lstat(p); err == nil && !fi.IsDir() {
+			if err := os.Remove(p); err != nil {
+				return err
+			}
+		}
+		// directories must be writable while being extracted.
+		if err := os.MkdirAll(p, 0o755); err != nil {
+			return err
+		}
+		x.dirs = append(x.dirs, e)
+		return nil
+	}
+
+	// replace any existing file rather than writing through it, it may be a
+	// symbolic link.
+	if err := os.Remove(p); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	switch {
+	case e.hardlink:
+		targetPath, err := x.resolve(e.linkname)
+		if err != nil {
+			return err
+		}
+		return os.Link(targetPath, p)
+	case e.mode&os.ModeSymlink != 0:
+		if err := x.checkLink(filepath.Dir(p), e.linkname); err != nil {
+			return fmt.Errorf("%s: symbolic link to %s: %w", e.name, e.linkname, err)
+		}
+		return os.Symlink(e.linkname, p)
+	case e.mode.IsRegular():
+		file, err := os.OpenFile(p, os.O_CREATE|os.O_EXCL|os.O_WRONLY, e.mode.Perm())
+		if err != nil {
+			return err
+		}
+		if _, err = io.Copy(file, e.r); err != nil {
+			file.Close()
+			return err
+		}
+		if err := file.Close(); err != nil {
+			return err
+		}
+		return x.chtimes(p, e.mtime)
+	default:
+		// device files and FIFOs are not needed to build, and cannot be
+		// created without privileges.
+		log.Printf("%s: Skipping %s, unsupported file type %v", x.label, e.name, e.mode.Type())
+		return nil
+	}
+}
+
+// finish applies the mode and modification time of the directories, deepest
+// first.
+func (x *extractor) finish() error {
+	for i := len(x.dirs) - 1; i >= 0; i-- {
+		e := x.dirs[i]
+		p, err := x.resolve(e.name)
+		if err != nil {
+			return err
+		}
+		if fi, err := os.Lstat(p); err != nil || !fi.IsDir() {
+			// replaced by a later entry.
+			continue
+		}
+		// keep the directories writable by the owner, other entries may
+		// write into them, and so that they can be cleaned up.
+		if err := os.Chmod(p, e.mode.Perm()|0o700); err != nil {
+			return err
+		}
+		if err := x.chtimes(p, e.mtime); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// chtimes sets the modification time of a file, clamped to clampMtime. Zero
+// times are left alone.
+func (x *extractor) chtimes(p string, mtime time.Time) error {
+	if mtime.IsZero() {
+		return nil
+	}
+	if !clampMtime.IsZero() && mtime.After(clampMtime) {
+		mtime = clampMtime
+	}
+	return os.Chtimes(p, mtime, mtime)
+}
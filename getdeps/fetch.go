@@ -6,28 +6,63 @@
 package main
 
 import (
-	"crypto/sha256"
-	"encoding/hex"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"log"
+	"math/rand"
 	"net/http"
 	"net/url"
 	"os"
-	"path"
+	"strconv"
 	"strings"
+	"syscall"
+	"time"
 )
 
-func fetch(label, urlStr string) ([]byte, error) {
-	log.Printf("%s: Downloading %s...", label, urlStr)
+// Download retry settings, see the corresponding flags.
+var (
+	fetchRetries    = 5
+	fetchBackoff    = time.Second
+	fetchMaxBackoff = time.Minute
+)
+
+// maxRetryAfter caps the delay requested by servers via Retry-After.
+const maxRetryAfter = 5 * time.Minute
+
+// downloadSink is where fetch writes the downloaded data. Reset is called when
+// a partial download cannot be resumed and has to start over, and must discard
+// everything written so far.
+type downloadSink interface {
+	io.Writer
+	Reset() error
+}
+
+// fetch downloads the specified URL and streams the response body into sink.
+// Interrupted downloads are resumed with a Range request if the server
+// supports it, transient errors and 5xx responses are retried with exponential
+// backoff. HTML pages are rejected, see fetchURL.
+func fetch(label, urlStr string, sink downloadSink) error {
+	return fetchURL(label, urlStr, sink, false)
+}
+
+// fetchURL is like fetch. If pinned is true, the content is checked against a
+// pinned hash afterwards, which vouches for it whatever its content type:
+// misconfigured servers label some artifacts as HTML.
+func fetchURL(label, urlStr string, sink downloadSink, pinned bool) error {
+	// credentials in the URL must not be logged.
+	redacted := urlStr
+	if u, err := url.Parse(urlStr); err == nil {
+		redacted = u.Redacted()
+	}
+	if offline {
+		return fmt.Errorf("%s: cannot download %s: %w", label, redacted, errOffline)
+	}
+	log.Printf("%s: Downloading %s...", label, redacted)
 
-	// Get the data
-	var (
-		resp *http.Response
-		err  error
-	)
 	client := &http.Client{
+		Transport: httpTransport,
 		CheckRedirect: func(req *http.Request, via []*http.Request) error {
 			// some servers will behave differently upon redirects if a Referer
 			// header is found, and this may cause the download to fail. So here
@@ -36,156 +71,409 @@ func fetch(label, urlStr string) ([]byte, error) {
 			return nil
 		},
 	}
-	req, err := http.NewRequest("GET", urlStr, nil)
-	if err != nil {
-		return nil, fmt.Errorf("Failed to create new http.Request: %w", err)
-	}
-	for attempts := 0; attempts < 3; attempts++ {
-		resp, err = client.Do(req)
+
+	var (
+		// number of bytes written to the sink so far.
+		written int64
+		// ETag or Last-Modified of the resource, used in If-Range to make sure
+		// that a resumed download refers to the same content.
+		validator string
+		lastErr   error
+	)
+	for attempt := 0; attempt <= fetchRetries; attempt++ {
+		if attempt > 0 {
+			delay := retryDelay(attempt, lastErr)
+			log.Printf("%s: Download failed, retrying in %v (%d/%d). Error was: %v", label, delay, attempt, fetchRetries, lastErr)
+			time.Sleep(delay)
+		}
+		req, err := http.NewRequest("GET", urlStr, nil)
+		if err != nil {
+			return fmt.Errorf("Failed to create new http.Request: %w", err)
+		}
+		if written > 0 {
+			req.Header.Set("Range", fmt.Sprintf("bytes=%d-", written))
+			req.Header.Set("If-Range", validator)
+		}
+		resp, err := client.Do(req)
 		if err != nil {
-			if uErr, ok := err.(*url.Error); ok {
-				if uErr.Temporary() || uErr.Timeout() {
-					// retryable error
-					log.Printf("Failed to get file, trying again. Error was: %v", err)
-					continue
+			if !isRetryable(err) {
+				return fmt.Errorf("%s: error while downloading %s: %w", label, redacted, err)
+			}
+			lastErr = err
+			continue
+		}
+		log.Printf("%s: Status code is %s", label, resp.Status)
+
+		switch {
+		case resp.StatusCode == http.StatusPartialContent && written > 0 && contentRangeStart(resp) == written:
+			log.Printf("%s: Resuming download at byte %d", label, written)
+		case resp.StatusCode == http.StatusPartialContent:
+			// a range other than the one requested cannot be appended to what
+			// was written so far, nor stored as the whole content.
+			resp.Body.Close()
+			lastErr = fmt.Errorf("%s: unexpected partial content %q when resuming at byte %d", redacted, resp.Header.Get("Content-Range"), written)
+			if err := sink.Reset(); err != nil {
+				return err
+			}
+			// start over without a Range request.
+			written, validator = 0, ""
+			continue
+		case resp.StatusCode >= 200 && resp.StatusCode < 300:
+			if written > 0 {
+				log.Printf("%s: Cannot resume download, starting over", label)
+				if err := sink.Reset(); err != nil {
+					resp.Body.Close()
+					return err
 				}
+				written = 0
+			}
+			if !pinned && isHTML(resp.Header.Get("Content-Type"), resp.Request.URL.Path) {
+				resp.Body.Close()
+				return fmt.Errorf("%s: %w", label, &ContentError{URL: resp.Request.URL.Redacted(), ContentType: resp.Header.Get("Content-Type")})
+			}
+			validator = resp.Header.Get("ETag")
+			if validator == "" || strings.HasPrefix(validator, "W/") {
+				// weak ETags cannot be used with If-Range.
+				validator = resp.Header.Get("Last-Modified")
 			}
-			// non-retryable error
-			return nil, fmt.Errorf("%s: error while downloading %s: %w", label, urlStr, err)
+		default:
+			resp.Body.Close()
+			err := newHTTPError(resp)
+			if !isRetryable(err) {
+				return fmt.Errorf("%s: %w", label, err)
+			}
+			lastErr = err
+			continue
+		}
+
+		n, err := io.Copy(sink, resp.Body)
+		resp.Body.Close()
+		written += n
+		if err == nil {
+			return nil
+		}
+		if validator == "" {
+			// without a validator it is not safe to resume.
+			if rErr := sink.Reset(); rErr != nil {
+				return rErr
+			}
+			written = 0
+		} else if n > 0 {
+			// the download made progress, which is kept, so don't count this
+			// as a failed attempt.
+			attempt--
 		}
-		defer resp.Body.Close()
-		log.Printf("Status code is %s", resp.Status)
-		break
+		lastErr = err
 	}
-	// At this point either the last attempt succeeded, or it failed with
-	// a retryable error, but we are out of retrie.
-	if err != nil {
-		return nil, fmt.Errorf("every download attempt has failed. Last error: %v", err)
+	// At this point the last attempt failed with a retryable error, but we are
+	// out of retries.
+	return fmt.Errorf("%s: every download attempt of %s has failed. Last error: %w", label, redacted, lastErr)
+}
+
+// isRetryable returns true if the download may succeed when tried again.
+func isRetryable(err error) bool {
+	var hErr *HTTPError
+	if errors.As(err, &hErr) {
+		return hErr.StatusCode == http.StatusTooManyRequests || errors.Is(hErr, ErrServerError)
+	}
+	var uErr *url.Error
+	if errors.As(err, &uErr) && (uErr.Temporary() || uErr.Timeout()) {
+		return true
 	}
+	return errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, syscall.ECONNRESET) ||
+		errors.Is(err, syscall.ECONNREFUSED) ||
+		errors.Is(err, syscall.EPIPE)
+}
 
-	var data []byte
-	for attempts := 0; attempts < 3; attempts++ {
-		data, err = ioutil.ReadAll(resp.Body)
-		if err != nil {
-			switch err {
-			case io.ErrUnexpectedEOF, io.ErrClosedPipe:
-				// retryable error
-				log.Printf("Failed to retrieve file, trying again. Error was: %v", err)
-				continue
-			default:
-				// non-retryable error
-				return nil, fmt.Errorf("%s: error while downloading %s: %w", label, urlStr, err)
+// retryDelay returns how long to wait before the specified retry attempt. It
+// honours the Retry-After header of 429 and 503 responses, and otherwise uses
+// exponential backoff with jitter.
+func retryDelay(attempt int, err error) time.Duration {
+	var hErr *HTTPError
+	if errors.As(err, &hErr) {
+		switch hErr.StatusCode {
+		case http.StatusTooManyRequests, http.StatusServiceUnavailable:
+			if d, ok := parseRetryAfter(hErr.Header.Get("Retry-After")); ok {
+				if d > maxRetryAfter {
+					d = maxRetryAfter
+				}
+				return d
 			}
-		} else {
-			break
 		}
 	}
-	return data, nil
+	d := fetchMaxBackoff
+	if attempt < 32 && fetchBackoff<<uint(attempt-1) < fetchMaxBackoff {
+		d = fetchBackoff << uint(attempt-1)
+	}
+	// full jitter in the upper half of the interval.
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
 }
 
-func fetchAndVerify(label, projectDir, urlStr string, hashMode HashMode, hash *string, urlOverrides *URLOverrides) ([]byte, os.FileInfo, error) {
-	if urlOverrides != nil {
-		urlStr = urlOverrides.Override(urlStr)
+// parseRetryAfter parses the value of a Retry-After header, which can be
+// either a number of seconds or an HTTP date.
+func parseRetryAfter(v string) (time.Duration, bool) {
+	if v == "" {
+		return 0, false
 	}
-
-	u, err := url.Parse(urlStr)
-	if err != nil {
-		return nil, nil, fmt.Errorf("%s: invalid URL %q: %w", label, urlStr, err)
+	if secs, err := strconv.Atoi(v); err == nil && secs >= 0 {
+		return time.Duration(secs) * time.Second, true
+	}
+	if t, err := http.ParseTime(v); err == nil {
+		d := time.Until(t)
+		if d < 0 {
+			d = 0
+		}
+		return d, true
 	}
+	return 0, false
+}
 
-	if strings.ToLower(u.Scheme) == "file" {
-		filePath := path.Join(projectDir, u.Host, u.Path)
-		fileInfo, err := os.Stat(filePath)
-		if err != nil {
-			return nil, nil, err
+// contentRangeStart returns the first byte position of a Content-Range
+// response header, or -1 if it is missing or invalid.
+func contentRangeStart(resp *http.Response) int64 {
+	var start, end, size int64
+	cr := resp.Header.Get("Content-Range")
+	if _, err := fmt.Sscanf(cr, "bytes %d-%d/%d", &start, &end, &size); err != nil {
+		// the total size may be unknown, i.e. "*".
+		if _, err := fmt.Sscanf(cr, "bytes %d-%d/*", &start, &end); err != nil {
+			return -1
 		}
-		data, err := ioutil.ReadFile(filePath)
-		return data, fileInfo, err
 	}
+	return start
+}
+
+// newDownloadFile creates the temporary file a download is streamed into. If
+// the download cache is enabled, the file is created in the cache directory
+// so it can be moved into the cache once verified.
+func newDownloadFile() (*os.File, error) {
+	if downloadCache != nil {
+		return downloadCache.TempFile()
+	}
+	return ioutil.TempFile("", "getdeps-")
+}
+
+// verifyingFile is a downloadSink that writes to a file and hashes the data
+// at the same time. The file is deliberately not embedded, so that io.Copy
+// cannot bypass Write via os.File.ReadFrom.
+type verifyingFile struct {
+	f        *os.File
+	verifier *hashVerifier
+}
+
+func (vf *verifyingFile) Write(p []byte) (int, error) {
+	n, err := vf.f.Write(p)
+	vf.verifier.Write(p[:n])
+	return n, err
+}
+
+// Reset discards all the data written so far.
+func (vf *verifyingFile) Reset() error {
+	if err := vf.f.Truncate(0); err != nil {
+		return err
+	}
+	if _, err := vf.f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	vf.verifier.Reset()
+	return nil
+}
 
-	switch hashMode {
-	case hashModeStrict:
-		if hash == nil || *hash == "" {
-			return nil, nil, fmt.Errorf("%s: %s: hash mode is strict and no hash supplied", label, urlStr)
+// fetchAndVerify fetches the content from the first of the specified URLs
+// (the primary URL followed by its mirrors) that serves it, applying URL
+// overrides to each of them, and checks it against the hash according to the
+// hash mode. See mirrorOrder for the order in which the URLs are tried.
+// The content is returned as a file opened for reading, which the caller must
+// close, along with the URL that served it. If the content was served by the
+// download cache, the URL is the one it was originally downloaded from, or
+// empty if unknown.
+// Downloads are streamed to a temporary file and hashed while being written,
+// so the data is never held in memory as a whole.
+func fetchAndVerify(label, projectDir string, urls []string, hashMode HashMode, hash *string, urlOverrides *URLOverrides) (*os.File, os.FileInfo, string, error) {
+	if len(urls) == 0 {
+		return nil, nil, "", fmt.Errorf("%s: no URL specified", label)
+	}
+	candidates := make([]*url.URL, 0, len(urls))
+	for _, urlStr := range urls {
+		if urlOverrides != nil {
+			urlStr = urlOverrides.Override(urlStr)
 		}
-	case hashModeUpdate:
-		if hash != nil {
-			*hash = ""
+		u, err := url.Parse(urlStr)
+		if err != nil {
+			return nil, nil, "", fmt.Errorf("%s: invalid URL %q: %w", label, urlStr, err)
 		}
-	case hashModePermissive:
-		// Proceed
+		candidates = append(candidates, u)
+	}
+	if mirrorOrder == mirrorOrderLatency {
+		sortByLatency(label, candidates)
 	}
 
-	var data []byte
-	if hash != nil {
-		var actualHash string
-		// blindly retry to downloading the file when hash check fails. This is
-		// to work around an odd behaviour of the GNU mirrors where the files
-		// are updated but their content is wrong for a few seconds (e.g. the
-		// tar.gz file with tar'ed but not gzip'ed content, like it's being
-		// compressed in prod).
-		for attempts := 0; attempts < 3; attempts++ {
-			data, err = fetch(label, urlStr)
-			if err != nil {
-				return nil, nil, err
+	if hash == nil {
+		var noHash string
+		hash = &noHash
+	}
+	var (
+		lastErr      error
+		checkedCache bool
+	)
+	for _, u := range candidates {
+		if isFileURL(u) {
+			f, fileInfo, err := openLocal(projectDir, u, *hash, hashMode)
+			if err == nil {
+				// the path is specific to the host, the configured origin is
+				// kept.
+				return f, fileInfo, "", nil
 			}
-			actualHash, err = verifyHash(data, *hash)
-			if err != nil {
-				log.Printf("Hash validation for %s failed, will try downloading the file again. Error is: %v", label, err)
-				continue
+			log.Printf("%s: %v", label, err)
+			lastErr = err
+			continue
+		}
+
+		if !checkedCache {
+			switch hashMode {
+			case hashModeStrict:
+				if *hash == "" {
+					return nil, nil, "", fmt.Errorf("%s: %s: hash mode is strict and no hash supplied", label, u.Redacted())
+				}
+			case hashModeUpdate:
+				*hash = ""
+			case hashModePermissive:
+				// Proceed
 			}
-			if *hash == "" {
-				*hash = actualHash
-				log.Printf("%s: Hash %s", label, actualHash)
-			} else {
-				log.Printf("%s: Hash %s (verified)", label, actualHash)
+			if downloadCache != nil && *hash != "" {
+				if f, err := openCached(label, *hash); err != nil {
+					log.Printf("%s: Failed to read %s from cache: %v", label, *hash, err)
+				} else if f != nil {
+					return f, nil, downloadCache.Origin(*hash), nil
+				}
 			}
-			return data, nil, nil
+			checkedCache = true
 		}
 
-		// at this point err is `nil` if the last attempt was successful,
-		// and not `nil` otherwise.
-		return data, nil, err
+		f, err := downloadAndVerify(label, u, hash)
+		if err == nil {
+			return f, nil, u.Redacted(), nil
+		}
+		if len(candidates) > 1 {
+			log.Printf("%s: Failed to fetch from %s, trying the next mirror. Error is: %v", label, u.Redacted(), err)
+		}
+		lastErr = err
 	}
-
-	data, err = fetch(label, urlStr)
-	return data, nil, err
+	return nil, nil, "", lastErr
 }
 
-func verifyHash(data []byte, expectedHash string) (string, error) {
-	var ct string
-	expectedHash = strings.ToLower(expectedHash)
-	if expectedHash == "" {
-		// Hash update mode
-		ct = "sha256"
-	} else {
-		parts := strings.Split(expectedHash, ":")
-		if len(parts) != 2 {
-			return "", fmt.Errorf("unsupported hash format %q", expectedHash)
-		}
-		expectedHashType := parts[0]
-		switch expectedHashType {
-		case "sha256":
-			ct = "sha256"
-		default:
-			return "", fmt.Errorf("unsupported hash type %q", expectedHashType)
-		}
+// openLocal opens the local file of a file URL. Unless the hash is being
+// updated, a pinned hash is verified, as the file may come e.g. from a vendor
+// bundle which has been tampered with.
+func openLocal(projectDir string, u *url.URL, hash string, hashMode HashMode) (*os.File, os.FileInfo, error) {
+	name := filePath(projectDir, u)
+	fileInfo, err := os.Stat(name)
+	if err != nil {
+		return nil, nil, err
 	}
-
-	var csHex string
-	switch ct {
-	case "sha256":
-		cs := sha256.Sum256(data)
-		csHex = strings.ToLower(hex.EncodeToString(cs[:]))
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, nil, err
+	}
+	if hash == "" || hashMode == hashModeUpdate {
+		return f, fileInfo, nil
+	}
+	if _, err := verifyHash(f, hash); err != nil {
+		f.Close()
+		return nil, nil, fmt.Errorf("%s: %w", name, err)
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		f.Close()
+		return nil, nil, err
 	}
+	return f, fileInfo, nil
+}
 
-	actualHash := fmt.Sprintf("%s:%s", ct, csHex)
+// downloadAndVerify downloads the specified URL into a temporary file and
+// checks it against the hash. If the hash is empty, it is set to the hash of
+// the downloaded content.
+func downloadAndVerify(label string, u *url.URL, hash *string) (*os.File, error) {
+	// blindly retry to downloading the file when hash check fails. This is
+	// to work around an odd behaviour of the GNU mirrors where the files
+	// are updated but their content is wrong for a few seconds (e.g. the
+	// tar.gz file with tar'ed but not gzip'ed content, like it's being
+	// compressed in prod).
+	var lastErr error
+	for attempts := 0; attempts < 3; attempts++ {
+		f, err := newDownloadFile()
+		if err != nil {
+			return nil, err
+		}
+		// The file is only kept if it ends up in the cache. Otherwise it is
+		// unlinked once verified, and the open file remains readable until
+		// the caller closes it.
+		tmpName := f.Name()
+		verifier, err := newHashVerifier(*hash)
+		if err == nil {
+			err = fetchURL(label, u.String(), &verifyingFile{f: f, verifier: verifier}, *hash != "")
+		}
+		if err != nil {
+			f.Close()
+			os.Remove(tmpName)
+			return nil, err
+		}
+		actualHash, err := verifier.Verify()
+		if err != nil {
+			f.Close()
+			os.Remove(tmpName)
+			log.Printf("Hash validation for %s failed, will try downloading the file again. Error is: %v", label, err)
+			lastErr = err
+			continue
+		}
+		if *hash == "" {
+			// Nothing vouches for the content, so make sure that an error page
+			// is not recorded as the artifact.
+			if err := checkContent(f, u); err != nil {
+				f.Close()
+				os.Remove(tmpName)
+				return nil, fmt.Errorf("%s: %w", label, err)
+			}
+			*hash = actualHash
+			log.Printf("%s: Hash %s", label, actualHash)
+		} else {
+			log.Printf("%s: Hash %s (verified)", label, actualHash)
+		}
+		if downloadCache != nil {
+			err := downloadCache.Commit(actualHash, tmpName)
+			if err == nil {
+				err = downloadCache.SetOrigin(actualHash, u.Redacted())
+			}
+			if err != nil {
+				log.Printf("%s: Failed to store %s in cache: %v", label, actualHash, err)
+			}
+		}
+		os.Remove(tmpName)
+		if _, err := f.Seek(0, io.SeekStart); err != nil {
+			f.Close()
+			return nil, err
+		}
+		return f, nil
+	}
 
-	var err error
+	return nil, lastErr
+}
 
-	if expectedHash != "" && actualHash != expectedHash {
-		return actualHash, fmt.Errorf("hash mismatch: expected %q, got %q", expectedHash, actualHash)
+// openCached returns the cache entry for the specified hash after verifying
+// it, or nil if there is no valid entry. Corrupted entries are removed.
+func openCached(label, hash string) (*os.File, error) {
+	f, err := downloadCache.Open(hash)
+	if err != nil || f == nil {
+		return nil, err
 	}
-
-	return actualHash, err
+	actualHash, err := verifyHash(f, hash)
+	if err == nil {
+		_, err = f.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		f.Close()
+		log.Printf("%s: Cached entry is corrupted, removing it. Error is: %v", label, err)
+		return nil, downloadCache.Remove(hash)
+	}
+	log.Printf("%s: Hash %s (verified, cached)", label, actualHash)
+	return f, nil
 }
@@ -0,0 +1,289 @@
+// Copyright (c) Facebook, Inc. and its affiliates.
+//
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestVerifyHash(t *testing.T) {
+	h, err := verifyHash(strings.NewReader("hello"), "")
+	require.NoError(t, err)
+	assert.Equal(t, testHash, h)
+
+	h, err = verifyHash(strings.NewReader("hello"), strings.ToUpper(testHash))
+	require.NoError(t, err)
+	assert.Equal(t, testHash, h)
+
+	_, err = verifyHash(strings.NewReader("goodbye"), testHash)
+	assert.Error(t, err)
+
+	_, err = verifyHash(strings.NewReader("hello"), "md5:5d41402abc4b2a76b9719d911017c592")
+	assert.Error(t, err)
+
+	sha512Hash := "sha512:9b71d224bd62f3785d96d46ad3ea3d73319bfbc2890caadae2dff72519673ca72323c3d99ba5c11d7c7acc6e14b8c5da0c4663475c2e5c3adef46f73bcdec043"
+	blake2bHash := "blake2b-256:324dcf027dd4a30a932c441f365a25e86b173defa4b8e58948253471b81b72cf"
+	h, err = verifyHash(strings.NewReader("hello"), sha512Hash)
+	require.NoError(t, err)
+	assert.Equal(t, sha512Hash, h)
+
+	// multiple hashes must all match.
+	h, err = verifyHash(strings.NewReader("hello"), testHash+", "+blake2bHash)
+	require.NoError(t, err)
+	assert.Equal(t, testHash+","+blake2bHash, h)
+	_, err = verifyHash(strings.NewReader("hello"), testHash+",blake2b-256:0000")
+	assert.Error(t, err)
+
+	// update mode records the configured hash types.
+	updateHashTypes = []string{"sha256", "sha512"}
+	defer func() { updateHashTypes = []string{"sha256"} }()
+	h, err = verifyHash(strings.NewReader("hello"), "")
+	require.NoError(t, err)
+	assert.Equal(t, testHash+","+sha512Hash, h)
+}
+
+func TestFetchAndVerify(t *testing.T) {
+	requests := 0
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.Write([]byte("hello"))
+	}))
+	defer ts.Close()
+
+	dir, err := ioutil.TempDir("", "getdeps-cache")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	downloadCache, err = NewDownloadCache(dir)
+	require.NoError(t, err)
+	defer func() { downloadCache = nil }()
+
+	// hash update mode: the hash is recorded and the file is cached.
+	hash := "sha256:0000"
+	f, _, fetchedFrom, err := fetchAndVerify("test", "", []string{ts.URL + "/hello.txt"}, hashModeUpdate, &hash, nil)
+	require.NoError(t, err)
+	assert.Equal(t, ts.URL+"/hello.txt", fetchedFrom)
+	data, err := ioutil.ReadAll(f)
+	f.Close()
+	require.NoError(t, err)
+	assert.Equal(t, "hello", string(data))
+	assert.Equal(t, testHash, hash)
+	assert.Equal(t, 1, requests)
+
+	// strict mode: served from the cache, which knows where it came from.
+	f, _, fetchedFrom, err = fetchAndVerify("test", "", []string{ts.URL + "/hello.txt"}, hashModeStrict, &hash, nil)
+	require.NoError(t, err)
+	assert.Equal(t, ts.URL+"/hello.txt", fetchedFrom)
+	data, err = ioutil.ReadAll(f)
+	f.Close()
+	require.NoError(t, err)
+	assert.Equal(t, "hello", string(data))
+	assert.Equal(t, 1, requests)
+
+	// strict mode without hash fails.
+	noHash := ""
+	_, _, _, err = fetchAndVerify("test", "", []string{ts.URL + "/hello.txt"}, hashModeStrict, &noHash, nil)
+	assert.Error(t, err)
+}
+
+type bufferSink struct {
+	bytes.Buffer
+}
+
+func (b *bufferSink) Reset() error {
+	b.Buffer.Reset()
+	return nil
+}
+
+func TestFetchResume(t *testing.T) {
+	fetchBackoff = time.Millisecond
+	content := bytes.Repeat([]byte("0123456789"), 1000)
+	modTime := time.Now()
+	var ranges []string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ranges = append(ranges, r.Header.Get("Range"))
+		w.Header().Set("ETag", `"v1"`)
+		switch len(ranges) {
+		case 1:
+			// drop the connection half way through.
+			w.Header().Set("Content-Length", strconv.Itoa(len(content)))
+			w.Write(content[:len(content)/2])
+			w.(http.Flusher).Flush()
+			conn, _, err := w.(http.Hijacker).Hijack()
+			require.NoError(t, err)
+			conn.Close()
+		case 2:
+			w.Header().Set("Retry-After", "0")
+			w.WriteHeader(http.StatusServiceUnavailable)
+		default:
+			http.ServeContent(w, r, "data", modTime, bytes.NewReader(content))
+		}
+	}))
+	defer ts.Close()
+
+	var sink bufferSink
+	require.NoError(t, fetch("test", ts.URL, &sink))
+	assert.Equal(t, content, sink.Bytes())
+	assert.Equal(t, []string{"", "bytes=5000-", "bytes=5000-"}, ranges)
+}
+
+func TestFetchResumeWrongRange(t *testing.T) {
+	fetchBackoff = time.Millisecond
+	content := bytes.Repeat([]byte("0123456789"), 1000)
+	var ranges []string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ranges = append(ranges, r.Header.Get("Range"))
+		w.Header().Set("ETag", `"v1"`)
+		switch len(ranges) {
+		case 1:
+			w.Header().Set("Content-Length", strconv.Itoa(len(content)))
+			w.Write(content[:len(content)/2])
+			w.(http.Flusher).Flush()
+			conn, _, err := w.(http.Hijacker).Hijack()
+			require.NoError(t, err)
+			conn.Close()
+		case 2:
+			// a range other than the one requested.
+			w.Header().Set("Content-Range", fmt.Sprintf("bytes 1000-%d/%d", len(content)-1, len(content)))
+			w.WriteHeader(http.StatusPartialContent)
+			w.Write(content[1000:])
+		default:
+			w.Write(content)
+		}
+	}))
+	defer ts.Close()
+
+	var sink bufferSink
+	require.NoError(t, fetch("test", ts.URL, &sink))
+	assert.Equal(t, content, sink.Bytes())
+	assert.Equal(t, []string{"", "bytes=5000-", ""}, ranges)
+}
+
+func TestFetchTruncatedWithoutValidator(t *testing.T) {
+	fetchBackoff = time.Millisecond
+	content := bytes.Repeat([]byte("0123456789"), 1000)
+	requests := 0
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		// no ETag nor Last-Modified, and the connection always drops.
+		w.Header().Set("Content-Length", strconv.Itoa(len(content)))
+		w.Write(content[:len(content)/2])
+		w.(http.Flusher).Flush()
+		conn, _, err := w.(http.Hijacker).Hijack()
+		require.NoError(t, err)
+		conn.Close()
+	}))
+	defer ts.Close()
+
+	var sink bufferSink
+	err := fetch("test", ts.URL, &sink)
+	assert.ErrorContains(t, err, "every download attempt")
+	assert.Equal(t, fetchRetries+1, requests)
+	assert.Empty(t, sink.Bytes())
+}
+
+func TestFetchHTTPErrors(t *testing.T) {
+	fetchBackoff = time.Millisecond
+	requests := 0
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if r.URL.Path == "/missing" {
+			http.NotFound(w, r)
+			return
+		}
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer ts.Close()
+
+	var sink bufferSink
+	// 4xx are not retried.
+	err := fetch("test", ts.URL+"/missing", &sink)
+	assert.True(t, errors.Is(err, ErrNotFound))
+	assert.Contains(t, err.Error(), ts.URL+"/missing")
+	assert.Contains(t, err.Error(), "404")
+	assert.Equal(t, 1, requests)
+
+	// 5xx are retried.
+	requests = 0
+	err = fetch("test", ts.URL+"/broken", &sink)
+	assert.True(t, errors.Is(err, ErrServerError))
+	assert.False(t, errors.Is(err, ErrNotFound))
+	assert.Equal(t, fetchRetries+1, requests)
+}
+
+func TestFetchAndVerifyHTML(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/labeled.tar.gz" {
+			w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		} else {
+			// no content type, the content has to be sniffed.
+			w.Header()["Content-Type"] = nil
+		}
+		w.Write([]byte("<!DOCTYPE html><html><body>Please log in</body></html>"))
+	}))
+	defer ts.Close()
+
+	for _, name := range []string{"labeled.tar.gz", "unlabeled.tar.gz"} {
+		hash := ""
+		_, _, _, err := fetchAndVerify("test", "", []string{ts.URL + "/" + name}, hashModeUpdate, &hash, nil)
+		assert.True(t, errors.Is(err, ErrUnexpectedContent), name)
+		assert.Equal(t, "", hash, name)
+	}
+}
+
+func TestFetchAndVerifyPinnedHTML(t *testing.T) {
+	// a pinned artifact is accepted whatever its content type.
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		w.Write([]byte("hello"))
+	}))
+	defer ts.Close()
+
+	hash := testHash
+	f, _, _, err := fetchAndVerify("test", "", []string{ts.URL + "/hello.tar.gz"}, hashModeStrict, &hash, nil)
+	require.NoError(t, err)
+	f.Close()
+	hash = ""
+	_, _, _, err = fetchAndVerify("test", "", []string{ts.URL + "/hello.tar.gz"}, hashModeUpdate, &hash, nil)
+	assert.True(t, errors.Is(err, ErrUnexpectedContent), err)
+}
+
+func TestFetchAndVerifyMirrors(t *testing.T) {
+	down := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.NotFound(w, r)
+	}))
+	defer down.Close()
+	up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("hello"))
+	}))
+	defer up.Close()
+
+	overrides := URLOverrides{"https://mirror.example.com/hello.txt": up.URL + "/hello.txt"}
+	hash := testHash
+	f, _, fetchedFrom, err := fetchAndVerify("test", "", []string{down.URL + "/hello.txt", "https://mirror.example.com/hello.txt"}, hashModeStrict, &hash, &overrides)
+	require.NoError(t, err)
+	f.Close()
+	assert.Equal(t, up.URL+"/hello.txt", fetchedFrom)
+
+	mirrorOrder = mirrorOrderLatency
+	defer func() { mirrorOrder = mirrorOrderConfig }()
+	f, _, fetchedFrom, err = fetchAndVerify("test", "", []string{down.URL + "/hello.txt", up.URL + "/hello.txt"}, hashModeStrict, &hash, nil)
+	require.NoError(t, err)
+	f.Close()
+	assert.Equal(t, up.URL+"/hello.txt", fetchedFrom)
+}
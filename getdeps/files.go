@@ -7,16 +7,23 @@ package main
 
 import (
 	"fmt"
-	"io/ioutil"
+	"io"
 	"net/url"
 	"os"
 	"path"
+	"path/filepath"
 )
 
 // File represents a single file to be fetched
 type File struct {
-	URL  string `json:"url"`
-	Hash string `json:"hash,omitempty"`
+	URL string `json:"url"`
+	// Alternative URLs serving the same content, see fetchAndVerify.
+	Mirrors []string `json:"mirrors,omitempty"`
+	Hash    string   `json:"hash,omitempty"`
+	// Optional detached signature, verified before writing the file.
+	Signature *Signature `json:"signature,omitempty"`
+	// URL the file was actually fetched from. Set by Files.Get.
+	FetchedFrom string `json:"fetched_from,omitempty"`
 }
 
 // Files represents a list of files that need to be fetched
@@ -27,35 +34,79 @@ type Files struct {
 }
 
 // Get download the list of files
-func (ff *Files) Get(projectDir string, urlOverrides *URLOverrides, hashMode HashMode) error {
-	for i, f := range ff.Filelist {
-		u, err := url.Parse(f.URL)
+func (ff *Files) Get(projectDir, workDir string, urlOverrides *URLOverrides, hashMode HashMode) error {
+	for i := range ff.Filelist {
+		src, fileInfo, err := ff.fetch(i, projectDir, urlOverrides, hashMode)
 		if err != nil {
-			return fmt.Errorf("%s: Invalid URL %q", ff.Label, f.URL)
+			return err
 		}
-
-		name := path.Base(u.Path)
-
-		bytes, fileInfo, err := fetchAndVerify(ff.Label, projectDir, f.URL, hashMode, &f.Hash, urlOverrides)
+		err = ff.write(i, src, fileInfo, workDir)
+		src.Close()
 		if err != nil {
-			return fmt.Errorf("%s: %s: %w", ff.Label, name, err)
-		}
-
-		if err = os.MkdirAll(ff.Dest, os.ModePerm); err != nil {
 			return err
 		}
+	}
 
-		path := path.Join(ff.Dest, name)
-		perms := os.FileMode(0644)
-		if fileInfo != nil {
-			perms = fileInfo.Mode()
-		}
-		if err = ioutil.WriteFile(path, bytes, perms); err != nil {
-			return err
-		}
+	return nil
+}
+
+// fetch downloads the i-th file of the list. The caller must close the
+// returned file.
+func (ff *Files) fetch(i int, projectDir string, urlOverrides *URLOverrides, hashMode HashMode) (*os.File, os.FileInfo, error) {
+	f := &ff.Filelist[i]
+	src, fileInfo, fetchedFrom, err := fetchAndVerify(ff.Label, projectDir, append([]string{f.URL}, f.Mirrors...), hashMode, &f.Hash, urlOverrides)
+	if err != nil {
+		return nil, nil, fmt.Errorf("%s: %s: %w", ff.Label, f.name(), err)
+	}
+	// entries cached before their origin was recorded keep the configured one.
+	if fetchedFrom != "" {
+		f.FetchedFrom = fetchedFrom
+	}
+	if err := verifySignature(ff.Label, projectDir, f.Signature, src, urlOverrides); err != nil {
+		src.Close()
+		return nil, nil, fmt.Errorf("%s: %s: %w", ff.Label, f.name(), err)
+	}
+	return src, fileInfo, nil
+}
+
+// write stores the content of the i-th file of the list in the destination
+// directory under workDir.
+func (ff *Files) write(i int, src io.Reader, fileInfo os.FileInfo, workDir string) error {
+	return writeFile(filepath.Join(workDir, ff.Dest, ff.Filelist[i].name()), src, fileInfo)
+}
+
+// name returns the name of the file, i.e. the last element of its URL.
+func (f *File) name() string {
+	return urlBaseName(f.URL)
+}
 
-		ff.Filelist[i] = f
+// urlBaseName returns the last element of the path of the URL.
+func urlBaseName(urlStr string) string {
+	u, err := url.Parse(urlStr)
+	if err != nil {
+		return path.Base(urlStr)
 	}
+	return path.Base(u.Path)
+}
 
-	return nil
+// writeFile streams the content of src into a new file at the specified path,
+// creating the parent directories as needed. The file gets the permissions from
+// fileInfo if not nil, or 0644 otherwise.
+func writeFile(name string, src io.Reader, fileInfo os.FileInfo) error {
+	if err := os.MkdirAll(path.Dir(name), os.ModePerm); err != nil {
+		return err
+	}
+	perms := os.FileMode(0644)
+	if fileInfo != nil {
+		perms = fileInfo.Mode()
+	}
+	dst, err := os.OpenFile(name, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, perms)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(dst, src); err != nil {
+		dst.Close()
+		return err
+	}
+	return dst.Close()
 }
@@ -8,8 +8,10 @@ package main
 import (
 	"fmt"
 	"log"
+	"net/url"
 	"os"
 	"os/exec"
+	"path/filepath"
 	"strings"
 )
 
@@ -20,10 +22,28 @@ type Git struct {
 	Dest   string  `json:"dest,omitempty"`
 	Branch *string `json:"branch,omitempty"`
 	Hash   *string `json:"hash,omitempty"`
+	// Tag to check out instead of the branch. Set by Get if Version is set.
+	Tag *string `json:"tag,omitempty"`
+	// Version constraint selecting the newest matching tag in update mode,
+	// e.g. "~5.10". See parseVersionConstraint.
+	Version *string `json:"version,omitempty"`
+	// Keys allowed to sign the commit, or the tag, checked out. Optional.
+	VerifySignatures *SignaturePolicy `json:"verify_signatures,omitempty"`
+	// Changes cherry-picked, in order, on top of the checkout.
+	CherryPicks []CherryPick `json:"cherry_picks,omitempty"`
+	// Patches applied, in order, after the changes are cherry-picked.
+	Patches []Patch `json:"patches,omitempty"`
+	// Submodules to check out at the commits recorded by the repository,
+	// none by default.
+	Submodules *Submodules `json:"submodules,omitempty"`
+	// Commit of every submodule checked out, by path. Set by Get.
+	SubmoduleHashes map[string]string `json:"submodule_hashes,omitempty"`
 }
 
-// Get downloads a Git repository
-func (g *Git) Get(projectDir string, urlOverrides *URLOverrides, hashMode HashMode) error {
+// Get downloads a Git repository into its destination under workDir. The
+// submodules whose path is listed in skip are not checked out, as other
+// entries are fetched there.
+func (g *Git) Get(projectDir, workDir string, urlOverrides *URLOverrides, hashMode HashMode, skip []string) error {
 	branch := defaultBranch
 	if g.Branch != nil && *g.Branch != "" {
 		branch = *g.Branch
@@ -31,56 +51,128 @@ func (g *Git) Get(projectDir string, urlOverrides *URLOverrides, hashMode HashMo
 		g.Branch = &branch
 	}
 
-	dest := "."
-	if g.Dest != "" {
-		dest = g.Dest
-	}
+	dest := filepath.Join(workDir, g.Dest)
 
 	hash := ""
 	if g.Hash != nil {
 		hash = *g.Hash
 	}
-	currentHash, err := gitClone(g.Label, g.URL, dest, branch, hashMode, hash, urlOverrides)
+	ref, tag, err := resolveRef(g.Label, projectDir, g.URL, branch, g.Tag, g.Version, hash, hashMode, urlOverrides)
+	if err != nil {
+		return err
+	}
+	if tag != "" {
+		g.Tag = &tag
+	}
+	currentHash, err := gitClone(g.Label, projectDir, g.URL, dest, ref, hashMode, hash, urlOverrides, tag, g.VerifySignatures)
 	if err != nil {
 		return err
 	}
 	g.Hash = &currentHash
 
-	return nil
+	if err := g.cherryPick(projectDir, dest, hashMode, urlOverrides); err != nil {
+		return err
+	}
+	if err := applyPatches(g.Label, projectDir, dest, g.Patches, true, hashMode); err != nil {
+		return err
+	}
+	return g.updateSubmodules(projectDir, dest, urlOverrides, skip)
 }
 
 func gitCloneShallow(label, repo, ref, dest string) (err error) {
+	// Only remove the destination on failure if it was created here, it may
+	// contain the output of other entries otherwise.
+	_, statErr := os.Stat(dest)
+	created := os.IsNotExist(statErr)
 	if err = os.MkdirAll(dest, 0o755); err != nil {
 		return fmt.Errorf("%s: error creating %q: %w", label, dest, err)
 	}
 	defer func() {
 		if err != nil {
-			if dest != "." {
+			if created {
 				os.RemoveAll(dest)
 			} else {
-				os.RemoveAll(".git")
+				os.RemoveAll(filepath.Join(dest, ".git"))
 			}
 		}
 	}()
-	if err = runCommand("git", "-C", dest, "init", "-q"); err != nil {
+	if gitBackend == gitBackendGoGit {
+		if err = goGitCloneShallow(label, repo, ref, dest); err != nil {
+			return fmt.Errorf("%s: %w", label, err)
+		}
+		return nil
+	}
+	if err = runCommand(label, "git", "-C", dest, "init", "-q"); err != nil {
 		return fmt.Errorf("%s: %w", label, err)
 	}
-	if err = runCommand("git", "-C", dest, "remote", "add", "origin", repo); err != nil {
+	if err = runCommand(label, "git", "-C", dest, "remote", "add", "origin", repo); err != nil {
 		return fmt.Errorf("%s: %w", label, err)
 	}
-	if err = runCommand("git", "-C", dest, "fetch", "--depth=1", "origin", ref); err != nil {
+	if err = runCommand(label, "git", "-C", dest, "fetch", "--depth=1", "origin", ref); err != nil {
 		return fmt.Errorf("%s: %w", label, err)
 	}
-	if err = runCommand("git", "-C", dest, "checkout", "-q", ref); err != nil {
+	if err = runCommand(label, "git", "-C", dest, "checkout", "-q", ref); err != nil {
 		return fmt.Errorf("%s: %w", label, err)
 	}
 	return nil
 }
 
-func gitClone(label, repo, dest, branch string, hashMode HashMode, hash string, urlOverrides *URLOverrides) (string, error) {
+// resolveRepo applies the overrides to the repository URL. Relative paths
+// are relative to the base directory.
+func resolveRepo(projectDir, repo string, urlOverrides *URLOverrides) string {
 	if urlOverrides != nil {
 		repo = urlOverrides.Override(repo)
 	}
+	if isRelativeRepoPath(repo) {
+		repo = filepath.Join(projectDir, repo)
+	}
+	return repo
+}
+
+// isRelativeRepoPath returns true if the repository URL is a relative local
+// path. Like Git, a colon before the first slash denotes an scp-like URL,
+// e.g. "host:path", rather than a path.
+func isRelativeRepoPath(repo string) bool {
+	if repo == "" || filepath.IsAbs(repo) {
+		return false
+	}
+	i := strings.IndexAny(repo, ":/")
+	return i < 0 || repo[i] == '/'
+}
+
+// isLocalRepoPath returns true if the repository URL is a local path, rather
+// than a URL. File URLs are not local paths.
+func isLocalRepoPath(repo string) bool {
+	return filepath.IsAbs(repo) || isRelativeRepoPath(repo)
+}
+
+// redactURL returns the repository URL with its password, if any, masked, so
+// that it can be logged.
+func redactURL(repo string) string {
+	u, err := url.Parse(repo)
+	if err != nil || u.User == nil {
+		return repo
+	}
+	return u.Redacted()
+}
+
+// stripUserinfo returns the repository URL without its credentials, if any,
+// so that it can be stored.
+func stripUserinfo(repo string) string {
+	u, err := url.Parse(repo)
+	if err != nil || u.User == nil {
+		return repo
+	}
+	u.User = nil
+	return u.String()
+}
+
+// gitClone checks out the hash, or the branch if there is no hash, of the
+// repository at dest, and returns the commit checked out. If policy is not
+// nil, the checkout is rejected unless its commit, or the tag if the branch is
+// one, is signed by one of the allowed keys.
+func gitClone(label, projectDir, repo, dest, branch string, hashMode HashMode, hash string, urlOverrides *URLOverrides, tag string, policy *SignaturePolicy) (string, error) {
+	repo = resolveRepo(projectDir, repo, urlOverrides)
 
 	if branch == "" {
 		return "", fmt.Errorf("%s: branch not specified", label)
@@ -90,7 +182,54 @@ func gitClone(label, repo, dest, branch string, hashMode HashMode, hash string,
 		hash = ""
 	}
 
-	log.Printf("%s: Cloning %s (%s %s)...", label, repo, branch, hash)
+	source := repo
+	if gitCache != nil && !isLocalRepoPath(repo) {
+		log.Printf("%s: Cloning %s (%s %s) from the Git cache...", label, redactURL(repo), branch, hash)
+		if err := gitCache.clone(label, repo, branch, hash, dest); err != nil {
+			return "", err
+		}
+		source = "file://" + gitCache.path(repo)
+	} else if err := gitCloneRemote(label, repo, dest, branch, hash); err != nil {
+		return "", err
+	}
+
+	currentHash, err := gitRevParse(dest, "HEAD")
+	if err != nil {
+		return "", fmt.Errorf("%s: %w", label, err)
+	}
+	log.Printf("%s: Current hash is %s", label, currentHash)
+
+	if hashMode == hashModeStrict && hash == "" {
+		return currentHash, fmt.Errorf("%s: %s: hash mode is strict and no hash supplied (current is %s)", label, redactURL(repo), currentHash)
+	}
+	if err := policy.verifyCheckout(label, projectDir, source, dest, tag, currentHash); err != nil {
+		return currentHash, err
+	}
+
+	return currentHash, nil
+}
+
+// gitRevParse returns the commit rev resolves to in the repository at dir.
+func gitRevParse(dir, rev string) (string, error) {
+	if gitBackend == gitBackendGoGit {
+		return goGitRevParse(dir, rev)
+	}
+	cmd := exec.Command("git", "-C", dir, "rev-parse", "--verify", rev+"^{commit}")
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return "", fmt.Errorf("error running %v: %w", cmd, err)
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
+// gitCloneRemote checks out the hash, or the branch if there is no hash, of
+// the repository at dest, without the Git cache.
+func gitCloneRemote(label, repo, dest, branch, hash string) error {
+	if offline && localRepoPath(repo) == "" {
+		return fmt.Errorf("%s: cannot clone %s: %w", label, redactURL(repo), errOffline)
+	}
+
+	log.Printf("%s: Cloning %s (%s %s)...", label, redactURL(repo), branch, hash)
 
 	// Try the shallow clone first. This is much faster but requires
 	// `uploadpack.allowReachableSHA1InWant` to be enabled on the server,
@@ -112,26 +251,70 @@ func gitClone(label, repo, dest, branch string, hashMode HashMode, hash string,
 	}
 
 	if !ok {
-		if err := runCommand("git", "clone", "-q", "-b", branch, repo, dest); err != nil {
-			return "", fmt.Errorf("%s: %w", label, err)
+		if gitBackend == gitBackendGoGit {
+			if err := goGitClone(label, repo, branch, hash, dest); err != nil {
+				return fmt.Errorf("%s: %w", label, err)
+			}
+			return nil
+		}
+		if err := runCommand(label, "git", "clone", "-q", "-b", branch, repo, dest); err != nil {
+			return fmt.Errorf("%s: %w", label, err)
 		}
 		if hash != "" {
-			if err := runCommand("git", "-C", dest, "checkout", "-q", hash); err != nil {
-				return "", fmt.Errorf("%s: %w", label, err)
+			if err := runCommand(label, "git", "-C", dest, "checkout", "-q", hash); err != nil {
+				return fmt.Errorf("%s: %w", label, err)
 			}
 		}
 	}
+	return nil
+}
 
-	cmd := exec.Command("git", "-C", dest, "rev-parse", "HEAD")
-	out, err := cmd.CombinedOutput()
+// gitMirror creates a bare mirror of the repository at dest, and returns the
+// commit hash the entry resolves to in it. Like gitClone, it checks the
+// signature of the commit or tag if policy is not nil.
+func gitMirror(label, projectDir, repo, dest, branch string, hashMode HashMode, hash string, urlOverrides *URLOverrides, tag string, policy *SignaturePolicy) (string, error) {
+	repo = resolveRepo(projectDir, repo, urlOverrides)
+
+	if branch == "" {
+		return "", fmt.Errorf("%s: branch not specified", label)
+	}
+
+	if hashMode == hashModeUpdate {
+		hash = ""
+	}
+
+	if offline && localRepoPath(repo) == "" {
+		return "", fmt.Errorf("%s: cannot mirror %s: %w", label, redactURL(repo), errOffline)
+	}
+
+	log.Printf("%s: Mirroring %s...", label, redactURL(repo))
+	if err := runCommand(label, "git", "clone", "-q", "--mirror", repo, dest); err != nil {
+		return "", fmt.Errorf("%s: %w", label, err)
+	}
+	// the bundle may be shared, the credentials must not be stored in it.
+	if stripped := stripUserinfo(repo); stripped != repo {
+		if err := runCommand(label, "git", "-C", dest, "remote", "set-url", "origin", stripped); err != nil {
+			return "", fmt.Errorf("%s: %w", label, err)
+		}
+	}
+
+	ref := hash
+	if ref == "" {
+		ref = branch
+	}
+	cmd := exec.Command("git", "-C", dest, "rev-parse", "--verify", "-q", ref+"^{commit}")
+	out, err := cmd.Output()
 	if err != nil {
-		return "", fmt.Errorf("%s: error running %v: %w", label, cmd, err)
+		return "", fmt.Errorf("%s: %s: %s not found in the repository", label, redactURL(repo), ref)
 	}
 	currentHash := strings.TrimSpace(string(out))
 	log.Printf("%s: Current hash is %s", label, currentHash)
 
 	if hashMode == hashModeStrict && hash == "" {
-		return currentHash, fmt.Errorf("%s: %s: hash mode is strict and no hash supplied (current is %s)", label, repo, currentHash)
+		return currentHash, fmt.Errorf("%s: %s: hash mode is strict and no hash supplied (current is %s)", label, redactURL(repo), currentHash)
+	}
+	if err := policy.verifyCheckout(label, projectDir, "", dest, tag, currentHash); err != nil {
+		return currentHash, err
 	}
 
 	return currentHash, nil
@@ -0,0 +1,218 @@
+// Copyright (c) Facebook, Inc. and its affiliates.
+//
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+// gitCache is the cache of Git repositories used by gitClone. It is nil if
+// caching is disabled.
+var gitCache *GitCache
+
+// GitCache keeps a bare mirror of every remote Git repository, stored as
+// `<dir>/<name>-<hash of the URL>.git`. Mirrors are updated with git fetch,
+// and checkouts are made from them, so that only new commits are downloaded.
+// Like the download cache, the directory can be shared between build
+// directories and CI workers.
+type GitCache struct {
+	Dir string
+
+	mu sync.Mutex
+	// serializes the operations on each mirror, by path.
+	locks map[string]*sync.Mutex
+}
+
+// NewGitCache returns a GitCache rooted at the specified directory, creating
+// it if necessary.
+func NewGitCache(dir string) (*GitCache, error) {
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		return nil, fmt.Errorf("failed to create Git cache directory '%s': %w", dir, err)
+	}
+	return &GitCache{Dir: dir, locks: map[string]*sync.Mutex{}}, nil
+}
+
+// mirrorRefspecs are the refs kept in the mirrors of the Git cache.
+var mirrorRefspecs = [2]string{"+refs/heads/*:refs/heads/*", "+refs/tags/*:refs/tags/*"}
+
+var unsafeNameChars = regexp.MustCompile(`[^A-Za-z0-9._-]+`)
+
+// path returns the path of the mirror of the repository. The URL is hashed,
+// as it may contain credentials or characters not allowed in file names, and
+// its base name kept for readability.
+func (c *GitCache) path(repo string) string {
+	sum := sha256.Sum256([]byte(repo))
+	name := strings.TrimSuffix(path.Base(filepath.ToSlash(repo)), ".git")
+	name = unsafeNameChars.ReplaceAllString(name, "_")
+	return filepath.Join(c.Dir, fmt.Sprintf("%s-%s.git", name, hex.EncodeToString(sum[:8])))
+}
+
+// lock locks the mirror at p, and returns the function unlocking it. Besides
+// the other goroutines, other processes sharing the cache are excluded by an
+// flock on the file `<mirror>.lock`.
+func (c *GitCache) lock(p string) (func(), error) {
+	c.mu.Lock()
+	l, ok := c.locks[p]
+	if !ok {
+		l = &sync.Mutex{}
+		c.locks[p] = l
+	}
+	c.mu.Unlock()
+	l.Lock()
+	f, err := os.OpenFile(p+".lock", os.O_RDWR|os.O_CREATE, 0o666)
+	if err != nil {
+		l.Unlock()
+		return nil, err
+	}
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX); err != nil {
+		f.Close()
+		l.Unlock()
+		return nil, fmt.Errorf("error locking %s: %w", f.Name(), err)
+	}
+	return func() {
+		// closing the file releases the flock.
+		f.Close()
+		l.Unlock()
+	}, nil
+}
+
+// has returns true if the repository is mirrored, and the mirror contains
+// the specified commit.
+func (c *GitCache) has(repo, hash string) bool {
+	return exec.Command("git", "-C", c.path(repo), "cat-file", "-e", hash+"^{commit}").Run() == nil
+}
+
+// create initializes an empty mirror of the repository at p. Only branches
+// and tags are mirrored, other refs, e.g. Gerrit changes, are fetched on
+// demand. The URL is stored without credentials, which are only passed on the
+// command line of git fetch. The mirror is created in a temporary directory
+// and renamed, so that other processes sharing the cache never see a partial
+// one.
+func (c *GitCache) create(label, repo, p string) error {
+	tmp, err := ioutil.TempDir(c.Dir, ".tmp-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmp)
+	for _, args := range [][]string{
+		{"init", "-q", "--bare"},
+		{"config", "remote.origin.url", stripUserinfo(repo)},
+		{"config", "--add", "remote.origin.fetch", mirrorRefspecs[0]},
+		{"config", "--add", "remote.origin.fetch", mirrorRefspecs[1]},
+		// checkouts are shallow fetches of a single commit.
+		{"config", "uploadpack.allowAnySHA1InWant", "true"},
+	} {
+		if err := runCommand(label, "git", append([]string{"-C", tmp}, args...)...); err != nil {
+			return err
+		}
+	}
+	if err := os.Rename(tmp, p); err != nil {
+		if _, statErr := os.Stat(p); statErr == nil {
+			// created concurrently by another process.
+			return nil
+		}
+		return err
+	}
+	return nil
+}
+
+// update creates or updates the mirror of the repository, and returns its
+// path and the commit the hash, or the branch if there is no hash, resolves
+// to in it. If the commit is already in the mirror, nothing is fetched, which
+// also works in offline mode.
+func (c *GitCache) update(label, repo, branch, hash string) (string, string, error) {
+	p := c.path(repo)
+	unlock, err := c.lock(p)
+	if err != nil {
+		return "", "", fmt.Errorf("%s: %w", label, err)
+	}
+	defer unlock()
+
+	ref := hash
+	if ref == "" {
+		ref = branch
+	}
+	if hash == "" || !c.has(repo, hash) {
+		if offline && localRepoPath(repo) == "" {
+			return "", "", fmt.Errorf("%s: %s not in the Git cache: %w", label, ref, errOffline)
+		}
+		if _, err := os.Stat(p); os.IsNotExist(err) {
+			log.Printf("%s: Creating mirror of %s in the Git cache...", label, redactURL(repo))
+			if err := c.create(label, repo, p); err != nil {
+				return "", "", fmt.Errorf("%s: error creating the mirror of %s: %w", label, redactURL(repo), err)
+			}
+		}
+		log.Printf("%s: Updating the mirror of %s...", label, redactURL(repo))
+		if err := runCommand(label, "git", "-C", p, "fetch", "-q", "--prune", repo, mirrorRefspecs[0], mirrorRefspecs[1]); err != nil {
+			return "", "", fmt.Errorf("%s: %w", label, err)
+		}
+	}
+
+	commit, err := mirrorCommit(label, p, repo, ref)
+	if err != nil {
+		return "", "", fmt.Errorf("%s: %s: %w", label, redactURL(repo), err)
+	}
+	return p, commit, nil
+}
+
+// mirrorCommit returns the commit ref resolves to in the bare repository at
+// dir, a mirror of repo. Refs which are not mirrored, e.g. Gerrit changes, are
+// fetched from repo, and kept from being garbage collected.
+func mirrorCommit(label, dir, repo, ref string) (string, error) {
+	out, err := exec.Command("git", "-C", dir, "rev-parse", "--verify", "-q", ref+"^{commit}").Output()
+	if err == nil {
+		return strings.TrimSpace(string(out)), nil
+	}
+	// neither a mirrored ref, nor a commit reachable from one.
+	if err := runCommand(label, "git", "-C", dir, "fetch", "-q", repo, ref); err != nil {
+		return "", fmt.Errorf("%s not found: %w", ref, err)
+	}
+	if out, err = exec.Command("git", "-C", dir, "rev-parse", "--verify", "-q", "FETCH_HEAD^{commit}").Output(); err != nil {
+		return "", fmt.Errorf("%s is not a commit", ref)
+	}
+	commit := strings.TrimSpace(string(out))
+	if err := runCommand(label, "git", "-C", dir, "update-ref", "refs/getdeps/"+commit, commit); err != nil {
+		return "", err
+	}
+	return commit, nil
+}
+
+// clone checks out the hash, or the branch if there is no hash, of the
+// repository at dest, from its mirror.
+func (c *GitCache) clone(label, repo, branch, hash, dest string) error {
+	p, commit, err := c.update(label, repo, branch, hash)
+	if err != nil {
+		return err
+	}
+	ref := commit
+	if gitBackend == gitBackendGoGit {
+		// the in-process server of go-git only serves refs.
+		ref = "refs/getdeps/" + commit
+		if err := runCommand(label, "git", "-C", p, "update-ref", ref, commit); err != nil {
+			return fmt.Errorf("%s: %w", label, err)
+		}
+	}
+	if err := gitCloneShallow(label, "file://"+p, ref, dest); err != nil {
+		return err
+	}
+	// like the mirror, the checkout does not store the credentials.
+	if err := runCommand(label, "git", "-C", dest, "remote", "set-url", "origin", stripUserinfo(repo)); err != nil {
+		return fmt.Errorf("%s: %w", label, err)
+	}
+	return nil
+}
@@ -0,0 +1,235 @@
+// Copyright (c) Facebook, Inc. and its affiliates.
+//
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// SignaturePolicy lists the keys allowed to sign the commit, or the tag,
+// checked out for a Git or Goget entry. OpenPGP signatures are checked against
+// the keyring, SSH signatures against the allowed signers file, so at least
+// one of them must be set.
+type SignaturePolicy struct {
+	// Path of the keyring containing the allowed OpenPGP keys, either binary
+	// or ASCII-armored. Relative paths are relative to the base directory.
+	Keyring string `json:"keyring,omitempty"`
+	// Path of the allowed signers file listing the allowed SSH keys, in the
+	// format of ssh-keygen(1), as used by gpg.ssh.allowedSignersFile.
+	// Relative paths are relative to the base directory.
+	AllowedSigners string `json:"allowed_signers,omitempty"`
+	// Fingerprint of the key that signed the commit or the tag. Set once the
+	// signature is verified.
+	SignedBy string `json:"signed_by,omitempty"`
+}
+
+// Markers starting the signatures embedded in Git objects.
+const (
+	pgpSignatureMarker = "-----BEGIN PGP SIGNATURE-----"
+	sshSignatureMarker = "-----BEGIN SSH SIGNATURE-----"
+)
+
+// errUnsigned is the error returned when verifying an unsigned Git object.
+var errUnsigned = errors.New("not signed")
+
+// splitCommitSignature returns the signed content of a raw commit object,
+// i.e. the commit without its gpgsig header, and the signature.
+func splitCommitSignature(data []byte) ([]byte, []byte) {
+	var payload, sig bytes.Buffer
+	lines := strings.SplitAfter(string(data), "\n")
+	inSig, inHeaders := false, true
+	for _, line := range lines {
+		switch {
+		case !inHeaders:
+			payload.WriteString(line)
+		case inSig && strings.HasPrefix(line, " "):
+			// continuation of the signature header.
+			sig.WriteString(line[1:])
+		case strings.HasPrefix(line, "gpgsig "):
+			inSig = true
+			sig.WriteString(strings.TrimPrefix(line, "gpgsig "))
+		default:
+			inSig = false
+			if line == "\n" {
+				inHeaders = false
+			}
+			payload.WriteString(line)
+		}
+	}
+	return payload.Bytes(), sig.Bytes()
+}
+
+// splitTagSignature returns the signed content of a raw tag object, i.e. the
+// tag without the signature appended to its message, and the signature.
+func splitTagSignature(data []byte) ([]byte, []byte) {
+	i := -1
+	for _, marker := range []string{pgpSignatureMarker, sshSignatureMarker} {
+		if j := bytes.LastIndex(data, []byte("\n"+marker)); j > i {
+			i = j
+		}
+	}
+	if i < 0 {
+		return data, nil
+	}
+	return data[:i+1], data[i+1:]
+}
+
+// verify checks that the Git object, a commit or an annotated tag, of the
+// repository at dir is signed by one of the allowed keys, and records the
+// fingerprint of the key.
+func (p *SignaturePolicy) verify(label, projectDir, dir, object string) error {
+	if p.Keyring == "" && p.AllowedSigners == "" {
+		return fmt.Errorf("%s: verify_signatures: keyring or allowed signers must be specified", label)
+	}
+	out, err := exec.Command("git", "-C", dir, "cat-file", "-t", object).Output()
+	if err != nil {
+		return fmt.Errorf("%s: %s not found", label, object)
+	}
+	objType := strings.TrimSpace(string(out))
+	data, err := exec.Command("git", "-C", dir, "cat-file", objType, object).Output()
+	if err != nil {
+		return fmt.Errorf("%s: failed to read %s: %w", label, object, err)
+	}
+	var payload, sig []byte
+	switch objType {
+	case "commit":
+		payload, sig = splitCommitSignature(data)
+	case "tag":
+		payload, sig = splitTagSignature(data)
+	default:
+		return fmt.Errorf("%s: %s is a %s, not a commit or a tag", label, object, objType)
+	}
+
+	var signer string
+	switch {
+	case len(sig) == 0:
+		err = errUnsigned
+	case bytes.HasPrefix(sig, []byte(pgpSignatureMarker)):
+		signer, err = p.verifyPGP(projectDir, payload, sig)
+	case bytes.HasPrefix(sig, []byte(sshSignatureMarker)):
+		signer, err = p.verifySSH(projectDir, payload, sig)
+	default:
+		err = fmt.Errorf("unsupported signature format")
+	}
+	if err != nil {
+		return fmt.Errorf("%s: signature verification of %s %s failed: %w", label, objType, object, err)
+	}
+	p.SignedBy = signer
+	log.Printf("%s: Signature of %s %s verified, signed by %s", label, objType, object, signer)
+	return nil
+}
+
+// verifyPGP checks an OpenPGP signature against the keyring, and returns the
+// fingerprint of the primary key that made it. Like for tarballs, keys which
+// are now expired or revoked are not trusted.
+func (p *SignaturePolicy) verifyPGP(projectDir string, payload, sig []byte) (string, error) {
+	if p.Keyring == "" {
+		return "", fmt.Errorf("OpenPGP signature but no keyring specified")
+	}
+	keyringPath := p.Keyring
+	if !filepath.IsAbs(keyringPath) {
+		keyringPath = filepath.Join(projectDir, keyringPath)
+	}
+	keyring, err := readKeyring(keyringPath)
+	if err != nil {
+		return "", fmt.Errorf("failed to read keyring '%s': %w", keyringPath, err)
+	}
+	signer, err := checkDetachedSignature(keyring, bytes.NewReader(payload), bytes.NewReader(sig))
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%X", signer.PrimaryKey.Fingerprint), nil
+}
+
+// sshKeyFingerprintRe matches the fingerprint of the key in the output of
+// ssh-keygen -Y verify.
+var sshKeyFingerprintRe = regexp.MustCompile(`key (SHA256:\S+)`)
+
+// verifySSH checks an SSH signature against the allowed signers, with
+// ssh-keygen like git verify-commit does, and returns the fingerprint of the
+// key that made it.
+func (p *SignaturePolicy) verifySSH(projectDir string, payload, sig []byte) (string, error) {
+	if p.AllowedSigners == "" {
+		return "", fmt.Errorf("SSH signature but no allowed signers specified")
+	}
+	allowedSigners := p.AllowedSigners
+	if !filepath.IsAbs(allowedSigners) {
+		allowedSigners = filepath.Join(projectDir, allowedSigners)
+	}
+	if _, err := os.Stat(allowedSigners); err != nil {
+		return "", fmt.Errorf("failed to read allowed signers: %w", err)
+	}
+	f, err := ioutil.TempFile("", "getdeps-sig")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(f.Name())
+	_, err = f.Write(sig)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return "", err
+	}
+
+	out, err := exec.Command("ssh-keygen", "-Y", "find-principals", "-f", allowedSigners, "-s", f.Name()).Output()
+	principals := strings.Split(strings.TrimSpace(string(out)), "\n")
+	if err != nil || principals[0] == "" {
+		return "", fmt.Errorf("key not in the allowed signers")
+	}
+	cmd := exec.Command("ssh-keygen", "-Y", "verify", "-f", allowedSigners, "-I", principals[0], "-n", "git", "-s", f.Name())
+	cmd.Stdin = bytes.NewReader(payload)
+	out, err = cmd.CombinedOutput()
+	if err != nil {
+		return "", fmt.Errorf("%s", strings.TrimSpace(string(out)))
+	}
+	m := sshKeyFingerprintRe.FindSubmatch(out)
+	if m == nil {
+		return "", fmt.Errorf("unexpected output of ssh-keygen: %s", strings.TrimSpace(string(out)))
+	}
+	return string(m[1]), nil
+}
+
+// verifyCheckout checks the signature of the checkout at dest, whose HEAD is
+// commit: the signature of the tag if one was checked out, or of the commit
+// otherwise, or if the tag is lightweight or unsigned. The tag is fetched from
+// repo if it is not empty.
+func (p *SignaturePolicy) verifyCheckout(label, projectDir, repo, dest, tag, commit string) error {
+	if p == nil {
+		return nil
+	}
+	if tag == "" {
+		return p.verify(label, projectDir, dest, commit)
+	}
+	ref := "refs/tags/" + tag
+	if repo != "" {
+		if err := runCommand(label, "git", "-C", dest, "fetch", "-q", "--depth=1", "--no-tags", repo, "+"+ref+":"+ref); err != nil {
+			return fmt.Errorf("%s: cannot fetch tag %s: %w", label, tag, err)
+		}
+	}
+	out, err := exec.Command("git", "-C", dest, "rev-parse", "--verify", "-q", ref+"^{commit}").Output()
+	if err != nil {
+		return fmt.Errorf("%s: tag %s not found", label, tag)
+	}
+	if tagged := strings.TrimSpace(string(out)); tagged != commit {
+		return fmt.Errorf("%s: tag %s points at %s, not at the checked out %s", label, tag, tagged, commit)
+	}
+	if out, err = exec.Command("git", "-C", dest, "cat-file", "-t", ref).Output(); err == nil && strings.TrimSpace(string(out)) == "tag" {
+		if err := p.verify(label, projectDir, dest, ref); !errors.Is(err, errUnsigned) {
+			return err
+		}
+	}
+	return p.verify(label, projectDir, dest, commit)
+}
@@ -0,0 +1,166 @@
+// Copyright (c) Facebook, Inc. and its affiliates.
+//
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"github.com/ProtonMail/go-crypto/openpgp/packet"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// writeTestGitObject writes a raw object to the repository, with the
+// signature made by sign over its content, and returns its hash.
+func writeTestGitObject(t *testing.T, repo, objType, headers, message string, sign func([]byte) string) string {
+	payload := headers + "\n" + message
+	var obj string
+	switch sig := sign([]byte(payload)); {
+	case sig == "":
+		obj = payload
+	case objType == "commit":
+		sig = strings.ReplaceAll(strings.TrimSpace(sig), "\n", "\n ")
+		obj = headers + "gpgsig " + sig + "\n\n" + message
+	default:
+		obj = payload + sig
+	}
+	cmd := exec.Command("git", "-C", repo, "hash-object", "-t", objType, "-w", "--stdin")
+	cmd.Stdin = strings.NewReader(obj)
+	out, err := cmd.Output()
+	require.NoError(t, err)
+	return strings.TrimSpace(string(out))
+}
+
+func TestSplitCommitSignature(t *testing.T) {
+	commit := "tree 1234\nauthor a <a@example.com> 0 +0000\ngpgsig -----BEGIN PGP SIGNATURE-----\n \n abcd\n -----END PGP SIGNATURE-----\ncommitter c <c@example.com> 0 +0000\n\nmessage\n gpgsig\n"
+	payload, sig := splitCommitSignature([]byte(commit))
+	assert.Equal(t, "tree 1234\nauthor a <a@example.com> 0 +0000\ncommitter c <c@example.com> 0 +0000\n\nmessage\n gpgsig\n", string(payload))
+	assert.Equal(t, "-----BEGIN PGP SIGNATURE-----\n\nabcd\n-----END PGP SIGNATURE-----\n", string(sig))
+
+	payload, sig = splitCommitSignature([]byte("tree 1234\n\nmessage\n"))
+	assert.Equal(t, "tree 1234\n\nmessage\n", string(payload))
+	assert.Empty(t, sig)
+}
+
+func TestGitVerifySignatures(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not found")
+	}
+	projectDir, err := ioutil.TempDir("", "getdeps-project")
+	require.NoError(t, err)
+	defer os.RemoveAll(projectDir)
+	signer, _ := newTestKeyring(t, projectDir, "signer")
+	newTestKeyring(t, projectDir, "other")
+	fingerprint := fmt.Sprintf("%X", signer.PrimaryKey.Fingerprint)
+	pgpSign := func(payload []byte) string {
+		var sig bytes.Buffer
+		require.NoError(t, openpgp.ArmoredDetachSign(&sig, signer, bytes.NewReader(payload), nil))
+		return sig.String() + "\n"
+	}
+	unsigned := func([]byte) string { return "" }
+
+	repo := newTestGitRepo(t, map[string]string{"README": "coreboot"})
+	base := runTestGit(t, repo, "rev-parse", "HEAD")
+	headers := fmt.Sprintf("tree %s\nparent %s\nauthor a <a@example.com> 1700000000 +0000\ncommitter a <a@example.com> 1700000000 +0000\n", runTestGit(t, repo, "rev-parse", "HEAD^{tree}"), base)
+	signed := writeTestGitObject(t, repo, "commit", headers, "signed\n", pgpSign)
+	runTestGit(t, repo, "update-ref", "refs/heads/signed", signed)
+	tag := func(name, commit string, sign func([]byte) string) {
+		headers := fmt.Sprintf("object %s\ntype commit\ntag %s\ntagger a <a@example.com> 1700000000 +0000\n", commit, name)
+		runTestGit(t, repo, "update-ref", "refs/tags/"+name, writeTestGitObject(t, repo, "tag", headers, "release\n", sign))
+	}
+	tag("v1.0", base, pgpSign)
+	tag("v1.1", base, unsigned)
+	tag("v1.2", signed, unsigned)
+	// the same key, revoked since the objects were signed.
+	require.NoError(t, signer.RevokeKey(packet.KeyRetired, "retired", nil))
+	writeTestKeyring(t, signer, filepath.Join(projectDir, "revoked.asc"))
+
+	get := func(g *Git, hashMode HashMode) error {
+		workDir, err := ioutil.TempDir("", "getdeps-work")
+		require.NoError(t, err)
+		t.Cleanup(func() { os.RemoveAll(workDir) })
+		return g.Get(projectDir, workDir, nil, hashMode, nil)
+	}
+	strPtr := func(s string) *string { return &s }
+
+	for _, cached := range []bool{false, true} {
+		if cached {
+			dir, err := ioutil.TempDir("", "getdeps-gitcache")
+			require.NoError(t, err)
+			defer os.RemoveAll(dir)
+			gitCache, err = NewGitCache(dir)
+			require.NoError(t, err)
+			defer func() { gitCache = nil }()
+		}
+
+		for _, tc := range []struct {
+			name    string
+			g       Git
+			keyring string
+			err     string
+		}{
+			{"signed commit", Git{Branch: strPtr("signed")}, "signer.asc", ""},
+			{"other key", Git{Branch: strPtr("signed")}, "other.asc", "signature verification of commit"},
+			{"revoked key", Git{Branch: strPtr("signed")}, "revoked.asc", "revoked"},
+			{"unsigned commit", Git{Hash: &base}, "signer.asc", "not signed"},
+			{"signed tag", Git{Tag: strPtr("v1.0"), Hash: &base}, "signer.asc", ""},
+			{"signed tag, other key", Git{Tag: strPtr("v1.0")}, "other.asc", "signature verification of tag"},
+			{"signed tag, revoked key", Git{Tag: strPtr("v1.0")}, "revoked.asc", "revoked"},
+			{"unsigned tag", Git{Tag: strPtr("v1.1")}, "signer.asc", "not signed"},
+			{"unsigned tag, signed commit", Git{Tag: strPtr("v1.2")}, "signer.asc", ""},
+		} {
+			g := tc.g
+			g.Label, g.URL = "coreboot", "file://"+repo
+			g.VerifySignatures = &SignaturePolicy{Keyring: tc.keyring}
+			err := get(&g, hashModePermissive)
+			if tc.err != "" {
+				require.Error(t, err, tc.name)
+				assert.Contains(t, err.Error(), tc.err, tc.name)
+				continue
+			}
+			require.NoError(t, err, tc.name)
+			assert.Equal(t, fingerprint, g.VerifySignatures.SignedBy, tc.name)
+		}
+	}
+
+	if _, err := exec.LookPath("ssh-keygen"); err != nil {
+		t.Log("ssh-keygen not found, skipping SSH signatures")
+		return
+	}
+	key := filepath.Join(projectDir, "id_ed25519")
+	out, err := exec.Command("ssh-keygen", "-q", "-t", "ed25519", "-N", "", "-C", "", "-f", key).CombinedOutput()
+	require.NoError(t, err, string(out))
+	pub, err := ioutil.ReadFile(key + ".pub")
+	require.NoError(t, err)
+	require.NoError(t, ioutil.WriteFile(filepath.Join(projectDir, "allowed_signers"), []byte("a@example.com "+string(pub)), 0644))
+	sshSign := func(payload []byte) string {
+		cmd := exec.Command("ssh-keygen", "-q", "-Y", "sign", "-f", key, "-n", "git")
+		cmd.Stdin = bytes.NewReader(payload)
+		out, err := cmd.Output()
+		require.NoError(t, err)
+		return string(out)
+	}
+	sshSigned := writeTestGitObject(t, repo, "commit", headers, "ssh signed\n", sshSign)
+	runTestGit(t, repo, "update-ref", "refs/heads/ssh-signed", sshSigned)
+
+	g := &Git{Label: "coreboot", URL: "file://" + repo, Branch: strPtr("ssh-signed"), VerifySignatures: &SignaturePolicy{AllowedSigners: "allowed_signers"}}
+	require.NoError(t, get(g, hashModePermissive))
+	assert.True(t, strings.HasPrefix(g.VerifySignatures.SignedBy, "SHA256:"), g.VerifySignatures.SignedBy)
+
+	// OpenPGP signatures need a keyring.
+	g.Branch, g.Hash = strPtr("signed"), nil
+	err = get(g, hashModePermissive)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "no keyring")
+}
@@ -0,0 +1,379 @@
+// Copyright (c) Facebook, Inc. and its affiliates.
+//
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+
+	git "github.com/go-git/go-git/v5"
+	gitconfig "github.com/go-git/go-git/v5/config"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/go-git/go-git/v5/plumbing/storer"
+	"github.com/go-git/go-git/v5/plumbing/transport"
+	"github.com/go-git/go-git/v5/plumbing/transport/client"
+	githttp "github.com/go-git/go-git/v5/plumbing/transport/http"
+	"github.com/go-git/go-git/v5/plumbing/transport/server"
+	"github.com/go-git/go-git/v5/storage/memory"
+)
+
+// GitBackend is the implementation of the basic Git operations used to check
+// out the repositories. See constants below.
+type GitBackend string
+
+const (
+	// gitBackendExec runs the git binary.
+	gitBackendExec GitBackend = "git"
+	// gitBackendGoGit performs the operations in-process with go-git, so that
+	// no git binary is needed, and the results do not depend on its version.
+	// Submodules, cherry-picks, patches generated by git format-patch, the Git
+	// cache, signature verification and vendoring still run git, see
+	// gitBinaryUses.
+	gitBackendGoGit GitBackend = "go-git"
+)
+
+var (
+	gitBackend           = gitBackendExec
+	supportedGitBackends = []GitBackend{gitBackendExec, gitBackendGoGit}
+)
+
+// GitError is returned by the go-git backend when a Git operation fails. Err
+// is the go-git error, e.g. plumbing.ErrReferenceNotFound or
+// transport.ErrRepositoryNotFound, which errors.Is matches.
+type GitError struct {
+	// Operation that failed, e.g. "fetch" or "checkout".
+	Op string
+	// Repository URL, or path of the local repository.
+	Repo string
+	// Ref the operation applies to, if any.
+	Ref string
+	Err error
+}
+
+func (e *GitError) Error() string {
+	// the URL may contain credentials.
+	if e.Ref == "" {
+		return fmt.Sprintf("git %s %s: %v", e.Op, redactURL(e.Repo), e.Err)
+	}
+	return fmt.Sprintf("git %s %s %s: %v", e.Op, redactURL(e.Repo), e.Ref, e.Err)
+}
+
+func (e *GitError) Unwrap() error {
+	return e.Err
+}
+
+// gitBinaryUses returns a description of every feature used by the node which
+// runs the git binary, even with the go-git backend, so that the run can fail
+// before fetching anything if git is not installed.
+func (n *Node) gitBinaryUses(projectDir string) []string {
+	if n == nil {
+		return nil
+	}
+	var uses []string
+	for i, g := range n.Git {
+		if g.Submodules != nil && (g.Submodules.All || len(g.Submodules.Paths) > 0) {
+			uses = append(uses, fmt.Sprintf("git %s: submodules", g.Label))
+		}
+		if len(n.nestedGitDests(i)) > 0 {
+			uses = append(uses, fmt.Sprintf("git %s: submodule drift check of the entries under it", g.Label))
+		}
+		if len(g.CherryPicks) > 0 {
+			uses = append(uses, fmt.Sprintf("git %s: cherry-picks", g.Label))
+		}
+		for _, p := range g.Patches {
+			if data, err := ioutil.ReadFile(p.path(projectDir)); err == nil && isMailbox(data) {
+				uses = append(uses, fmt.Sprintf("git %s: patch %s, applied with git am", g.Label, p.Path))
+			}
+		}
+		if g.VerifySignatures != nil {
+			uses = append(uses, fmt.Sprintf("git %s: signature verification", g.Label))
+		}
+	}
+	for _, gg := range n.Goget {
+		if !gg.Module && gg.VerifySignatures != nil {
+			uses = append(uses, fmt.Sprintf("goget %s: signature verification", gg.Label))
+		}
+	}
+	return uses
+}
+
+// setupGoGit configures the transports of go-git: HTTPS remotes get the
+// network settings and credentials of git, see gitHTTPTransport, and local
+// repositories are read in-process rather than with git-upload-pack.
+func setupGoGit() {
+	var c *http.Client
+	if gitHTTPTransport != nil {
+		c = &http.Client{Transport: gitHTTPTransport}
+	}
+	httpClient := githttp.NewClient(c)
+	client.InstallProtocol("https", httpClient)
+	client.InstallProtocol("http", httpClient)
+	client.InstallProtocol("file", server.NewClient(goGitLoader{}))
+}
+
+// goGitLoader loads local repositories, bare or not, for the in-process
+// server of go-git.
+type goGitLoader struct{}
+
+func (goGitLoader) Load(ep *transport.Endpoint) (storer.Storer, error) {
+	r, err := git.PlainOpen(ep.Path)
+	if errors.Is(err, git.ErrRepositoryNotExists) {
+		return nil, transport.ErrRepositoryNotFound
+	} else if err != nil {
+		return nil, err
+	}
+	return r.Storer, nil
+}
+
+// goGitCloneShallow initializes a repository at dest with repo as its origin,
+// fetches ref, which is a commit hash, a tag, a branch or a full ref name,
+// without its history, and checks it out.
+func goGitCloneShallow(label, repo, ref, dest string) error {
+	r, err := git.PlainInit(dest, false)
+	if err != nil {
+		return &GitError{Op: "init", Repo: dest, Err: err}
+	}
+	remote, err := r.CreateRemote(&gitconfig.RemoteConfig{Name: "origin", URLs: []string{repo}})
+	if err != nil {
+		return &GitError{Op: "remote add", Repo: repo, Err: err}
+	}
+	src, err := goGitRemoteRef(remote, repo, ref)
+	if err != nil {
+		return err
+	}
+	dst := src
+	if plumbing.IsHash(src) {
+		dst = "refs/getdeps/checkout"
+	}
+	depth := 1
+	if localRepoPath(repo) != "" {
+		// the in-process server does not support shallow fetches, which
+		// are not worth it for local repositories anyway.
+		depth = 0
+	}
+	log.Printf("%s: Fetching %s from %s...", label, ref, redactURL(repo))
+	err = r.Fetch(&git.FetchOptions{
+		RemoteName: "origin",
+		RefSpecs:   []gitconfig.RefSpec{gitconfig.RefSpec("+" + src + ":" + dst)},
+		Depth:      depth,
+		Tags:       git.NoTags,
+	})
+	if err != nil && !errors.Is(err, git.NoErrAlreadyUpToDate) {
+		return &GitError{Op: "fetch", Repo: repo, Ref: ref, Err: err}
+	}
+	commit, err := goGitRefCommit(r, plumbing.ReferenceName(dst))
+	if err != nil {
+		return &GitError{Op: "fetch", Repo: repo, Ref: ref, Err: err}
+	}
+	return goGitCheckout(label, r, repo, commit)
+}
+
+// goGitRemoteRef returns the name of the ref of the remote to fetch for ref,
+// resolving short names like git does: tags take precedence over branches.
+// Commit hashes are returned as they are.
+func goGitRemoteRef(remote *git.Remote, repo, ref string) (string, error) {
+	if plumbing.IsHash(ref) {
+		return ref, nil
+	}
+	refs, err := remote.List(&git.ListOptions{})
+	if err != nil {
+		return "", &GitError{Op: "ls-remote", Repo: repo, Err: err}
+	}
+	names := map[plumbing.ReferenceName]bool{}
+	for _, r := range refs {
+		names[r.Name()] = true
+	}
+	for _, name := range []string{ref, "refs/" + ref, "refs/tags/" + ref, "refs/heads/" + ref} {
+		if strings.HasPrefix(name, "refs/") && names[plumbing.ReferenceName(name)] {
+			return name, nil
+		}
+	}
+	return "", &GitError{Op: "fetch", Repo: repo, Ref: ref, Err: plumbing.ErrReferenceNotFound}
+}
+
+// goGitRefCommit returns the commit the ref points at, peeling annotated
+// tags.
+func goGitRefCommit(r *git.Repository, name plumbing.ReferenceName) (plumbing.Hash, error) {
+	ref, err := r.Reference(name, true)
+	if err != nil {
+		return plumbing.ZeroHash, err
+	}
+	if tag, err := r.TagObject(ref.Hash()); err == nil {
+		c, err := tag.Commit()
+		if err != nil {
+			return plumbing.ZeroHash, err
+		}
+		return c.Hash, nil
+	}
+	return ref.Hash(), nil
+}
+
+// goGitCheckout checks out the commit, detaching HEAD.
+func goGitCheckout(label string, r *git.Repository, repo string, commit plumbing.Hash) error {
+	wt, err := r.Worktree()
+	if err != nil {
+		return &GitError{Op: "checkout", Repo: repo, Ref: commit.String(), Err: err}
+	}
+	if err := wt.Checkout(&git.CheckoutOptions{Hash: commit, Force: true}); err != nil {
+		return &GitError{Op: "checkout", Repo: repo, Ref: commit.String(), Err: err}
+	}
+	log.Printf("%s: Checked out %s", label, commit)
+	return nil
+}
+
+// goGitClone clones the repository at dest with its full history, and checks
+// out the hash, or the branch, which may also be a tag, if there is no hash.
+func goGitClone(label, repo, branch, hash, dest string) error {
+	r, err := git.PlainClone(dest, false, &git.CloneOptions{URL: repo, NoCheckout: true, Tags: git.AllTags})
+	if err != nil {
+		return &GitError{Op: "clone", Repo: repo, Err: err}
+	}
+	revs := []string{hash}
+	if hash == "" {
+		revs = []string{"refs/remotes/origin/" + branch, "refs/tags/" + branch}
+	}
+	for _, rev := range revs {
+		if commit, err := r.ResolveRevision(plumbing.Revision(rev)); err == nil {
+			return goGitCheckout(label, r, repo, *commit)
+		}
+	}
+	return &GitError{Op: "checkout", Repo: repo, Ref: revs[0], Err: plumbing.ErrReferenceNotFound}
+}
+
+// goGitRevParse returns the commit rev resolves to in the repository at dir.
+func goGitRevParse(dir, rev string) (string, error) {
+	r, err := git.PlainOpen(dir)
+	if err != nil {
+		return "", &GitError{Op: "rev-parse", Repo: dir, Ref: rev, Err: err}
+	}
+	commit, err := r.ResolveRevision(plumbing.Revision(rev))
+	if err != nil {
+		return "", &GitError{Op: "rev-parse", Repo: dir, Ref: rev, Err: err}
+	}
+	return commit.String(), nil
+}
+
+// goGitDescribe describes the commit checked out in the repository
+// containing dir like git describe --dirty --tags --always: the newest tag
+// reachable from it, followed by the number of commits since the tag and the
+// abbreviated commit, if any, or the abbreviated commit if there is no tag.
+func goGitDescribe(dir string) (string, error) {
+	r, err := git.PlainOpenWithOptions(dir, &git.PlainOpenOptions{DetectDotGit: true})
+	if err != nil {
+		return "", &GitError{Op: "describe", Repo: dir, Err: err}
+	}
+	head, err := r.Head()
+	if err != nil {
+		return "", &GitError{Op: "describe", Repo: dir, Ref: "HEAD", Err: err}
+	}
+
+	tags := map[plumbing.Hash][]string{}
+	iter, err := r.Tags()
+	if err != nil {
+		return "", &GitError{Op: "describe", Repo: dir, Err: err}
+	}
+	iter.ForEach(func(ref *plumbing.Reference) error {
+		if commit, err := goGitRefCommit(r, ref.Name()); err == nil {
+			tags[commit] = append(tags[commit], ref.Name().Short())
+		}
+		return nil
+	})
+
+	abbrev := head.Hash().String()[:7]
+	desc := abbrev
+	commits, err := r.Log(&git.LogOptions{From: head.Hash(), Order: git.LogOrderCommitterTime})
+	if err != nil {
+		return "", &GitError{Op: "describe", Repo: dir, Err: err}
+	}
+	n := 0
+	errFound := errors.New("found")
+	err = commits.ForEach(func(c *object.Commit) error {
+		if names, ok := tags[c.Hash]; ok {
+			sort.Strings(names)
+			desc = names[len(names)-1]
+			if n > 0 {
+				desc = fmt.Sprintf("%s-%d-g%s", desc, n, abbrev)
+			}
+			return errFound
+		}
+		n++
+		return nil
+	})
+	if err != nil && err != errFound {
+		return "", &GitError{Op: "describe", Repo: dir, Err: err}
+	}
+
+	wt, err := r.Worktree()
+	if err != nil {
+		return "", &GitError{Op: "describe", Repo: dir, Err: err}
+	}
+	status, err := wt.Status()
+	if err != nil {
+		return "", &GitError{Op: "describe", Repo: dir, Err: err}
+	}
+	for _, s := range status {
+		// like git describe, untracked files do not make the tree dirty.
+		if (s.Staging != git.Unmodified && s.Staging != git.Untracked) || (s.Worktree != git.Unmodified && s.Worktree != git.Untracked) {
+			desc += "-dirty"
+			break
+		}
+	}
+	return desc, nil
+}
+
+// goGitLsRemote returns the name and hash of the refs of the repository,
+// including the peeled tags, named with a ^{} suffix like git ls-remote does.
+func goGitLsRemote(repo string) ([][2]string, error) {
+	if p := localRepoPath(repo); p != "" {
+		// the in-process server does not advertise peeled tags.
+		return goGitLsLocal(p)
+	}
+	remote := git.NewRemote(memory.NewStorage(), &gitconfig.RemoteConfig{Name: "origin", URLs: []string{repo}})
+	refs, err := remote.List(&git.ListOptions{PeelingOption: git.AppendPeeled})
+	if err != nil {
+		return nil, &GitError{Op: "ls-remote", Repo: repo, Err: err}
+	}
+	var out [][2]string
+	for _, ref := range refs {
+		out = append(out, [2]string{ref.Hash().String(), ref.Name().String()})
+	}
+	return out, nil
+}
+
+// goGitLsLocal is goGitLsRemote for the local repository at dir.
+func goGitLsLocal(dir string) ([][2]string, error) {
+	r, err := git.PlainOpen(dir)
+	if err != nil {
+		return nil, &GitError{Op: "ls-remote", Repo: dir, Err: err}
+	}
+	iter, err := r.References()
+	if err != nil {
+		return nil, &GitError{Op: "ls-remote", Repo: dir, Err: err}
+	}
+	var out [][2]string
+	err = iter.ForEach(func(ref *plumbing.Reference) error {
+		if ref.Type() != plumbing.HashReference {
+			return nil
+		}
+		out = append(out, [2]string{ref.Hash().String(), ref.Name().String()})
+		if tag, err := r.TagObject(ref.Hash()); err == nil {
+			if c, err := tag.Commit(); err == nil {
+				out = append(out, [2]string{c.Hash.String(), ref.Name().String() + "^{}"})
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, &GitError{Op: "ls-remote", Repo: dir, Err: err}
+	}
+	return out, nil
+}
@@ -0,0 +1,322 @@
+// Copyright (c) Facebook, Inc. and its affiliates.
+//
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// goImport is the repository of the Go packages under an import path prefix,
+// as declared by a go-import meta tag.
+type goImport struct {
+	Prefix string `json:"prefix"`
+	VCS    string `json:"vcs"`
+	Repo   string `json:"repo"`
+}
+
+// codeHosts maps the import paths of well-known code hosting sites to their
+// repositories, without go-import discovery, like the go command does. A "*"
+// in a pattern matches one path element, and is replaced by it in the
+// repository URL.
+var codeHosts = map[string]string{
+	"github.com/*/*":        "https://github.com/*/*",
+	"gitlab.com/*/*":        "https://gitlab.com/*/*",
+	"bitbucket.org/*/*":     "https://bitbucket.org/*/*",
+	"go.googlesource.com/*": "https://go.googlesource.com/*",
+}
+
+// goImportMap maps import path patterns to repositories when go-import
+// discovery fails, e.g. in offline mode, see codeHosts. See the
+// --go-import-map flag.
+var goImportMap = map[string]string{
+	"golang.org/x/*":             "https://go.googlesource.com/*",
+	"google.golang.org/protobuf": "https://go.googlesource.com/protobuf",
+	"google.golang.org/grpc":     "https://github.com/grpc/grpc-go",
+	"google.golang.org/api":      "https://github.com/googleapis/google-api-go-client",
+	"google.golang.org/genproto": "https://github.com/googleapis/go-genproto",
+	"cloud.google.com/go":        "https://github.com/googleapis/google-cloud-go",
+	"go.uber.org/*":              "https://github.com/uber-go/*",
+	"go.etcd.io/*":               "https://github.com/etcd-io/*",
+	"go.opencensus.io":           "https://github.com/census-instrumentation/opencensus-go",
+	"go.starlark.net":            "https://github.com/google/starlark-go",
+	"gopkg.in/*":                 "https://gopkg.in/*",
+	"gopkg.in/*/*":               "https://gopkg.in/*/*",
+	"gotest.tools":               "https://github.com/gotestyourself/gotest.tools",
+	"honnef.co/go/tools":         "https://github.com/dominikh/go-tools",
+	"k8s.io/*":                   "https://github.com/kubernetes/*",
+	"sigs.k8s.io/*":              "https://github.com/kubernetes-sigs/*",
+	"mvdan.cc/*":                 "https://github.com/mvdan/*",
+}
+
+// loadGoImportMap adds the patterns of a JSON file, mapping import path
+// patterns to repositories, to goImportMap.
+func loadGoImportMap(name string) error {
+	data, err := ioutil.ReadFile(name)
+	if err != nil {
+		return err
+	}
+	var m map[string]string
+	if err := json.Unmarshal(data, &m); err != nil {
+		return fmt.Errorf("invalid Go import map %s: %w", name, err)
+	}
+	for pattern, repo := range m {
+		goImportMap[pattern] = repo
+	}
+	return nil
+}
+
+// matchGoImport returns the repository of the import path according to the
+// longest matching pattern of the table, or nil if there is none. Of patterns
+// of the same length, the one with the fewest "*" wins.
+func matchGoImport(table map[string]string, importPath string) *goImport {
+	elems := strings.Split(importPath, "/")
+	var (
+		best      *goImport
+		bestLen   int
+		bestStars int
+	)
+	for pattern, repo := range table {
+		patElems := strings.Split(pattern, "/")
+		stars := strings.Count(pattern, "*")
+		if len(patElems) > len(elems) || len(patElems) < bestLen || (len(patElems) == bestLen && stars >= bestStars) {
+			continue
+		}
+		match := true
+		for i, p := range patElems {
+			if p == "*" {
+				repo = strings.Replace(repo, "*", elems[i], 1)
+			} else if p != elems[i] {
+				match = false
+				break
+			}
+		}
+		if match {
+			best = &goImport{Prefix: strings.Join(elems[:len(patElems)], "/"), VCS: "git", Repo: repo}
+			bestLen, bestStars = len(patElems), stars
+		}
+	}
+	return best
+}
+
+// goImports caches the go-import discovery results of the run, by import
+// path.
+var goImports = struct {
+	sync.Mutex
+	m map[string]*goImport
+}{m: map[string]*goImport{}}
+
+// resolveGoImport returns the repository of the Go package at importPath. It
+// is found, in order, from a .git suffix in the import path, from the import
+// paths of well-known code hosting sites, by go-import discovery, whose
+// results are cached in the download cache, or from the mapping table if
+// discovery fails. In offline mode, only cached discovery results are used.
+func resolveGoImport(label, importPath string) (*goImport, error) {
+	// like with the go command, a .git suffix marks the repository root.
+	elems := strings.Split(importPath, "/")
+	for i := 1; i < len(elems); i++ {
+		if strings.HasSuffix(elems[i], ".git") {
+			root := strings.Join(elems[:i+1], "/")
+			return &goImport{Prefix: root, VCS: "git", Repo: "https://" + root}, nil
+		}
+	}
+	if imp := matchGoImport(codeHosts, importPath); imp != nil {
+		return imp, nil
+	}
+
+	goImports.Lock()
+	imp, ok := goImports.m[importPath]
+	goImports.Unlock()
+	if ok {
+		return imp, nil
+	}
+	if imp = readCachedGoImport(importPath); imp != nil {
+		log.Printf("%s: %s is in %s %s (cached)", label, importPath, imp.VCS, imp.Repo)
+	} else {
+		var err error
+		if offline {
+			err = errOffline
+		} else {
+			imp, err = discoverGoImport(label, importPath)
+		}
+		if err != nil {
+			if imp = matchGoImport(goImportMap, importPath); imp == nil {
+				return nil, fmt.Errorf("%s: cannot resolve import path %s: %w", label, importPath, err)
+			}
+			log.Printf("%s: go-import discovery of %s failed, using the mapping table. Error is: %v", label, importPath, err)
+			return imp, nil
+		}
+		log.Printf("%s: %s is in %s %s", label, importPath, imp.VCS, imp.Repo)
+		writeCachedGoImport(label, importPath, imp)
+	}
+	goImports.Lock()
+	goImports.m[importPath] = imp
+	goImports.Unlock()
+	return imp, nil
+}
+
+// goImportCachePath returns the path of the cached discovery result of the
+// import path, or an empty string if the download cache is disabled. The
+// import path is hashed, as it comes from the configuration and may contain
+// e.g. "..".
+func goImportCachePath(importPath string) string {
+	if downloadCache == nil {
+		return ""
+	}
+	sum := sha256.Sum256([]byte(importPath))
+	return filepath.Join(downloadCache.Dir, "go-import", hex.EncodeToString(sum[:])+".json")
+}
+
+func readCachedGoImport(importPath string) *goImport {
+	name := goImportCachePath(importPath)
+	if name == "" {
+		return nil
+	}
+	data, err := ioutil.ReadFile(name)
+	if err != nil {
+		return nil
+	}
+	var imp goImport
+	if err := json.Unmarshal(data, &imp); err != nil || checkGoImport(&imp) != nil {
+		return nil
+	}
+	return &imp
+}
+
+func writeCachedGoImport(label, importPath string, imp *goImport) {
+	name := goImportCachePath(importPath)
+	if name == "" {
+		return
+	}
+	data, err := json.Marshal(imp)
+	if err == nil {
+		err = writeFile(name, bytes.NewReader(data), nil)
+	}
+	if err != nil {
+		log.Printf("%s: Failed to cache the go-import of %s: %v", label, importPath, err)
+	}
+}
+
+// discoverGoImport fetches https://<importPath>?go-get=1 and returns the
+// go-import meta tag matching the import path.
+func discoverGoImport(label, importPath string) (*goImport, error) {
+	urlStr := "https://" + importPath + "?go-get=1"
+	log.Printf("%s: Fetching %s...", label, urlStr)
+	client := &http.Client{Transport: httpTransport}
+	resp, err := client.Get(urlStr)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	imports, err := parseGoImports(io.LimitReader(resp.Body, 1<<20))
+	if len(imports) == 0 {
+		if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+			return nil, newHTTPError(resp)
+		}
+		if err == nil {
+			err = errors.New("no go-import meta tag")
+		}
+		return nil, fmt.Errorf("%s: %w", urlStr, err)
+	}
+
+	var match *goImport
+	for i := range imports {
+		imp := &imports[i]
+		if imp.Prefix != importPath && !strings.HasPrefix(importPath, imp.Prefix+"/") {
+			continue
+		}
+		// module proxies cannot be cloned.
+		if imp.VCS == "mod" {
+			continue
+		}
+		if match != nil {
+			return nil, fmt.Errorf("%s: multiple go-import meta tags match %s", urlStr, importPath)
+		}
+		match = imp
+	}
+	if match == nil {
+		return nil, fmt.Errorf("%s: no go-import meta tag matches %s", urlStr, importPath)
+	}
+	if err := checkGoImport(match); err != nil {
+		return nil, fmt.Errorf("%s: %s: %w", urlStr, importPath, err)
+	}
+	return match, nil
+}
+
+// checkGoImport returns an error unless the go-import is a git repository
+// fetched over https. Any web page can serve go-import meta tags, and other
+// URLs, e.g. file://, ext:: or ssh ones, would let it make git read local
+// repositories, run commands or use the SSH keys of the user.
+func checkGoImport(imp *goImport) error {
+	if imp.VCS != "git" {
+		return fmt.Errorf("%s is in a %s repository, only git is supported", imp.Prefix, imp.VCS)
+	}
+	if u, err := url.Parse(imp.Repo); err != nil || u.Scheme != "https" || u.Host == "" {
+		return fmt.Errorf("repository %q of %s is not an https URL", imp.Repo, imp.Prefix)
+	}
+	return nil
+}
+
+// parseGoImports returns the go-import meta tags of the head of an HTML page.
+func parseGoImports(r io.Reader) ([]goImport, error) {
+	d := xml.NewDecoder(r)
+	d.Strict = false
+	d.AutoClose = xml.HTMLAutoClose
+	d.Entity = xml.HTMLEntity
+	d.CharsetReader = func(charset string, input io.Reader) (io.Reader, error) {
+		switch strings.ToLower(charset) {
+		case "utf-8", "ascii":
+			return input, nil
+		}
+		return nil, fmt.Errorf("unsupported charset %q", charset)
+	}
+	var imports []goImport
+	for {
+		t, err := d.RawToken()
+		if err != nil {
+			if err == io.EOF || len(imports) > 0 {
+				return imports, nil
+			}
+			return nil, err
+		}
+		if e, ok := t.(xml.StartElement); ok && strings.EqualFold(e.Name.Local, "body") {
+			return imports, nil
+		}
+		if e, ok := t.(xml.EndElement); ok && strings.EqualFold(e.Name.Local, "head") {
+			return imports, nil
+		}
+		e, ok := t.(xml.StartElement)
+		if !ok || !strings.EqualFold(e.Name.Local, "meta") || htmlAttr(e, "name") != "go-import" {
+			continue
+		}
+		if f := strings.Fields(htmlAttr(e, "content")); len(f) == 3 {
+			imports = append(imports, goImport{Prefix: f[0], VCS: f[1], Repo: f[2]})
+		}
+	}
+}
+
+// htmlAttr returns the value of the attribute of the HTML element.
+func htmlAttr(e xml.StartElement, name string) string {
+	for _, a := range e.Attr {
+		if strings.EqualFold(a.Name.Local, name) {
+			return a.Value
+		}
+	}
+	return ""
+}
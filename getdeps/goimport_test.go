@@ -0,0 +1,179 @@
+// Copyright (c) Facebook, Inc. and its affiliates.
+//
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseGoImports(t *testing.T) {
+	imports, err := parseGoImports(strings.NewReader(`<!DOCTYPE html>
+<html><head>
+<meta charset="utf-8">
+<META NAME="go-import" CONTENT="example.com/tool git https://git.example.com/tool">
+<meta name="go-import" content="example.com/tool mod https://proxy.example.com">
+<meta name="go-source" content="example.com/tool _ _ _">
+<meta name="go-import" content="invalid">
+</head>
+<body><meta name="go-import" content="example.com/other git https://git.example.com/other"></body>
+</html>`))
+	require.NoError(t, err)
+	assert.Equal(t, []goImport{
+		{Prefix: "example.com/tool", VCS: "git", Repo: "https://git.example.com/tool"},
+		{Prefix: "example.com/tool", VCS: "mod", Repo: "https://proxy.example.com"},
+	}, imports)
+}
+
+func TestMatchGoImport(t *testing.T) {
+	table := map[string]string{
+		"golang.org/x/*":   "https://go.googlesource.com/*",
+		"golang.org/x/foo": "https://github.com/golang/foo",
+		"gopkg.in/*":       "https://gopkg.in/*",
+		"gopkg.in/*/*":     "https://gopkg.in/*/*",
+	}
+	for _, tc := range []struct {
+		path, prefix, repo string
+	}{
+		{"golang.org/x/crypto", "golang.org/x/crypto", "https://go.googlesource.com/crypto"},
+		{"golang.org/x/crypto/ssh", "golang.org/x/crypto", "https://go.googlesource.com/crypto"},
+		{"golang.org/x/foo", "golang.org/x/foo", "https://github.com/golang/foo"},
+		{"gopkg.in/yaml.v2", "gopkg.in/yaml.v2", "https://gopkg.in/yaml.v2"},
+		{"gopkg.in/user/pkg.v1", "gopkg.in/user/pkg.v1", "https://gopkg.in/user/pkg.v1"},
+		{"golang.org/x", "", ""},
+		{"example.com/tool", "", ""},
+	} {
+		imp := matchGoImport(table, tc.path)
+		if tc.prefix == "" {
+			assert.Nil(t, imp, tc.path)
+			continue
+		}
+		require.NotNil(t, imp, tc.path)
+		assert.Equal(t, goImport{Prefix: tc.prefix, VCS: "git", Repo: tc.repo}, *imp, tc.path)
+	}
+}
+
+func TestResolveGoImport(t *testing.T) {
+	requests := 0
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if r.URL.Query().Get("go-get") != "1" {
+			http.NotFound(w, r)
+			return
+		}
+		switch r.URL.Path {
+		case "/tool", "/tool/cmd":
+			fmt.Fprintf(w, `<html><head><meta name="go-import" content="%s/tool git https://git.example.com/tool"></head></html>`, r.Host)
+		case "/hg":
+			fmt.Fprintf(w, `<html><head><meta name="go-import" content="%s/hg hg https://hg.example.com/hg"></head></html>`, r.Host)
+		case "/local":
+			fmt.Fprintf(w, `<html><head><meta name="go-import" content="%s/local git file:///home/user/.ssh"></head></html>`, r.Host)
+		case "/ext":
+			fmt.Fprintf(w, `<html><head><meta name="go-import" content="%s/ext git ext::sh"></head></html>`, r.Host)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer ts.Close()
+	// the certificate of the server is valid for example.com.
+	host := "example.com"
+	tr := ts.Client().Transport.(*http.Transport).Clone()
+	tr.DialContext = func(ctx context.Context, network, _ string) (net.Conn, error) {
+		return (&net.Dialer{}).DialContext(ctx, network, ts.Listener.Addr().String())
+	}
+	httpTransport = tr
+	cacheDir, err := ioutil.TempDir("", "getdeps-cache")
+	require.NoError(t, err)
+	defer os.RemoveAll(cacheDir)
+	downloadCache = &DownloadCache{Dir: cacheDir}
+	goImportMap[host+"/mapped"] = "https://git.example.com/mapped"
+	defer func() {
+		httpTransport, downloadCache = nil, nil
+		delete(goImportMap, host+"/mapped")
+		goImports.m = map[string]*goImport{}
+	}()
+
+	// discovery results are cached for the run and on disk.
+	for i := 0; i < 2; i++ {
+		pkg := Gopkg{Label: "tool", Pkg: host + "/tool"}
+		repo, err := pkg.repo()
+		require.NoError(t, err)
+		assert.Equal(t, "https://git.example.com/tool", repo)
+		assert.Equal(t, 1, requests)
+	}
+	goImports.m = map[string]*goImport{}
+	offline = true
+	repo, err := (&Gopkg{Label: "tool", Pkg: host + "/tool"}).repo()
+	offline = false
+	require.NoError(t, err)
+	assert.Equal(t, "https://git.example.com/tool", repo)
+	assert.Equal(t, 1, requests)
+
+	// the mapping table is used when discovery fails.
+	repo, err = (&Gopkg{Label: "mapped", Pkg: host + "/mapped"}).repo()
+	require.NoError(t, err)
+	assert.Equal(t, "https://git.example.com/mapped", repo)
+	offline = true
+	_, err = (&Gopkg{Label: "other", Pkg: host + "/other"}).repo()
+	offline = false
+	assert.True(t, errors.Is(err, errOffline), err)
+	_, err = (&Gopkg{Label: "other", Pkg: host + "/other"}).repo()
+	assert.True(t, errors.Is(err, ErrNotFound), err)
+
+	// the package must be the root of a git repository.
+	_, err = (&Gopkg{Label: "tool", Pkg: host + "/tool/cmd"}).repo()
+	assert.ErrorContains(t, err, "use it as pkg")
+	_, err = (&Gopkg{Label: "hg", Pkg: host + "/hg"}).repo()
+	assert.ErrorContains(t, err, "only git is supported")
+
+	// only https repositories are accepted from discovery.
+	for _, name := range []string{"local", "ext"} {
+		_, err = (&Gopkg{Label: name, Pkg: host + "/" + name}).repo()
+		assert.ErrorContains(t, err, "is not an https URL", name)
+	}
+
+	// import paths are hashed in the cache.
+	for _, importPath := range []string{host + "/../../../escape", ""} {
+		dir, err := filepath.Rel(cacheDir, filepath.Dir(goImportCachePath(importPath)))
+		require.NoError(t, err)
+		assert.Equal(t, "go-import", dir, importPath)
+	}
+
+	// code hosts, .git suffixes and non-HTTP URLs need no discovery, and the
+	// mapping table applies in offline mode.
+	requests = 0
+	for pkg, want := range map[string]string{
+		"https://github.com/u-root/u-root": "https://github.com/u-root/u-root",
+		"golang.org/x/crypto":              "https://go.googlesource.com/crypto",
+		host + "/repos/tool.git":           "https://" + host + "/repos/tool.git",
+		"file:///srv/git/tool":             "file:///srv/git/tool",
+	} {
+		if pkg == "golang.org/x/crypto" {
+			offline = true
+		}
+		repo, err := (&Gopkg{Label: "tool", Pkg: pkg}).repo()
+		offline = false
+		require.NoError(t, err, pkg)
+		assert.Equal(t, want, repo, pkg)
+	}
+	assert.Equal(t, 0, requests)
+	// URLs are cloned as they are if they cannot be resolved.
+	repo, err = (&Gopkg{Label: "other", Pkg: "https://" + host + "/other"}).repo()
+	require.NoError(t, err)
+	assert.Equal(t, "https://"+host+"/other", repo)
+}
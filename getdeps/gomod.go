@@ -0,0 +1,470 @@
+// Copyright (c) Facebook, Inc. and its affiliates.
+//
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+
+package main
+
+import (
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"golang.org/x/mod/module"
+	"golang.org/x/mod/sumdb/dirhash"
+	modzip "golang.org/x/mod/zip"
+)
+
+// moduleCacheDir is the module cache populated by goget entries in module
+// mode, relative to the working directory. Builds use it as GOMODCACHE.
+const moduleCacheDir = "gomodcache"
+
+// goproxy is the list of Go module proxies used by goget entries in module
+// mode, in the GOPROXY format. See the --goproxy flag.
+var goproxy = defaultGoproxy()
+
+// defaultGoproxy returns the default of the --goproxy flag, from the GOPROXY
+// environment variable.
+func defaultGoproxy() string {
+	if p := os.Getenv("GOPROXY"); p != "" {
+		return p
+	}
+	return "https://proxy.golang.org"
+}
+
+// moduleProxy is an element of a GOPROXY list.
+type moduleProxy struct {
+	// URL as configured, and after applying the overrides.
+	orig, url string
+	// whether the next proxy is tried on any error, rather than only if this
+	// one does not have the module.
+	fallBackOnError bool
+}
+
+// parseGoproxy parses a GOPROXY list: proxy URLs separated by commas, to try
+// the next one if a proxy does not have the module, or by pipes, to try it on
+// any error. "off" ends the list, and "direct" is skipped as modules are only
+// fetched from proxies.
+func parseGoproxy(list string, urlOverrides *URLOverrides) ([]moduleProxy, error) {
+	var proxies []moduleProxy
+	for s := list; s != ""; {
+		i := strings.IndexAny(s, ",|")
+		elem, sep := s, byte(0)
+		if i >= 0 {
+			elem, sep, s = s[:i], s[i], s[i+1:]
+		} else {
+			s = ""
+		}
+		elem = strings.TrimSpace(elem)
+		switch elem {
+		case "":
+			continue
+		case "off":
+			s = ""
+			continue
+		case "direct":
+			continue
+		}
+		p := moduleProxy{orig: elem, url: elem, fallBackOnError: sep == '|'}
+		if urlOverrides != nil {
+			p.url = urlOverrides.Override(elem)
+		}
+		if _, err := url.Parse(p.url); err != nil {
+			return nil, fmt.Errorf("invalid module proxy %q: %w", p.url, err)
+		}
+		proxies = append(proxies, p)
+	}
+	if len(proxies) == 0 {
+		return nil, fmt.Errorf("no module proxy in %q", list)
+	}
+	return proxies, nil
+}
+
+// moduleFetcher downloads modules from a list of module proxies into a
+// directory with the layout of a module proxy, e.g. the cache/download
+// directory of a module cache.
+type moduleFetcher struct {
+	label      string
+	projectDir string
+	proxies    []moduleProxy
+	dir        string
+}
+
+func newModuleFetcher(label, projectDir, proxies, dir string, urlOverrides *URLOverrides) (*moduleFetcher, error) {
+	p, err := parseGoproxy(proxies, urlOverrides)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", label, err)
+	}
+	return &moduleFetcher{label: label, projectDir: projectDir, proxies: p, dir: dir}, nil
+}
+
+// path returns the path of a file of the module version, e.g. ".zip", in
+// the directory of the fetcher.
+func (mf *moduleFetcher) path(mod module.Version, suffix string) (string, error) {
+	escPath, err := module.EscapePath(mod.Path)
+	if err != nil {
+		return "", err
+	}
+	escVersion, err := module.EscapeVersion(mod.Version)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(mf.dir, escPath, "@v", escVersion+suffix), nil
+}
+
+// download writes the file of the module, relative to its directory on the
+// proxies, e.g. "@v/list", to dst. It returns the proxy which served it.
+func (mf *moduleFetcher) download(modPath, name, dst string) (*moduleProxy, error) {
+	escPath, err := module.EscapePath(modPath)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", mf.label, err)
+	}
+	var lastErr error
+	for i := range mf.proxies {
+		p := &mf.proxies[i]
+		err := mf.downloadFile(strings.TrimSuffix(p.url, "/")+"/"+escPath+"/"+name, dst)
+		if err == nil {
+			return p, nil
+		}
+		lastErr = err
+		if !p.fallBackOnError && !errors.Is(err, ErrNotFound) && !errors.Is(err, os.ErrNotExist) {
+			break
+		}
+	}
+	return nil, lastErr
+}
+
+// downloadFile writes the content of the URL to dst, atomically so that
+// entries sharing the directory do not see partial files.
+func (mf *moduleFetcher) downloadFile(urlStr, dst string) error {
+	u, err := url.Parse(urlStr)
+	if err != nil {
+		return fmt.Errorf("%s: invalid URL %q: %w", mf.label, urlStr, err)
+	}
+	if err := os.MkdirAll(filepath.Dir(dst), 0o755); err != nil {
+		return err
+	}
+	f, err := ioutil.TempFile(filepath.Dir(dst), ".tmp-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if isFileURL(u) {
+		var src *os.File
+		if src, err = os.Open(filePath(mf.projectDir, u)); err == nil {
+			_, err = io.Copy(f, src)
+			src.Close()
+		}
+	} else {
+		err = fetch(mf.label, urlStr, &fileSink{f})
+	}
+	if cErr := f.Close(); err == nil {
+		err = cErr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), dst)
+}
+
+// fileSink is a downloadSink writing to a file.
+type fileSink struct {
+	f *os.File
+}
+
+func (fs *fileSink) Write(p []byte) (int, error) {
+	return fs.f.Write(p)
+}
+
+// Reset discards all the data written so far.
+func (fs *fileSink) Reset() error {
+	if err := fs.f.Truncate(0); err != nil {
+		return err
+	}
+	_, err := fs.f.Seek(0, io.SeekStart)
+	return err
+}
+
+// read returns the content of the file of the module, see download.
+func (mf *moduleFetcher) read(modPath, name string) ([]byte, error) {
+	f, err := ioutil.TempFile("", "getdeps-")
+	if err != nil {
+		return nil, err
+	}
+	f.Close()
+	defer os.Remove(f.Name())
+	if _, err := mf.download(modPath, name, f.Name()); err != nil {
+		return nil, err
+	}
+	return ioutil.ReadFile(f.Name())
+}
+
+// resolveVersion returns the version of the module to fetch: the tag if any,
+// or the newest release matching the version constraint, or the latest version
+// otherwise. Like for Git repositories, the version constraint always selects
+// the version in update mode.
+func (mf *moduleFetcher) resolveVersion(modPath string, tag, ver *string, hashMode HashMode) (string, error) {
+	var tagName, constraint string
+	if tag != nil {
+		tagName = *tag
+	}
+	if ver != nil {
+		constraint = *ver
+	}
+	if constraint != "" {
+		c, err := parseVersionConstraint(constraint)
+		if err != nil {
+			return "", fmt.Errorf("%s: %w", mf.label, err)
+		}
+		if tagName != "" && hashMode != hashModeUpdate {
+			if v, ok := tagVersion(tagName); !ok || !c.match(v) {
+				return "", fmt.Errorf("%s: version %s does not match %s, update the configuration", mf.label, tagName, constraint)
+			}
+			return tagName, nil
+		}
+		list, err := mf.read(modPath, "@v/list")
+		if err != nil {
+			return "", fmt.Errorf("%s: cannot list the versions of %s: %w", mf.label, modPath, err)
+		}
+		versions := map[string]string{}
+		for _, v := range strings.Fields(string(list)) {
+			versions[v] = v
+		}
+		if tagName = newestTag(versions, c); tagName == "" {
+			return "", fmt.Errorf("%s: %s: no version matches %s", mf.label, modPath, constraint)
+		}
+		log.Printf("%s: Version %s resolves to %s", mf.label, constraint, tagName)
+		return tagName, nil
+	}
+	if tagName != "" {
+		return tagName, nil
+	}
+	data, err := mf.read(modPath, "@latest")
+	if err != nil {
+		return "", fmt.Errorf("%s: cannot find the latest version of %s: %w", mf.label, modPath, err)
+	}
+	var info struct{ Version string }
+	if err := json.Unmarshal(data, &info); err != nil || info.Version == "" {
+		return "", fmt.Errorf("%s: invalid latest version of %s: %q", mf.label, modPath, data)
+	}
+	log.Printf("%s: Latest version of %s is %s", mf.label, modPath, info.Version)
+	return info.Version, nil
+}
+
+// downloadModule downloads the zip of the module version, or only its go.mod
+// file if modOnly, unless it is already there, and returns its h1: hash.
+// The hash is checked against sum if not empty. The hash of the zip is also
+// stored next to it, as in a module cache.
+func (mf *moduleFetcher) downloadModule(mod module.Version, modOnly bool, sum string) (string, error) {
+	suffix, hashFile := ".zip", func(name string) (string, error) { return dirhash.HashZip(name, dirhash.Hash1) }
+	if modOnly {
+		suffix, hashFile = ".mod", hashGoMod
+	}
+	name, err := mf.path(mod, suffix)
+	if err != nil {
+		return "", fmt.Errorf("%s: %s: %w", mf.label, mod, err)
+	}
+	if sum != "" {
+		if h, err := hashFile(name); err == nil && h == sum {
+			return h, nil
+		}
+	}
+	if _, err := mf.download(mod.Path, "@v/"+filepath.Base(name), name); err != nil {
+		return "", fmt.Errorf("%s: cannot download %s %s: %w", mf.label, mod, suffix, err)
+	}
+	h, err := hashFile(name)
+	if err != nil {
+		os.Remove(name)
+		return "", fmt.Errorf("%s: %s %s: %w", mf.label, mod, suffix, err)
+	}
+	if sum != "" && h != sum {
+		os.Remove(name)
+		return "", fmt.Errorf("%s: %s %s: checksum mismatch: downloaded %s, expected %s", mf.label, mod, suffix, h, sum)
+	}
+	if !modOnly {
+		// the go command only uses the zips of the module cache with a hash.
+		if err := ioutil.WriteFile(strings.TrimSuffix(name, suffix)+".ziphash", []byte(h), 0o644); err != nil {
+			return "", err
+		}
+	}
+	return h, nil
+}
+
+// hashGoMod returns the h1: hash of a go.mod file, as recorded in go.sum.
+func hashGoMod(name string) (string, error) {
+	return dirhash.Hash1([]string{"go.mod"}, func(string) (io.ReadCloser, error) {
+		return os.Open(name)
+	})
+}
+
+// downloadDeps downloads the modules listed in the go.sum file of a module,
+// checking them against their hashes: zips for the modules whose packages may
+// be built, and go.mod files for those only needed to select the versions.
+func (mf *moduleFetcher) downloadDeps(goSum []byte) error {
+	type dep struct {
+		mod     module.Version
+		modOnly bool
+	}
+	sums := map[dep]string{}
+	scanner := bufio.NewScanner(bytes.NewReader(goSum))
+	for scanner.Scan() {
+		f := strings.Fields(scanner.Text())
+		if len(f) == 0 {
+			continue
+		}
+		if len(f) != 3 {
+			return fmt.Errorf("%s: invalid go.sum line %q", mf.label, scanner.Text())
+		}
+		d := dep{mod: module.Version{Path: f[0], Version: strings.TrimSuffix(f[1], "/go.mod")}}
+		d.modOnly = d.mod.Version != f[1]
+		sums[d] = f[2]
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	deps := make([]dep, 0, len(sums))
+	for d := range sums {
+		deps = append(deps, d)
+	}
+	sort.Slice(deps, func(i, j int) bool {
+		a, b := deps[i], deps[j]
+		if a.mod.Path != b.mod.Path {
+			return a.mod.Path < b.mod.Path
+		}
+		if a.mod.Version != b.mod.Version {
+			return a.mod.Version < b.mod.Version
+		}
+		return a.modOnly && !b.modOnly
+	})
+	log.Printf("%s: Downloading %d files of dependencies...", mf.label, len(deps))
+	for _, d := range deps {
+		if _, err := mf.downloadModule(d.mod, d.modOnly, sums[d]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// zipGoSum returns the go.sum file of the module zip, if any.
+func zipGoSum(name string, mod module.Version) ([]byte, error) {
+	zr, err := zip.OpenReader(name)
+	if err != nil {
+		return nil, err
+	}
+	defer zr.Close()
+	for _, zf := range zr.File {
+		if zf.Name != mod.String()+"/go.sum" {
+			continue
+		}
+		r, err := zf.Open()
+		if err != nil {
+			return nil, err
+		}
+		defer r.Close()
+		return ioutil.ReadAll(r)
+	}
+	return nil, nil
+}
+
+// modulePath returns the path of the module of the package.
+func (pkg *Gopkg) modulePath() (string, error) {
+	modPath, err := pkg.importPath()
+	if err != nil {
+		return "", err
+	}
+	if err := module.CheckPath(modPath); err != nil {
+		return "", fmt.Errorf("%s: %w", pkg.Label, err)
+	}
+	return modPath, nil
+}
+
+// proxy returns the module proxies of the package.
+func (pkg *Gopkg) proxy() string {
+	if pkg.Proxy != "" {
+		return pkg.Proxy
+	}
+	return goproxy
+}
+
+// fetchModule downloads the module of the package, and the dependencies listed
+// in its go.sum file, from the module proxies into dir, and returns the module
+// version and the path of its zip.
+func (pkg *Gopkg) fetchModule(projectDir, dir string, urlOverrides *URLOverrides, hashMode HashMode) (module.Version, string, error) {
+	var mod module.Version
+	modPath, err := pkg.modulePath()
+	if err != nil {
+		return mod, "", err
+	}
+	mf, err := newModuleFetcher(pkg.Label, projectDir, pkg.proxy(), dir, urlOverrides)
+	if err != nil {
+		return mod, "", err
+	}
+	ver, err := mf.resolveVersion(modPath, pkg.Tag, pkg.Version, hashMode)
+	if err != nil {
+		return mod, "", err
+	}
+	mod = module.Version{Path: modPath, Version: ver}
+	pkg.Tag = &ver
+
+	hash := ""
+	if pkg.Hash != nil && hashMode != hashModeUpdate {
+		hash = *pkg.Hash
+	}
+	log.Printf("%s: Fetching module %s...", pkg.Label, mod)
+	currentHash, err := mf.downloadModule(mod, false, hash)
+	if err != nil {
+		return mod, "", err
+	}
+	log.Printf("%s: Current hash is %s", pkg.Label, currentHash)
+	pkg.Hash = &currentHash
+	if hashMode == hashModeStrict && hash == "" {
+		return mod, "", fmt.Errorf("%s: %s: hash mode is strict and no hash supplied (current is %s)", pkg.Label, mod, currentHash)
+	}
+
+	zipFile, err := mf.path(mod, ".zip")
+	if err != nil {
+		return mod, "", err
+	}
+	goSum, err := zipGoSum(zipFile, mod)
+	if err != nil {
+		return mod, "", fmt.Errorf("%s: %s: %w", pkg.Label, mod, err)
+	}
+	// the dependencies are verified by go.sum, itself verified by the hash.
+	if err := mf.downloadDeps(goSum); err != nil {
+		return mod, "", err
+	}
+	return mod, zipFile, nil
+}
+
+// getModule downloads the module of the package into the module cache under
+// workDir, and extracts it into the GOPATH like in GOPATH mode, so that it
+// can be built in module mode without network access.
+func (pkg *Gopkg) getModule(projectDir, workDir, goDir string, urlOverrides *URLOverrides, hashMode HashMode) error {
+	cacheDir := filepath.Join(workDir, moduleCacheDir, "cache", "download")
+	mod, zipFile, err := pkg.fetchModule(projectDir, cacheDir, urlOverrides, hashMode)
+	if err != nil {
+		return err
+	}
+	log.Printf("%s: Extracting %s into %s", pkg.Label, mod, goDir)
+	if err := modzip.Unzip(goDir, mod, zipFile); err != nil {
+		return fmt.Errorf("%s: %w", pkg.Label, err)
+	}
+	// unlike the module cache, the sources may be patched.
+	return filepath.Walk(goDir, func(name string, info os.FileInfo, err error) error {
+		if err != nil || !info.Mode().IsRegular() {
+			return err
+		}
+		return os.Chmod(name, info.Mode()|0o200)
+	})
+}
@@ -0,0 +1,186 @@
+// Copyright (c) Facebook, Inc. and its affiliates.
+//
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/mod/module"
+	"golang.org/x/mod/sumdb/dirhash"
+	modzip "golang.org/x/mod/zip"
+)
+
+// addTestModule adds a module version with the specified files to the module
+// proxy at dir, and returns the go.sum lines of the module.
+func addTestModule(t *testing.T, dir, modPath, version string, files map[string]string) string {
+	src, err := ioutil.TempDir("", "getdeps-module")
+	require.NoError(t, err)
+	defer os.RemoveAll(src)
+	for name, content := range files {
+		require.NoError(t, os.MkdirAll(filepath.Dir(filepath.Join(src, name)), 0755))
+		require.NoError(t, ioutil.WriteFile(filepath.Join(src, name), []byte(content), 0644))
+	}
+
+	mod := module.Version{Path: modPath, Version: version}
+	vDir := filepath.Join(dir, modPath, "@v")
+	require.NoError(t, os.MkdirAll(vDir, 0755))
+	zf, err := os.Create(filepath.Join(vDir, version+".zip"))
+	require.NoError(t, err)
+	require.NoError(t, modzip.CreateFromDir(zf, mod, src))
+	require.NoError(t, zf.Close())
+	require.NoError(t, ioutil.WriteFile(filepath.Join(vDir, version+".mod"), []byte(files["go.mod"]), 0644))
+	f, err := os.OpenFile(filepath.Join(vDir, "list"), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	require.NoError(t, err)
+	_, err = f.WriteString(version + "\n")
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	zipHash, err := dirhash.HashZip(zf.Name(), dirhash.Hash1)
+	require.NoError(t, err)
+	modHash, err := hashGoMod(filepath.Join(vDir, version+".mod"))
+	require.NoError(t, err)
+	return modPath + " " + version + " " + zipHash + "\n" + modPath + " " + version + "/go.mod " + modHash + "\n"
+}
+
+func TestGopkgModule(t *testing.T) {
+	dir, err := ioutil.TempDir("", "getdeps-goproxy")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	proxy := filepath.Join(dir, "proxy")
+
+	depSum := addTestModule(t, proxy, "example.com/dep", "v1.0.0", map[string]string{
+		"go.mod": "module example.com/dep\n\ngo 1.17\n",
+		"dep.go": "package dep\n\nconst Name = \"dep\"\n",
+	})
+	mainFiles := map[string]string{
+		"go.mod":  "module example.com/tool\n\ngo 1.17\n\nrequire example.com/dep v1.0.0\n",
+		"go.sum":  depSum,
+		"main.go": "package main\n\nimport \"example.com/dep\"\n\nfunc main() { println(dep.Name) }\n",
+	}
+	addTestModule(t, proxy, "example.com/tool", "v1.0.0", mainFiles)
+	mainFiles["README"] = "v1.1.0"
+	addTestModule(t, proxy, "example.com/tool", "v1.1.0", mainFiles)
+	require.NoError(t, ioutil.WriteFile(filepath.Join(proxy, "example.com/tool/@latest"), []byte(`{"Version":"v1.1.0"}`), 0644))
+
+	get := func(pkg *Gopkg, hashMode HashMode) (string, error) {
+		workDir, err := ioutil.TempDir(dir, "work")
+		require.NoError(t, err)
+		return workDir, pkg.Get("", workDir, nil, hashMode)
+	}
+	strPtr := func(s string) *string { return &s }
+
+	// the newest version matching the constraint is selected.
+	pkg := Gopkg{Label: "tool", Pkg: "example.com/tool", Module: true, Proxy: "file://" + proxy, Version: strPtr("~1.0")}
+	workDir, err := get(&pkg, hashModeUpdate)
+	require.NoError(t, err)
+	assert.Equal(t, "v1.0.0", *pkg.Tag)
+	require.NotNil(t, pkg.Hash)
+	assert.Regexp(t, "^h1:", *pkg.Hash)
+	goDir := filepath.Join(workDir, "gopath/src/example.com/tool")
+	assert.FileExists(t, filepath.Join(goDir, "main.go"))
+	assert.NoFileExists(t, filepath.Join(goDir, "README"))
+	cache := filepath.Join(workDir, moduleCacheDir)
+	assert.FileExists(t, filepath.Join(cache, "cache/download/example.com/dep/@v/v1.0.0.zip"))
+	assert.FileExists(t, filepath.Join(cache, "cache/download/example.com/dep/@v/v1.0.0.ziphash"))
+	assert.FileExists(t, filepath.Join(cache, "cache/download/example.com/dep/@v/v1.0.0.mod"))
+
+	// the module builds from the cache without network access.
+	if goBin, err := exec.LookPath("go"); err == nil {
+		cmd := exec.Command(goBin, "build", "-o", os.DevNull, ".")
+		cmd.Dir = goDir
+		cmd.Env = append(os.Environ(), "GOMODCACHE="+cache, "GOPROXY=off", "GOFLAGS=-mod=mod", "GOWORK=off", "GOTOOLCHAIN=local")
+		out, err := cmd.CombinedOutput()
+		assert.NoError(t, err, string(out))
+	}
+
+	// the pinned version and hash are fetched again in strict mode.
+	_, err = get(&pkg, hashModeStrict)
+	require.NoError(t, err)
+	assert.Equal(t, "v1.0.0", *pkg.Tag)
+	wrong := Gopkg{Label: "tool", Pkg: "example.com/tool", Module: true, Proxy: "file://" + proxy, Tag: strPtr("v1.0.0"), Hash: strPtr("h1:47DEQpj8HBSa+/TImW+5JCeuQeRkm5NMpJWZG3hSuFU=")}
+	_, err = get(&wrong, hashModeStrict)
+	assert.ErrorContains(t, err, "checksum mismatch")
+	_, err = get(&Gopkg{Label: "tool", Pkg: "example.com/tool", Module: true, Proxy: "file://" + proxy}, hashModeStrict)
+	assert.ErrorContains(t, err, "hash mode is strict and no hash supplied")
+
+	// the latest version is used without tag nor constraint, and proxies
+	// missing the module are skipped.
+	latest := Gopkg{Label: "tool", Pkg: "example.com/tool", Module: true, Proxy: "file://" + filepath.Join(dir, "empty") + ",off,file://" + proxy}
+	_, err = get(&latest, hashModeUpdate)
+	assert.Error(t, err)
+	latest.Proxy = "file://" + filepath.Join(dir, "empty") + ",file://" + proxy
+	workDir, err = get(&latest, hashModeUpdate)
+	require.NoError(t, err)
+	assert.Equal(t, "v1.1.0", *latest.Tag)
+	assert.FileExists(t, filepath.Join(workDir, "gopath/src/example.com/tool/README"))
+
+	// dependencies not matching go.sum are rejected.
+	require.NoError(t, ioutil.WriteFile(filepath.Join(proxy, "example.com/dep/@v/v1.0.0.mod"), []byte("module example.com/dep\n"), 0644))
+	_, err = get(&latest, hashModeUpdate)
+	assert.ErrorContains(t, err, "checksum mismatch")
+}
+
+func TestVendorModule(t *testing.T) {
+	dir, err := ioutil.TempDir("", "getdeps-vendor")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	proxy := filepath.Join(dir, "proxy")
+	depSum := addTestModule(t, proxy, "example.com/dep", "v1.0.0", map[string]string{
+		"go.mod": "module example.com/dep\n",
+		"dep.go": "package dep\n",
+	})
+	addTestModule(t, proxy, "example.com/tool", "v1.0.0", map[string]string{
+		"go.mod":  "module example.com/tool\n\nrequire example.com/dep v1.0.0\n",
+		"go.sum":  depSum,
+		"main.go": "package main\n",
+	})
+
+	version := "^1"
+	config := &Config{
+		BuildID: "test",
+		Initramfs: &Node{
+			Goget: []Gopkg{{Label: "tool", Pkg: "example.com/tool", Module: true, Version: &version}},
+		},
+	}
+	defer func(p string) { goproxy = p }(goproxy)
+	goproxy = "https://proxy.example.com"
+	// file URLs are relative to the base directory.
+	overrides := URLOverrides{"https://proxy.example.com": "file:///proxy"}
+	bundle := filepath.Join(dir, "bundle")
+	require.NoError(t, vendorBundle(bundle, config, []string{"initramfs"}, dir, &overrides, hashModeUpdate))
+
+	offline = true
+	defer func() { offline = false }()
+	goproxy = "https://other.example.com"
+	data, err := ioutil.ReadFile(filepath.Join(bundle, bundleConfigFile))
+	require.NoError(t, err)
+	bundleConfig, err := NewConfig(data)
+	require.NoError(t, err)
+	data, err = ioutil.ReadFile(filepath.Join(bundle, bundleURLOverridesFile))
+	require.NoError(t, err)
+	bundleOverrides, err := NewURLOverrides(data)
+	require.NoError(t, err)
+	pkg := bundleConfig.Initramfs.Goget[0]
+	assert.Equal(t, "https://proxy.example.com", pkg.Proxy)
+	assert.Equal(t, "v1.0.0", *pkg.Tag)
+
+	node := bundleConfig.Initramfs
+	assert.Empty(t, node.missingOffline(bundle, bundleOverrides, hashModeStrict))
+	workDir := filepath.Join(dir, "work")
+	require.NoError(t, os.Mkdir(workDir, 0755))
+	require.NoError(t, node.Get(bundle, workDir, bundleOverrides, hashModeStrict))
+	assert.FileExists(t, filepath.Join(workDir, "gopath/src/example.com/tool/main.go"))
+	assert.FileExists(t, filepath.Join(workDir, moduleCacheDir, "cache/download/example.com/dep/@v/v1.0.0.zip"))
+	// version constraints are resolved offline too.
+	require.NoError(t, os.RemoveAll(workDir))
+	require.NoError(t, node.Get(bundle, workDir, bundleOverrides, hashModeUpdate))
+}
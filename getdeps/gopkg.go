@@ -6,45 +6,57 @@
 package main
 
 import (
+	"fmt"
+	"log"
 	"net/url"
 	"os"
 	"path"
+	"path/filepath"
 	"strings"
 )
 
 // Gopkg represents a Go package
 type Gopkg struct {
-	Label  string  `json:"label"`
-	Pkg    string  `json:"pkg"`
+	Label string `json:"label"`
+	Pkg   string `json:"pkg"`
+	// Repository of the package, resolved from its import path if empty, see
+	// resolveGoImport. Set by Get.
+	Repo   string  `json:"repo,omitempty"`
 	Branch *string `json:"branch,omitempty"`
 	Hash   *string `json:"hash,omitempty"`
+	// Tag and version constraint, see Git.
+	Tag     *string `json:"tag,omitempty"`
+	Version *string `json:"version,omitempty"`
+	// Keys allowed to sign the commit, or the tag, checked out. Optional.
+	VerifySignatures *SignaturePolicy `json:"verify_signatures,omitempty"`
+	// Module mode: the module is fetched from a Go module proxy rather than
+	// cloned, along with its dependencies. Tag is then the module version and
+	// Hash its h1: hash, as in go.sum.
+	Module bool `json:"module,omitempty"`
+	// Module proxies, in the GOPROXY format. Defaults to --goproxy.
+	Proxy string `json:"proxy,omitempty"`
 }
 
-// Get downloads a Go package
-func (pkg *Gopkg) Get(projectDir string, urlOverrides *URLOverrides, hashMode HashMode) error {
-	dir, err := os.Getwd()
+// Get downloads a Go package into the GOPATH under workDir. In module mode,
+// its dependencies are downloaded into the module cache under workDir.
+func (pkg *Gopkg) Get(projectDir, workDir string, urlOverrides *URLOverrides, hashMode HashMode) error {
+	goDir, err := pkg.dir()
 	if err != nil {
 		return err
 	}
-
-	goDir := path.Join(dir, "gopath/src")
-	if err = os.MkdirAll(goDir, os.ModePerm); err != nil {
+	goDir = filepath.Join(workDir, goDir)
+	if err = os.MkdirAll(filepath.Dir(goDir), os.ModePerm); err != nil {
 		return err
 	}
+	if pkg.Module {
+		return pkg.getModule(projectDir, workDir, goDir, urlOverrides, hashMode)
+	}
 
-	url, err := url.Parse(pkg.Pkg)
+	repo, err := pkg.repo()
 	if err != nil {
 		return err
 	}
-	dirs := strings.Split(url.Host+url.Path, "/")
-	for i := 0; i < len(dirs); i++ {
-		goDir = path.Join(goDir, dirs[i])
-		if err = os.MkdirAll(goDir, os.ModePerm); err != nil {
-			return err
-		}
-	}
-
-	repo := strings.Replace(pkg.Pkg, "golang.org/x", "go.googlesource.com", 1)
+	pkg.Repo = repo
 
 	branch := defaultBranch
 	if pkg.Branch != nil && *pkg.Branch != "" {
@@ -56,10 +68,71 @@ func (pkg *Gopkg) Get(projectDir string, urlOverrides *URLOverrides, hashMode Ha
 	if pkg.Hash != nil {
 		hash = *pkg.Hash
 	}
-	currentHash, err := gitClone(pkg.Label, repo, goDir, branch, hashMode, hash, urlOverrides)
+	ref, tag, err := resolveRef(pkg.Label, projectDir, repo, branch, pkg.Tag, pkg.Version, hash, hashMode, urlOverrides)
+	if err != nil {
+		return err
+	}
+	if tag != "" {
+		pkg.Tag = &tag
+	}
+	currentHash, err := gitClone(pkg.Label, projectDir, repo, goDir, ref, hashMode, hash, urlOverrides, tag, pkg.VerifySignatures)
 	if err != nil {
 		return err
 	}
 	pkg.Hash = &currentHash
 	return nil
 }
+
+// importPath returns the import path of the package.
+func (pkg *Gopkg) importPath() (string, error) {
+	u, err := url.Parse(pkg.Pkg)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimPrefix(path.Join(u.Host, u.Path), "/"), nil
+}
+
+// repo returns the URL of the repository of the package, which must be at
+// the root of the repository. A package given as a URL which cannot be
+// resolved is assumed to be the URL of its repository.
+func (pkg *Gopkg) repo() (string, error) {
+	if pkg.Repo != "" {
+		return pkg.Repo, nil
+	}
+	u, err := url.Parse(pkg.Pkg)
+	if err != nil {
+		return "", err
+	}
+	if u.Scheme != "" && u.Scheme != "https" && u.Scheme != "http" {
+		return pkg.Pkg, nil
+	}
+	importPath, err := pkg.importPath()
+	if err != nil {
+		return "", err
+	}
+	imp, err := resolveGoImport(pkg.Label, importPath)
+	if err != nil {
+		if u.Scheme == "" {
+			return "", err
+		}
+		log.Printf("%s: %v, cloning %s", pkg.Label, err, pkg.Pkg)
+		return pkg.Pkg, nil
+	}
+	if imp.Prefix != importPath {
+		return "", fmt.Errorf("%s: %s is in the repository of %s, use it as pkg", pkg.Label, importPath, imp.Prefix)
+	}
+	if imp.VCS != "git" {
+		return "", fmt.Errorf("%s: %s is in a %s repository, only git is supported", pkg.Label, importPath, imp.VCS)
+	}
+	return imp.Repo, nil
+}
+
+// dir returns the directory of the package, relative to the working
+// directory.
+func (pkg *Gopkg) dir() (string, error) {
+	url, err := url.Parse(pkg.Pkg)
+	if err != nil {
+		return "", err
+	}
+	return path.Join("gopath/src", url.Host, url.Path), nil
+}
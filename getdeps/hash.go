@@ -0,0 +1,137 @@
+// Copyright (c) Facebook, Inc. and its affiliates.
+//
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"strings"
+
+	"golang.org/x/crypto/blake2b"
+)
+
+// Hashes of tarballs and files are specified as `<hash type>:<hex digest>`.
+// Multiple hashes can be specified, separated by commas, in which case all of
+// them must match.
+var hashTypes = map[string]func() hash.Hash{
+	"sha256": sha256.New,
+	"sha384": sha512.New384,
+	"sha512": sha512.New,
+	"blake2b-256": func() hash.Hash {
+		h, _ := blake2b.New256(nil)
+		return h
+	},
+	"blake2b-512": func() hash.Hash {
+		h, _ := blake2b.New512(nil)
+		return h
+	},
+}
+
+// updateHashTypes are the hash types recorded in hash update mode. See the
+// --update-hash-types flag.
+var updateHashTypes = []string{"sha256"}
+
+// splitHashes returns the individual hashes of a hash specification.
+func splitHashes(hashes string) []string {
+	var ret []string
+	for _, h := range strings.Split(hashes, ",") {
+		if h = strings.TrimSpace(h); h != "" {
+			ret = append(ret, h)
+		}
+	}
+	return ret
+}
+
+// checkHashTypes returns an error if any of the hash types is not supported.
+func checkHashTypes(types []string) error {
+	if len(types) == 0 {
+		return fmt.Errorf("no hash type specified")
+	}
+	for _, t := range types {
+		if _, ok := hashTypes[t]; !ok {
+			return fmt.Errorf("unsupported hash type %q", t)
+		}
+	}
+	return nil
+}
+
+// hashVerifier computes the hashes of the data written to it, using the same
+// hash types as the expected hashes, and checks them against the expected
+// ones. If the expected hash is empty (hash update mode), updateHashTypes are
+// used.
+type hashVerifier struct {
+	expected []string
+	types    []string
+	hashes   []hash.Hash
+}
+
+func newHashVerifier(expectedHash string) (*hashVerifier, error) {
+	v := hashVerifier{expected: splitHashes(strings.ToLower(expectedHash))}
+	if len(v.expected) == 0 {
+		v.types = updateHashTypes
+	}
+	for _, e := range v.expected {
+		parts := strings.Split(e, ":")
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("unsupported hash format %q", e)
+		}
+		v.types = append(v.types, parts[0])
+	}
+	if err := checkHashTypes(v.types); err != nil {
+		return nil, err
+	}
+	for _, t := range v.types {
+		v.hashes = append(v.hashes, hashTypes[t]())
+	}
+	return &v, nil
+}
+
+func (v *hashVerifier) Write(p []byte) (int, error) {
+	for _, h := range v.hashes {
+		h.Write(p)
+	}
+	return len(p), nil
+}
+
+// Reset discards the data written so far.
+func (v *hashVerifier) Reset() {
+	for _, h := range v.hashes {
+		h.Reset()
+	}
+}
+
+// Verify returns the hashes of the data written so far, in the same format
+// as the expected hash, and an error if any of them does not match.
+func (v *hashVerifier) Verify() (string, error) {
+	actual := make([]string, 0, len(v.hashes))
+	for i, h := range v.hashes {
+		actual = append(actual, fmt.Sprintf("%s:%s", v.types[i], hex.EncodeToString(h.Sum(nil))))
+	}
+	actualHash := strings.Join(actual, ",")
+	for i, e := range v.expected {
+		if actual[i] != e {
+			return actualHash, fmt.Errorf("hash mismatch: expected %q, got %q", e, actual[i])
+		}
+	}
+	return actualHash, nil
+}
+
+// verifyHash reads all the data from r and checks it against the expected
+// hash. It returns the actual hash.
+func verifyHash(r io.Reader, expectedHash string) (string, error) {
+	verifier, err := newHashVerifier(expectedHash)
+	if err != nil {
+		return "", err
+	}
+	if _, err := io.Copy(verifier, r); err != nil {
+		return "", err
+	}
+	return verifier.Verify()
+}
@@ -0,0 +1,190 @@
+// Copyright (c) Facebook, Inc. and its affiliates.
+//
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// defaultHgBranch is the branch checked out by hg entries without a branch.
+const defaultHgBranch = "default"
+
+// Hg represents a Mercurial repository
+type Hg struct {
+	Label  string  `json:"label"`
+	URL    string  `json:"url"`
+	Dest   string  `json:"dest,omitempty"`
+	Branch *string `json:"branch,omitempty"`
+	Hash   *string `json:"hash,omitempty"`
+}
+
+// Get downloads a Mercurial repository into its destination under workDir.
+func (h *Hg) Get(projectDir, workDir string, urlOverrides *URLOverrides, hashMode HashMode) error {
+	branch := defaultHgBranch
+	if h.Branch != nil && *h.Branch != "" {
+		branch = *h.Branch
+	} else {
+		h.Branch = &branch
+	}
+	hash := ""
+	if h.Hash != nil {
+		hash = *h.Hash
+	}
+	currentHash, err := hgClone(h.Label, projectDir, h.URL, filepath.Join(workDir, h.Dest), branch, hashMode, hash, urlOverrides)
+	if err != nil {
+		return err
+	}
+	h.Hash = &currentHash
+	return nil
+}
+
+// hgClone checks out the hash, or the head of the branch if there is no
+// hash, of the repository at dest, and returns the changeset checked out.
+func hgClone(label, projectDir, repo, dest, branch string, hashMode HashMode, hash string, urlOverrides *URLOverrides) (string, error) {
+	repo = resolveRepo(projectDir, repo, urlOverrides)
+
+	if hashMode == hashModeUpdate {
+		hash = ""
+	}
+	if offline && localRepoPath(repo) == "" {
+		return "", fmt.Errorf("%s: cannot clone %s: %w", label, redactURL(repo), errOffline)
+	}
+
+	log.Printf("%s: Cloning %s (%s %s)...", label, redactURL(repo), branch, hash)
+	rev := hash
+	if rev == "" {
+		rev = branch
+	}
+	if err := hgPull(label, repo, rev, dest); err != nil {
+		return "", err
+	}
+
+	currentHash, err := hgRevision(dest, ".")
+	if err != nil {
+		return "", fmt.Errorf("%s: %w", label, err)
+	}
+	log.Printf("%s: Current hash is %s", label, currentHash)
+
+	if hashMode == hashModeStrict && hash == "" {
+		return currentHash, fmt.Errorf("%s: %s: hash mode is strict and no hash supplied (current is %s)", label, redactURL(repo), currentHash)
+	}
+	return currentHash, nil
+}
+
+// hgPull creates a repository at dest and updates it to rev, pulling only
+// its ancestors from repo, like a shallow clone with git.
+func hgPull(label, repo, rev, dest string) (err error) {
+	// Only remove the destination on failure if it was created here, it may
+	// contain the output of other entries otherwise.
+	_, statErr := os.Stat(dest)
+	created := os.IsNotExist(statErr)
+	if err = os.MkdirAll(dest, 0o755); err != nil {
+		return fmt.Errorf("%s: error creating %q: %w", label, dest, err)
+	}
+	defer func() {
+		if err != nil {
+			if created {
+				os.RemoveAll(dest)
+			} else {
+				os.RemoveAll(filepath.Join(dest, ".hg"))
+			}
+		}
+	}()
+	if err = runCommand(label, "hg", "init", dest); err != nil {
+		return fmt.Errorf("%s: %w", label, err)
+	}
+	// later pulls use the repository, like with hg clone.
+	if err = writeHgPaths(dest, repo); err != nil {
+		return fmt.Errorf("%s: %w", label, err)
+	}
+	if err = runCommand(label, "hg", "-R", dest, "pull", "-q", "-r", rev, repo); err != nil {
+		return fmt.Errorf("%s: %w", label, err)
+	}
+	if err = runCommand(label, "hg", "-R", dest, "update", "-q", "-r", rev); err != nil {
+		return fmt.Errorf("%s: %w", label, err)
+	}
+	return nil
+}
+
+// writeHgPaths sets the default path of the repository at dir to repo, the
+// credentials of which are not stored, like in Git mirrors.
+func writeHgPaths(dir, repo string) error {
+	hgrc := fmt.Sprintf("[paths]\ndefault = %s\n", stripUserinfo(repo))
+	return ioutil.WriteFile(filepath.Join(dir, ".hg", "hgrc"), []byte(hgrc), 0o644)
+}
+
+// hgRevision returns the full hash of the changeset rev resolves to in the
+// repository at dir.
+func hgRevision(dir, rev string) (string, error) {
+	cmd := exec.Command("hg", "-R", dir, "log", "-r", rev, "-T", "{node}")
+	cmd.Env = hgCommandEnv()
+	out, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("error running %v: %w", cmd, err)
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
+// hgCommandEnv returns the environment of hg commands. The user's settings
+// changing the output of the commands are disabled.
+func hgCommandEnv() []string {
+	return append(os.Environ(), "HGPLAIN=1")
+}
+
+// vendor mirrors the repository into the bundle at rel, without a working
+// copy.
+func (h *Hg) vendor(v *vendorer, rel string) error {
+	branch := defaultHgBranch
+	if h.Branch != nil && *h.Branch != "" {
+		branch = *h.Branch
+	} else {
+		h.Branch = &branch
+	}
+	hash := ""
+	if h.Hash != nil && v.hashMode != hashModeUpdate {
+		hash = *h.Hash
+	}
+	repo := resolveRepo(v.projectDir, h.URL, v.urlOverrides)
+	if offline && localRepoPath(repo) == "" {
+		return fmt.Errorf("%s: cannot mirror %s: %w", h.Label, redactURL(repo), errOffline)
+	}
+
+	log.Printf("%s: Mirroring %s...", h.Label, redactURL(repo))
+	dest := filepath.Join(v.dir, rel)
+	if err := os.MkdirAll(filepath.Dir(dest), os.ModePerm); err != nil {
+		return err
+	}
+	if err := runCommand(h.Label, "hg", "clone", "-q", "-U", repo, dest); err != nil {
+		return fmt.Errorf("%s: %w", h.Label, err)
+	}
+	// the bundle may be shared, the credentials must not be stored in it.
+	if stripped := stripUserinfo(repo); stripped != repo {
+		if err := writeHgPaths(dest, stripped); err != nil {
+			return fmt.Errorf("%s: %w", h.Label, err)
+		}
+	}
+	rev := hash
+	if rev == "" {
+		rev = branch
+	}
+	currentHash, err := hgRevision(dest, rev)
+	if err != nil || currentHash == "" {
+		return fmt.Errorf("%s: %s: %s not found in the repository", h.Label, redactURL(repo), rev)
+	}
+	log.Printf("%s: Current hash is %s", h.Label, currentHash)
+	if v.hashMode == hashModeStrict && hash == "" {
+		return fmt.Errorf("%s: %s: hash mode is strict and no hash supplied (current is %s)", h.Label, redactURL(repo), currentHash)
+	}
+	h.Hash = &currentHash
+	v.addRepo(h.URL, rel)
+	return nil
+}
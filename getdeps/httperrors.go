@@ -0,0 +1,118 @@
+// Copyright (c) Facebook, Inc. and its affiliates.
+//
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+)
+
+// Error classes for failed downloads. Use errors.Is to check whether an error
+// returned by fetch belongs to one of them.
+var (
+	ErrNotFound          = errors.New("not found")
+	ErrAuthRequired      = errors.New("authentication required")
+	ErrServerError       = errors.New("server error")
+	ErrUnexpectedContent = errors.New("unexpected content")
+)
+
+// HTTPError is returned when the server responds with a non-2xx status code.
+type HTTPError struct {
+	URL        string
+	StatusCode int
+	Status     string
+	Header     http.Header
+}
+
+func newHTTPError(resp *http.Response) *HTTPError {
+	return &HTTPError{
+		URL:        resp.Request.URL.Redacted(),
+		StatusCode: resp.StatusCode,
+		Status:     resp.Status,
+		Header:     resp.Header,
+	}
+}
+
+func (e *HTTPError) Error() string {
+	if class := e.class(); class != nil {
+		return fmt.Sprintf("%s: %s (%v)", e.URL, e.Status, class)
+	}
+	return fmt.Sprintf("%s: unexpected HTTP status %s", e.URL, e.Status)
+}
+
+// class returns the error class of the status code, if any.
+func (e *HTTPError) class() error {
+	switch {
+	case e.StatusCode == http.StatusNotFound || e.StatusCode == http.StatusGone:
+		return ErrNotFound
+	case e.StatusCode == http.StatusUnauthorized || e.StatusCode == http.StatusForbidden ||
+		e.StatusCode == http.StatusProxyAuthRequired:
+		return ErrAuthRequired
+	case e.StatusCode >= 500:
+		return ErrServerError
+	}
+	return nil
+}
+
+// Is makes errors.Is match the error class of the status code.
+func (e *HTTPError) Is(target error) bool {
+	return target != nil && e.class() == target
+}
+
+// ContentError is returned when a download looks like something other than
+// the requested artifact, typically an HTML error or login page served with a
+// 2xx status code.
+type ContentError struct {
+	URL         string
+	ContentType string
+}
+
+func (e *ContentError) Error() string {
+	return fmt.Sprintf("%s: unexpected content type %q, this is likely an error page", e.URL, e.ContentType)
+}
+
+// Is makes errors.Is match ErrUnexpectedContent.
+func (e *ContentError) Is(target error) bool {
+	return target == ErrUnexpectedContent
+}
+
+// isHTML returns true if the content type is HTML but the path of the
+// requested URL doesn't look like an HTML file.
+func isHTML(contentType, urlPath string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	if mediaType != "text/html" && mediaType != "application/xhtml+xml" {
+		return false
+	}
+	switch strings.ToLower(path.Ext(urlPath)) {
+	case ".html", ".htm", ".xhtml":
+		return false
+	}
+	return true
+}
+
+// checkContent sniffs the beginning of a downloaded file and returns a
+// ContentError if it looks like an HTML page, unless an HTML page was
+// requested.
+func checkContent(f io.ReaderAt, u *url.URL) error {
+	buf := make([]byte, 512)
+	n, err := f.ReadAt(buf, 0)
+	if err != nil && err != io.EOF {
+		return err
+	}
+	if contentType := http.DetectContentType(buf[:n]); isHTML(contentType, u.Path) {
+		return &ContentError{URL: u.Redacted(), ContentType: contentType}
+	}
+	return nil
+}
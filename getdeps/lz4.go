@@ -0,0 +1,50 @@
+// Copyright (c) Facebook, Inc. and its affiliates.
+//
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+
+package main
+
+import (
+	"bufio"
+	"errors"
+	"io"
+
+	"github.com/pierrec/lz4/v4"
+)
+
+// lz4Reader decompresses an LZ4 stream, in the frame format as produced by the
+// lz4 tool or in the legacy format used e.g. by the Linux kernel. The header,
+// block and content checksums of the frames are verified. Unlike lz4.Reader,
+// it does not stop at the end of the first frame: like the lz4 tool, it
+// decompresses concatenated frames. It requires github.com/pierrec/lz4/v4
+// v4.1.22 or later, earlier versions reject the block checksums of valid
+// frames.
+type lz4Reader struct {
+	src     *bufio.Reader
+	zr      *lz4.Reader
+	started bool
+}
+
+func newLz4Reader(r io.Reader) *lz4Reader {
+	src := bufio.NewReader(r)
+	return &lz4Reader{src: src, zr: lz4.NewReader(src)}
+}
+
+func (z *lz4Reader) Read(p []byte) (int, error) {
+	if !z.started {
+		z.started = true
+		if _, err := z.src.Peek(4); err != nil {
+			return 0, errors.New("lz4: missing frame")
+		}
+	}
+	n, err := z.zr.Read(p)
+	if err == io.EOF {
+		if _, peekErr := z.src.Peek(1); peekErr == nil {
+			// another frame follows.
+			z.zr.Reset(z.src)
+			err = nil
+		}
+	}
+	return n, err
+}
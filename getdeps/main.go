@@ -25,6 +25,10 @@
 //
 // The hash mode allows you to be strict or permissive in the hash validation,
 // and, when used in update mode, it lets you use the latest commit hashes.
+//
+// The `vendor` command, i.e. `getdeps vendor <dir or .tar.gz>`, exports all the
+// sources into a self-contained bundle instead of the working directories, see
+// vendorBundle.
 package main
 
 import (
@@ -38,6 +42,8 @@ import (
 	"path/filepath"
 	"reflect"
 	"strings"
+	"sync"
+	"time"
 
 	flag "github.com/spf13/pflag"
 )
@@ -55,6 +61,31 @@ var (
 	flagURLOverridesFile = flag.StringP("url-overrides", "u", "", "URL overrides file")
 	flagFinalConfigFile  = flag.StringP("output", "o", "", "Path to the output config file after all expansions, suitable for storing in the `internal_versions` VPD variable")
 	flagBaseDir          = flag.StringP("basedir", "d", "", "Base directory for relative includes. If unspecified, the current working directory is used for relative includes")
+	flagFetchRetries     = flag.Int("fetch-retries", fetchRetries, "Number of times a failed download is retried")
+	flagFetchBackoff     = flag.Duration("fetch-backoff", fetchBackoff, "Initial delay between download retries, doubled at each attempt")
+	flagFetchMaxBackoff  = flag.Duration("fetch-max-backoff", fetchMaxBackoff, "Maximum delay between download retries")
+	flagJobs             = flag.IntP("jobs", "j", cap(jobs), "Maximum number of entries to fetch at the same time")
+	flagCacheDir         = flag.String("cache-dir", defaultCacheDir(), "Directory of the download cache, shared between runs, with mirrors of the Git repositories in its git subdirectory. Defaults to $GETDEPS_CACHE_DIR if set. An empty value disables the cache")
+	flagUpdateHashTypes  = flag.String("update-hash-types", strings.Join(updateHashTypes, ","), "Comma-separated list of hash types recorded for tarballs and files in update mode. Supported hash types: sha256, sha384, sha512, blake2b-256, blake2b-512")
+	flagOffline          = flag.Bool("offline", false, "Forbid all network access. Every artifact must be available in the download or Git cache, or via a file URL override, otherwise getdeps fails before touching any working directory")
+	flagCACert           = flag.String("ca-cert", "", "PEM file with the CA certificates trusted for HTTPS servers and proxies, replacing the system ones. Also used by git")
+	flagClientCert       = flag.String("client-cert", "", "PEM file with the client certificate presented to HTTPS servers and proxies. Also used by git")
+	flagClientKey        = flag.String("client-key", "", "PEM file with the key of the client certificate")
+	flagProxy            = flag.String("proxy", "", "URL of the proxy used for downloads and git. If unspecified, the proxy is taken from the environment")
+	flagGitProxy         = flag.String("git-proxy", "", "URL of the proxy used by git, if different from --proxy")
+	flagGoImportMap      = flag.String("go-import-map", "", "JSON file mapping Go import path patterns, where * matches a path element, to the repositories of goget entries, used when go-import discovery fails")
+	flagGoproxy          = flag.String("goproxy", goproxy, "Go module proxies of the goget entries in module mode, in the GOPROXY format. File URLs are relative to the base directory. Defaults to $GOPROXY if set")
+	flagCredentials      = flag.String("credentials", "", "JSON file with the per-host headers and bearer token environment variables sent to HTTPS servers and git remotes")
+	flagNetrc            = flag.String("netrc", defaultNetrcFile(), "netrc file with the per-host logins and passwords. Defaults to $NETRC if set. An empty value disables it")
+	flagClampMtime       = flag.Int64("clamp-mtime", defaultClampMtime(), "Unix time to which later modification times of extracted files are clamped, for reproducible builds. Defaults to $SOURCE_DATE_EPOCH if set. 0 disables clamping")
+	flagMirrorOrder      = flag.String("mirror-order", string(mirrorOrder),
+		"Order in which the mirrors of tarballs and files are tried: "+
+			"config - primary URL first, then the mirrors in configuration order; "+
+			"latency - by increasing response time.")
+	flagGitBackend = flag.String("git-backend", string(gitBackend),
+		"Implementation of the Git operations checking out the repositories: "+
+			"git - runs the git binary; "+
+			"go-git - in-process, without git. Submodules, cherry-picks, the Git cache, signature verification and vendoring still need git.")
 )
 
 // HashMode represents the hash mode to use. See constants below.
@@ -74,7 +105,13 @@ var (
 
 // Component defines an interface for the different components
 type Component interface {
-	Get(projectDir string, overrides *URLOverrides, hashMode HashMode) error
+	Get(projectDir, workDir string, overrides *URLOverrides, hashMode HashMode) error
+	// missingOffline lists the artifacts that cannot be fetched in offline
+	// mode.
+	missingOffline(projectDir string, overrides *URLOverrides, hashMode HashMode) []string
+	// gitBinaryUses lists the features that run the git binary, even with
+	// the go-git backend.
+	gitBinaryUses(projectDir string) []string
 }
 
 // Merge fields from src object into dst.
@@ -107,13 +144,19 @@ func mergeFields(dst reflect.Value, src reflect.Value) {
 // specified directory, if any.
 func identifyRepo(dir string) (string, error) {
 	// Is it a Git repo?
-	cmd := exec.Command("git", "describe", "--dirty", "--tags", "--always")
-	cmd.Dir = dir
-	if out, err := cmd.CombinedOutput(); err == nil {
-		return strings.TrimSpace(string(out)), nil
+	if gitBackend == gitBackendGoGit {
+		if id, err := goGitDescribe(dir); err == nil {
+			return id, nil
+		}
+	} else {
+		cmd := exec.Command("git", "describe", "--dirty", "--tags", "--always")
+		cmd.Dir = dir
+		if out, err := cmd.CombinedOutput(); err == nil {
+			return strings.TrimSpace(string(out)), nil
+		}
 	}
 	// is it a Hg repo?
-	cmd = exec.Command("hg", "identify")
+	cmd := exec.Command("hg", "identify")
 	cmd.Dir = dir
 	if out, err := cmd.CombinedOutput(); err == nil {
 		return strings.TrimSpace(string(out)), nil
@@ -209,6 +252,18 @@ func getBaseDir(basedir, configfile string) (string, error) {
 func main() {
 	flag.Parse()
 
+	vendorOutput := ""
+	switch flag.Arg(0) {
+	case "":
+	case "vendor":
+		if flag.NArg() != 2 {
+			log.Fatalf("Usage: %s vendor [flags] <directory or .tar.gz file>", os.Args[0])
+		}
+		vendorOutput = flag.Arg(1)
+	default:
+		log.Fatalf("Unknown command %q", flag.Arg(0))
+	}
+
 	baseDir, err := getBaseDir(*flagBaseDir, *flagConfigFile)
 	if err != nil {
 		log.Fatalf("Failed to get base dir: %v", err)
@@ -231,6 +286,35 @@ func main() {
 		log.Fatalf("unsupported hash mode %q", *flagHashMode)
 	}
 
+	found = false
+	for _, mo := range supportedMirrorOrders {
+		if *flagMirrorOrder == string(mo) {
+			found = true
+			break
+		}
+	}
+	if !found {
+		log.Fatalf("unsupported mirror order %q", *flagMirrorOrder)
+	}
+	mirrorOrder = MirrorOrder(*flagMirrorOrder)
+
+	found = false
+	for _, gb := range supportedGitBackends {
+		if *flagGitBackend == string(gb) {
+			found = true
+			break
+		}
+	}
+	if !found {
+		log.Fatalf("unsupported git backend %q", *flagGitBackend)
+	}
+	gitBackend = GitBackend(*flagGitBackend)
+
+	updateHashTypes = splitHashes(strings.ToLower(*flagUpdateHashTypes))
+	if err := checkHashTypes(updateHashTypes); err != nil {
+		log.Fatalf("Invalid update hash types: %v", err)
+	}
+
 	configData, err := ioutil.ReadFile(*flagConfigFile)
 	if err != nil {
 		log.Fatalf("Failed to read configuration file '%s': %v", *flagConfigFile, err)
@@ -240,6 +324,62 @@ func main() {
 		log.Fatalln(err)
 	}
 
+	if *flagJobs < 1 {
+		log.Fatalf("Invalid number of jobs %d", *flagJobs)
+	}
+	jobs = newJobLimiter(*flagJobs)
+
+	fetchRetries, fetchBackoff, fetchMaxBackoff = *flagFetchRetries, *flagFetchBackoff, *flagFetchMaxBackoff
+	if fetchRetries < 0 || fetchBackoff <= 0 || fetchMaxBackoff < fetchBackoff {
+		log.Fatalf("Invalid download retry settings: retries %d, backoff %v, max backoff %v", fetchRetries, fetchBackoff, fetchMaxBackoff)
+	}
+
+	offline = *flagOffline
+	goproxy = *flagGoproxy
+	if *flagGoImportMap != "" {
+		if err := loadGoImportMap(*flagGoImportMap); err != nil {
+			log.Fatalf("Failed to load Go import map: %v", err)
+		}
+	}
+
+	if *flagClampMtime < 0 {
+		log.Fatalf("Invalid modification time clamp %d", *flagClampMtime)
+	} else if *flagClampMtime > 0 {
+		clampMtime = time.Unix(*flagClampMtime, 0)
+	}
+
+	if err := setupNetwork(NetworkConfig{
+		CACert:     *flagCACert,
+		ClientCert: *flagClientCert,
+		ClientKey:  *flagClientKey,
+		Proxy:      *flagProxy,
+		GitProxy:   *flagGitProxy,
+	}); err != nil {
+		log.Fatalf("Invalid network settings: %v", err)
+	}
+	if err := setupCredentials(*flagCredentials, *flagNetrc); err != nil {
+		log.Fatalf("Invalid credentials: %v", err)
+	}
+	if gitBackend == gitBackendGoGit {
+		setupGoGit()
+	}
+
+	if *flagCacheDir != "" {
+		downloadCache, err = NewDownloadCache(*flagCacheDir)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		// the Git cache is maintained with git, also with the go-git backend.
+		if _, err := exec.LookPath("git"); err == nil {
+			gitCache, err = NewGitCache(filepath.Join(*flagCacheDir, "git"))
+			if err != nil {
+				log.Fatalln(err)
+			}
+		} else {
+			log.Printf("git not found, the Git cache is disabled")
+		}
+	}
+
 	// load URL overrides file
 	var urlOverrides *URLOverrides
 	if *flagURLOverridesFile != "" {
@@ -259,6 +399,9 @@ func main() {
 	}
 
 	buildID := getBuildID(*flagConfigFile, projectDir)
+	log.Printf("Build ID: %s", buildID)
+
+	componentObjs := make([]Component, 0, len(components))
 	for _, componentName := range components {
 		var component Component
 		switch componentName {
@@ -273,9 +416,53 @@ func main() {
 			// sync with the `supportedComponents` variable.
 			log.Fatalf("Unsupported component '%s'. This could be a bug, please report it to the maintainers", componentName)
 		}
-		workingDir := path.Join(projectDir, componentName)
+		componentObjs = append(componentObjs, component)
+	}
 
-		log.Printf("Build ID: %s", buildID)
+	// With the go-git backend, make sure that git is installed if some
+	// features need it, rather than failing half-way through the run.
+	if gitBackend == gitBackendGoGit {
+		if _, err := exec.LookPath("git"); err != nil {
+			var uses []string
+			for i, componentName := range components {
+				for _, u := range componentObjs[i].gitBinaryUses(baseDir) {
+					uses = append(uses, fmt.Sprintf("%s: %s", componentName, u))
+				}
+			}
+			if vendorOutput != "" {
+				uses = append(uses, "vendoring")
+			}
+			if len(uses) > 0 {
+				log.Fatalf("git not found, but the following features need it, even with --git-backend=%s:\n  %s", gitBackendGoGit, strings.Join(uses, "\n  "))
+			}
+		}
+	}
+
+	// In offline mode, make sure that everything is available locally before
+	// touching the working directories.
+	if offline {
+		var missing []string
+		for i, componentName := range components {
+			for _, m := range componentObjs[i].missingOffline(baseDir, urlOverrides, HashMode(*flagHashMode)) {
+				missing = append(missing, fmt.Sprintf("%s: %s", componentName, m))
+			}
+		}
+		if len(missing) > 0 {
+			log.Fatalf("Offline mode: the following artifacts are not available locally:\n  %s", strings.Join(missing, "\n  "))
+		}
+	}
+
+	if vendorOutput != "" {
+		config.BuildID = buildID
+		if err := vendorBundle(vendorOutput, config, components, baseDir, urlOverrides, HashMode(*flagHashMode)); err != nil {
+			log.Fatalf("Failed to vendor the sources:\n%v", err)
+		}
+		log.Printf("Vendored the sources into %s", vendorOutput)
+		return
+	}
+
+	for _, componentName := range components {
+		workingDir := path.Join(projectDir, componentName)
 
 		// clean up previous working directory
 		if err = os.RemoveAll(workingDir); err != nil {
@@ -286,17 +473,32 @@ func main() {
 		if err = os.Mkdir(workingDir, os.ModePerm); err != nil {
 			log.Fatalln(err)
 		}
+	}
 
-		// change working directory
-		if err := os.Chdir(workingDir); err != nil {
-			log.Fatalln(err)
-		}
-
-		// get the sources
-		if err := component.Get(baseDir, urlOverrides, HashMode(*flagHashMode)); err != nil {
-			log.Fatalln(err)
+	// get the sources. Components are fetched concurrently, the number of
+	// entries being fetched at the same time is limited by --jobs.
+	var wg sync.WaitGroup
+	componentErrs := make([]error, len(components))
+	for i, componentName := range components {
+		wg.Add(1)
+		go func(i int, componentName string) {
+			defer wg.Done()
+			workingDir := path.Join(projectDir, componentName)
+			if err := componentObjs[i].Get(baseDir, workingDir, urlOverrides, HashMode(*flagHashMode)); err != nil {
+				componentErrs[i] = fmt.Errorf("%s: %w", componentName, err)
+			}
+		}(i, componentName)
+	}
+	wg.Wait()
+	var errs errorList
+	for _, err := range componentErrs {
+		if err != nil {
+			errs = append(errs, err)
 		}
 	}
+	if err := errs.errorOrNil(); err != nil {
+		log.Fatalf("Failed to fetch the sources:\n%v", err)
+	}
 
 	// To ensure consistent formatting when the config is fed into vpd,
 	// write out a final versions file whether or not the base config was
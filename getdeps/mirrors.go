@@ -0,0 +1,88 @@
+// Copyright (c) Facebook, Inc. and its affiliates.
+//
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+
+package main
+
+import (
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"sync"
+	"time"
+)
+
+// MirrorOrder is the order in which the mirrors of an artifact are tried. See
+// constants below.
+type MirrorOrder string
+
+const (
+	// mirrorOrderConfig tries the primary URL first, then the mirrors in the
+	// order they appear in the configuration.
+	mirrorOrderConfig MirrorOrder = "config"
+	// mirrorOrderLatency tries the URLs by increasing response time of a
+	// HEAD request. Unreachable URLs are tried last.
+	mirrorOrderLatency MirrorOrder = "latency"
+)
+
+var (
+	mirrorOrder           = mirrorOrderConfig
+	supportedMirrorOrders = []MirrorOrder{mirrorOrderConfig, mirrorOrderLatency}
+)
+
+const (
+	// mirrorProbeTimeout is the maximum time a latency probe can take.
+	mirrorProbeTimeout = 5 * time.Second
+	// unreachable is the latency of mirrors that failed the probe.
+	unreachable = time.Duration(1<<63 - 1)
+)
+
+// sortByLatency sorts the URLs by the time it takes them to respond to a HEAD
+// request. Local (file) URLs always come first. The sort is stable, so URLs
+// with the same latency retain the configured order.
+func sortByLatency(label string, urls []*url.URL) {
+	if len(urls) < 2 || offline {
+		return
+	}
+	latencies := make(map[*url.URL]time.Duration, len(urls))
+	var (
+		mu sync.Mutex
+		wg sync.WaitGroup
+	)
+	client := &http.Client{Transport: httpTransport, Timeout: mirrorProbeTimeout}
+	for _, u := range urls {
+		if isFileURL(u) {
+			latencies[u] = 0
+			continue
+		}
+		wg.Add(1)
+		go func(u *url.URL) {
+			defer wg.Done()
+			latency := unreachable
+			start := time.Now()
+			resp, err := client.Head(u.String())
+			if err == nil {
+				resp.Body.Close()
+				if resp.StatusCode < 400 {
+					latency = time.Since(start)
+				}
+			}
+			mu.Lock()
+			latencies[u] = latency
+			mu.Unlock()
+		}(u)
+	}
+	wg.Wait()
+	sort.SliceStable(urls, func(i, j int) bool {
+		return latencies[urls[i]] < latencies[urls[j]]
+	})
+	for _, u := range urls {
+		if latencies[u] == unreachable {
+			log.Printf("%s: Mirror %s is unreachable", label, u.Redacted())
+		} else {
+			log.Printf("%s: Mirror %s, latency %v", label, u.Redacted(), latencies[u])
+		}
+	}
+}
@@ -0,0 +1,157 @@
+// Copyright (c) Facebook, Inc. and its affiliates.
+//
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+)
+
+// httpTransport is used by all the HTTP requests. It is nil, i.e. the default
+// transport, unless network settings are configured, see setupNetwork.
+var httpTransport http.RoundTripper
+
+// gitHTTPTransport is the equivalent of httpTransport for git, used by the
+// go-git backend. It differs from httpTransport if --git-proxy is set.
+var gitHTTPTransport http.RoundTripper
+
+// gitEnv and gitConfig are added to the environment of git commands, see
+// runCommand, so that the network settings also apply to HTTPS remotes.
+var (
+	gitEnv    []string
+	gitConfig [][2]string
+)
+
+// NetworkConfig contains the TLS and proxy settings, see the corresponding
+// flags.
+type NetworkConfig struct {
+	// PEM file with the CA certificates trusted for servers and proxies,
+	// replacing the system ones.
+	CACert string
+	// PEM files with the client certificate and its key, presented to
+	// servers and proxies requesting it.
+	ClientCert string
+	ClientKey  string
+	// URL of the proxy used for downloads. If empty, the proxy is taken from
+	// the environment, see http.ProxyFromEnvironment.
+	Proxy string
+	// URL of the proxy used by git. If empty, Proxy is used.
+	GitProxy string
+}
+
+// setupNetwork applies the network settings to httpTransport,
+// gitHTTPTransport, gitEnv and gitConfig.
+func setupNetwork(nc NetworkConfig) error {
+	if nc == (NetworkConfig{}) {
+		return nil
+	}
+	if (nc.ClientCert == "") != (nc.ClientKey == "") {
+		return fmt.Errorf("client certificate and key must be specified together")
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	tlsConfig := &tls.Config{}
+	if nc.CACert != "" {
+		pem, err := ioutil.ReadFile(nc.CACert)
+		if err != nil {
+			return fmt.Errorf("failed to read CA certificates: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("no CA certificate found in '%s'", nc.CACert)
+		}
+		tlsConfig.RootCAs = pool
+	}
+	if nc.ClientCert != "" {
+		cert, err := tls.LoadX509KeyPair(nc.ClientCert, nc.ClientKey)
+		if err != nil {
+			return fmt.Errorf("failed to load client certificate: %w", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	// the TLS configuration is also used to connect to HTTPS proxies.
+	transport.TLSClientConfig = tlsConfig
+	if nc.Proxy != "" {
+		proxyURL, err := url.Parse(nc.Proxy)
+		if err != nil {
+			return fmt.Errorf("invalid proxy URL: %w", err)
+		}
+		transport.Proxy = http.ProxyURL(proxyURL)
+	}
+	httpTransport = transport
+
+	// git reads the proxy from the environment too, so only set it if
+	// explicitly configured.
+	gitProxy := nc.GitProxy
+	if gitProxy == "" {
+		gitProxy = nc.Proxy
+	}
+	gitHTTPTransport = transport
+	gitEnv, gitConfig = nil, nil
+	if gitProxy != "" {
+		gitConfig = append(gitConfig, [2]string{"http.proxy", gitProxy})
+	}
+	if gitProxy != nc.Proxy {
+		proxyURL, err := url.Parse(gitProxy)
+		if err != nil {
+			return fmt.Errorf("invalid git proxy URL: %w", err)
+		}
+		gitTransport := transport.Clone()
+		gitTransport.Proxy = http.ProxyURL(proxyURL)
+		gitHTTPTransport = gitTransport
+	}
+	for _, f := range [][3]string{
+		{nc.CACert, "GIT_SSL_CAINFO", "http.proxySSLCAInfo"},
+		{nc.ClientCert, "GIT_SSL_CERT", "http.proxySSLCert"},
+		{nc.ClientKey, "GIT_SSL_KEY", "http.proxySSLKey"},
+	} {
+		if f[0] == "" {
+			continue
+		}
+		// git does not resolve the paths relative to the current directory
+		// of getdeps.
+		p, err := absPath(f[0])
+		if err != nil {
+			return err
+		}
+		gitEnv = append(gitEnv, f[1]+"="+p)
+		gitConfig = append(gitConfig, [2]string{f[2], p})
+	}
+	return nil
+}
+
+// gitConfigEnv returns the environment variables setting the specified git
+// configuration entries, in addition to those already set via
+// GIT_CONFIG_COUNT in the environment.
+func gitConfigEnv(config [][2]string) []string {
+	if len(config) == 0 {
+		return nil
+	}
+	n, _ := strconv.Atoi(os.Getenv("GIT_CONFIG_COUNT"))
+	var env []string
+	for _, kv := range config {
+		env = append(env,
+			fmt.Sprintf("GIT_CONFIG_KEY_%d=%s", n, kv[0]),
+			fmt.Sprintf("GIT_CONFIG_VALUE_%d=%s", n, kv[1]))
+		n++
+	}
+	return append(env, fmt.Sprintf("GIT_CONFIG_COUNT=%d", n))
+}
+
+func absPath(p string) (string, error) {
+	abs, err := filepath.Abs(p)
+	if err != nil {
+		return "", fmt.Errorf("failed to get absolute path for '%s': %w", p, err)
+	}
+	return abs, nil
+}
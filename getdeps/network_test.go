@@ -0,0 +1,109 @@
+// Copyright (c) Facebook, Inc. and its affiliates.
+//
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// writeTestClientCert generates a self-signed client certificate and writes it
+// and its key to PEM files in dir.
+func writeTestClientCert(t *testing.T, dir string) (string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "getdeps"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+	certFile, keyFile := filepath.Join(dir, "client.crt"), filepath.Join(dir, "client.key")
+	require.NoError(t, ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644))
+	require.NoError(t, ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600))
+	return certFile, keyFile
+}
+
+func TestFetchTLS(t *testing.T) {
+	dir, err := ioutil.TempDir("", "getdeps-tls")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	defer func() { httpTransport, gitEnv, gitConfig = nil, nil, nil }()
+
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if len(r.TLS.PeerCertificates) == 0 || r.TLS.PeerCertificates[0].Subject.CommonName != "getdeps" {
+			http.Error(w, "client certificate required", http.StatusForbidden)
+			return
+		}
+		w.Write([]byte("hello"))
+	}))
+	ts.TLS = &tls.Config{ClientAuth: tls.RequestClientCert}
+	ts.StartTLS()
+	defer ts.Close()
+
+	caFile := filepath.Join(dir, "ca.pem")
+	require.NoError(t, ioutil.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ts.Certificate().Raw}), 0644))
+	certFile, keyFile := writeTestClientCert(t, dir)
+
+	// the server certificate is not trusted by default.
+	var sink bufferSink
+	assert.Error(t, fetch("test", ts.URL, &sink))
+
+	require.NoError(t, setupNetwork(NetworkConfig{CACert: caFile}))
+	err = fetch("test", ts.URL, &sink)
+	assert.True(t, errors.Is(err, ErrAuthRequired), err)
+
+	require.NoError(t, setupNetwork(NetworkConfig{CACert: caFile, ClientCert: certFile, ClientKey: keyFile, Proxy: "https://proxy.example.com:3128"}))
+	sink.Reset()
+	// there is no proxy, only check that it is passed to git.
+	httpTransport.(*http.Transport).Proxy = nil
+	require.NoError(t, fetch("test", ts.URL, &sink))
+	assert.Equal(t, "hello", sink.String())
+	assert.Equal(t, []string{
+		"GIT_SSL_CAINFO=" + caFile,
+		"GIT_SSL_CERT=" + certFile,
+		"GIT_SSL_KEY=" + keyFile,
+	}, gitEnv)
+	assert.Equal(t, [][2]string{
+		{"http.proxy", "https://proxy.example.com:3128"},
+		{"http.proxySSLCAInfo", caFile},
+		{"http.proxySSLCert", certFile},
+		{"http.proxySSLKey", keyFile},
+	}, gitConfig)
+
+	assert.Error(t, setupNetwork(NetworkConfig{ClientCert: certFile}))
+}
+
+func TestGitConfigEnv(t *testing.T) {
+	t.Setenv("GIT_CONFIG_COUNT", "2")
+	assert.Equal(t, []string{
+		"GIT_CONFIG_KEY_2=http.proxy", "GIT_CONFIG_VALUE_2=http://proxy:3128",
+		"GIT_CONFIG_COUNT=3",
+	}, gitConfigEnv([][2]string{{"http.proxy", "http://proxy:3128"}}))
+	assert.Empty(t, gitConfigEnv(nil))
+}
@@ -7,43 +7,107 @@ package main
 
 import (
 	"fmt"
+	"log"
+	"path/filepath"
 	"reflect"
 )
 
 // Node is a common action node.
 type Node struct {
 	Git   []Git   `json:"git,omitempty"`
+	Hg    []Hg    `json:"hg,omitempty"`
 	Goget []Gopkg `json:"goget,omitempty"`
 	Untar []Untar `json:"untar,omitempty"`
 	Files *Files  `json:"files,omitempty"`
 }
 
-// Get performs the specified actions.
-func (n *Node) Get(projectDir string, urlOverrides *URLOverrides, hashMode HashMode) error {
-	for i, g := range n.Git {
-		if err := g.Get(projectDir, urlOverrides, hashMode); err != nil {
-			return fmt.Errorf("error processing %s entry %d: %w", "git", i, err)
-		}
-		n.Git[i] = g
+// Get performs the specified actions in workDir. Independent entries are
+// fetched concurrently, see jobs. Entries whose destination is inside the
+// destination of a Git or Hg entry listed before them are written once it has
+// been checked out. Git entries not matching the submodule commit recorded at
+// their destination by a containing Git entry are reported.
+func (n *Node) Get(projectDir, workDir string, urlOverrides *URLOverrides, hashMode HashMode) error {
+	var tg taskGroup
+	for i := range n.Git {
+		g := &n.Git[i]
+		skip := n.nestedGitDests(i)
+		tg.add(fmt.Sprintf("%s entry %d", "git", i), g.Dest, true, func(wait func() error) error {
+			if err := wait(); err != nil {
+				return err
+			}
+			jobs.acquire()
+			defer jobs.release()
+			return g.Get(projectDir, workDir, urlOverrides, hashMode, skip)
+		})
+	}
+	for i := range n.Hg {
+		h := &n.Hg[i]
+		tg.add(fmt.Sprintf("%s entry %d", "hg", i), h.Dest, true, func(wait func() error) error {
+			if err := wait(); err != nil {
+				return err
+			}
+			jobs.acquire()
+			defer jobs.release()
+			return h.Get(projectDir, workDir, urlOverrides, hashMode)
+		})
 	}
-	for i, gg := range n.Goget {
-		if err := gg.Get(projectDir, urlOverrides, hashMode); err != nil {
+	for i := range n.Goget {
+		gg := &n.Goget[i]
+		dir, err := gg.dir()
+		if err != nil {
 			return fmt.Errorf("error processing %s entry %d: %w", "goget", i, err)
 		}
-		n.Goget[i] = gg
+		tg.add(fmt.Sprintf("%s entry %d", "goget", i), dir, true, func(wait func() error) error {
+			if err := wait(); err != nil {
+				return err
+			}
+			jobs.acquire()
+			defer jobs.release()
+			return gg.Get(projectDir, workDir, urlOverrides, hashMode)
+		})
 	}
-	for i, u := range n.Untar {
-		if err := u.Get(projectDir, urlOverrides, hashMode); err != nil {
-			return fmt.Errorf("error processing %s entry %d: %w", "untar", i, err)
-		}
-		n.Untar[i] = u
+	for i := range n.Untar {
+		u := &n.Untar[i]
+		tg.add(fmt.Sprintf("%s entry %d", "untar", i), u.Dest, false, func(wait func() error) error {
+			jobs.acquire()
+			f, err := u.fetch(projectDir, urlOverrides, hashMode)
+			jobs.release()
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			if err := wait(); err != nil {
+				return err
+			}
+			if err := u.extract(f, workDir); err != nil {
+				return err
+			}
+			return applyPatches(u.Label, projectDir, filepath.Join(workDir, u.Dest), u.Patches, false, hashMode)
+		})
 	}
 	if n.Files != nil {
-		if err := n.Files.Get(projectDir, urlOverrides, hashMode); err != nil {
-			return fmt.Errorf("error processing %s entry: %w", "files", err)
+		for i := range n.Files.Filelist {
+			i := i
+			tg.add(fmt.Sprintf("%s entry %d", "files", i), n.Files.Dest, false, func(wait func() error) error {
+				jobs.acquire()
+				f, fileInfo, err := n.Files.fetch(i, projectDir, urlOverrides, hashMode)
+				jobs.release()
+				if err != nil {
+					return err
+				}
+				defer f.Close()
+				if err := wait(); err != nil {
+					return err
+				}
+				return n.Files.write(i, f, fileInfo, workDir)
+			})
 		}
 	}
-	return nil
+	err := tg.run()
+	for _, drift := range n.submoduleDrift(workDir) {
+		log.Printf("Submodule drift: %s", drift)
+	}
+	return err
 }
 
 func mergeNodes(base, patch *Node) (*Node, error) {
@@ -79,6 +143,26 @@ func mergeNodes(base, patch *Node) (*Node, error) {
 		}
 	}
 
+	for i := range patch.Hg {
+		if patch.Hg[i].Label == "" {
+			return nil, fmt.Errorf("label for %s cannot be empty", patch.Hg[i].URL)
+		}
+		matchFound := false
+		for j := range ret.Hg {
+			if patch.Hg[i].Label != ret.Hg[j].Label {
+				continue
+			}
+			dst := reflect.ValueOf(&ret.Hg[j]).Elem()
+			src := reflect.ValueOf(&patch.Hg[i]).Elem()
+			mergeFields(dst, src)
+			matchFound = true
+			break
+		}
+		if !matchFound {
+			ret.Hg = append(ret.Hg, patch.Hg[i])
+		}
+	}
+
 	for i := range patch.Goget {
 		if patch.Goget[i].Label == "" {
 			return nil, fmt.Errorf("label for %s cannot be empty", patch.Goget[i].Pkg)
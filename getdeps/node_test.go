@@ -0,0 +1,124 @@
+// Copyright (c) Facebook, Inc. and its affiliates.
+//
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newTestGitRepo creates a Git repository with a single commit containing the
+// specified files, and returns its path.
+func newTestGitRepo(t *testing.T, files map[string]string) string {
+	dir, err := ioutil.TempDir("", "getdeps-repo")
+	require.NoError(t, err)
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	git := func(args ...string) {
+		cmd := exec.Command("git", append([]string{"-C", dir, "-c", "user.name=test", "-c", "user.email=test@example.com"}, args...)...)
+		out, err := cmd.CombinedOutput()
+		require.NoError(t, err, string(out))
+	}
+	git("init", "-q", "-b", "master")
+	for name, content := range files {
+		require.NoError(t, os.MkdirAll(filepath.Join(dir, filepath.Dir(name)), 0755))
+		require.NoError(t, ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0644))
+	}
+	git("add", "-A")
+	git("commit", "-q", "-m", "initial commit")
+	return dir
+}
+
+func TestNodeGet(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not found")
+	}
+	repo := newTestGitRepo(t, map[string]string{"README": "coreboot"})
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("hello"))
+	}))
+	defer ts.Close()
+
+	workDir, err := ioutil.TempDir("", "getdeps-work")
+	require.NoError(t, err)
+	defer os.RemoveAll(workDir)
+
+	n := Node{
+		Git: []Git{{Label: "coreboot", URL: "file://" + repo}},
+		Files: &Files{
+			Label: "tarballs",
+			Dest:  "util/crossgcc/tarballs",
+			Filelist: []File{
+				{URL: ts.URL + "/a.tar.xz"},
+				{URL: ts.URL + "/b.tar.xz"},
+			},
+		},
+	}
+	require.NoError(t, n.Get("", workDir, nil, hashModeUpdate))
+
+	assert.FileExists(t, filepath.Join(workDir, "README"))
+	for _, name := range []string{"a.tar.xz", "b.tar.xz"} {
+		data, err := ioutil.ReadFile(filepath.Join(workDir, "util/crossgcc/tarballs", name))
+		require.NoError(t, err)
+		assert.Equal(t, "hello", string(data))
+	}
+	require.NotNil(t, n.Git[0].Hash)
+	assert.Len(t, *n.Git[0].Hash, 40)
+	assert.Equal(t, testHash, n.Files.Filelist[0].Hash)
+	assert.Equal(t, testHash, n.Files.Filelist[1].Hash)
+
+	// errors are reported for every failed entry.
+	n.Git[0].URL = "file:///nonexistent"
+	n.Files.Filelist[1].URL = "file:///nonexistent"
+	require.NoError(t, os.RemoveAll(workDir))
+	require.NoError(t, os.Mkdir(workDir, 0755))
+	err = n.Get("", workDir, nil, hashModeUpdate)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "git entry 0")
+	assert.Contains(t, err.Error(), "files entry 0")
+	assert.Contains(t, err.Error(), "files entry 1")
+}
+
+func TestTaskGroupOverlappingDests(t *testing.T) {
+	var (
+		mu    sync.Mutex
+		order []string
+	)
+	record := func(name string, delay time.Duration, err error) func(func() error) error {
+		return func(wait func() error) error {
+			// fetching takes a while, writing only starts once waited.
+			time.Sleep(delay)
+			if err := wait(); err != nil {
+				return err
+			}
+			mu.Lock()
+			order = append(order, name)
+			mu.Unlock()
+			return err
+		}
+	}
+	var tg taskGroup
+	tg.add("first", "src", false, record("first", 50*time.Millisecond, errors.New("failed")))
+	tg.add("nested", "src/lib", false, record("nested", 0, nil))
+	tg.add("same", "src", false, record("same", 0, nil))
+	tg.add("other", "other", false, record("other", 0, nil))
+	err := tg.run()
+	// a failed tarball does not prevent the following ones from being
+	// extracted.
+	assert.ErrorContains(t, err, "error processing first: failed")
+	assert.NotContains(t, err.Error(), "nested")
+	assert.Equal(t, []string{"other", "first", "nested", "same"}, order)
+}
@@ -0,0 +1,172 @@
+// Copyright (c) Facebook, Inc. and its affiliates.
+//
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// offline forbids all network access. See the --offline flag.
+var offline bool
+
+// errOffline is returned when an artifact would have to be fetched from the
+// network in offline mode.
+var errOffline = errors.New("network access is disabled in offline mode")
+
+// isFileURL returns true if the URL refers to a local file.
+func isFileURL(u *url.URL) bool {
+	return strings.ToLower(u.Scheme) == "file"
+}
+
+// filePath returns the local path of a file URL. File URLs are relative to
+// the base directory.
+func filePath(projectDir string, u *url.URL) string {
+	return path.Join(projectDir, u.Host, u.Path)
+}
+
+// localRepoPath returns the local path of a repository URL resolved by
+// resolveRepo, or an empty string if the repository is remote. Unlike file
+// URLs of tarballs, Git handles file URLs itself, so they are absolute.
+func localRepoPath(repo string) string {
+	if filepath.IsAbs(repo) {
+		return repo
+	}
+	if u, err := url.Parse(repo); err == nil && isFileURL(u) {
+		return filepath.Join(u.Host, u.Path)
+	}
+	return ""
+}
+
+// missingOffline returns a description of every artifact of the node which
+// cannot be fetched without network access.
+func (n *Node) missingOffline(projectDir string, urlOverrides *URLOverrides, hashMode HashMode) []string {
+	if n == nil {
+		return nil
+	}
+	var missing []string
+	for i, g := range n.Git {
+		missing = append(missing, missingPatches("git", g.Label, projectDir, g.Patches)...)
+		if !repoAvailableOffline(projectDir, g.URL, g.Hash, hashMode, urlOverrides) {
+			missing = append(missing, fmt.Sprintf("git %s: %s", g.Label, g.URL))
+			continue
+		}
+		missing = append(missing, g.missingCherryPicksOffline(projectDir, urlOverrides, hashMode)...)
+		missing = append(missing, g.missingSubmodulesOffline(projectDir, urlOverrides, hashMode, n.nestedGitDests(i))...)
+	}
+	for _, h := range n.Hg {
+		if !hgAvailableOffline(projectDir, h.URL, urlOverrides) {
+			missing = append(missing, fmt.Sprintf("hg %s: %s", h.Label, h.URL))
+		}
+	}
+	for _, gg := range n.Goget {
+		if gg.Module {
+			if !proxyAvailableOffline(projectDir, gg.proxy(), urlOverrides) {
+				missing = append(missing, fmt.Sprintf("goget %s: %s (module proxy %s)", gg.Label, gg.Pkg, gg.proxy()))
+			}
+			continue
+		}
+		if repo, err := gg.repo(); err != nil || !repoAvailableOffline(projectDir, repo, gg.Hash, hashMode, urlOverrides) {
+			missing = append(missing, fmt.Sprintf("goget %s: %s", gg.Label, gg.Pkg))
+		}
+	}
+	for _, u := range n.Untar {
+		missing = append(missing, missingPatches("untar", u.Label, projectDir, u.Patches)...)
+		if !availableOffline(projectDir, append([]string{u.URL}, u.Mirrors...), u.Hash, hashMode, urlOverrides) {
+			missing = append(missing, fmt.Sprintf("untar %s: %s", u.Label, u.URL))
+		}
+		if u.Signature != nil && !availableOffline(projectDir, []string{u.Signature.URL}, "", hashMode, urlOverrides) {
+			missing = append(missing, fmt.Sprintf("untar %s: %s", u.Label, u.Signature.URL))
+		}
+	}
+	if n.Files != nil {
+		for _, f := range n.Files.Filelist {
+			if !availableOffline(projectDir, append([]string{f.URL}, f.Mirrors...), f.Hash, hashMode, urlOverrides) {
+				missing = append(missing, fmt.Sprintf("files %s: %s", n.Files.Label, f.URL))
+			}
+			if f.Signature != nil && !availableOffline(projectDir, []string{f.Signature.URL}, "", hashMode, urlOverrides) {
+				missing = append(missing, fmt.Sprintf("files %s: %s", n.Files.Label, f.Signature.URL))
+			}
+		}
+	}
+	return missing
+}
+
+// availableOffline returns true if any of the URLs, after applying the
+// overrides, refers to an existing local file, or if the content is in the
+// download cache.
+func availableOffline(projectDir string, urls []string, hash string, hashMode HashMode, urlOverrides *URLOverrides) bool {
+	for _, urlStr := range urls {
+		if urlOverrides != nil {
+			urlStr = urlOverrides.Override(urlStr)
+		}
+		if u, err := url.Parse(urlStr); err == nil && isFileURL(u) {
+			if _, err := os.Stat(filePath(projectDir, u)); err == nil {
+				return true
+			}
+		}
+	}
+	// hashes are discarded in update mode, so the cache cannot be used.
+	if downloadCache == nil || hash == "" || hashMode == hashModeUpdate {
+		return false
+	}
+	f, err := downloadCache.Open(hash)
+	if err != nil || f == nil {
+		return false
+	}
+	f.Close()
+	return true
+}
+
+// repoAvailableOffline returns true if the repository, after applying the
+// overrides, is a local one, or if the commit is in the Git cache.
+func repoAvailableOffline(projectDir, repo string, hash *string, hashMode HashMode, urlOverrides *URLOverrides) bool {
+	repo = resolveRepo(projectDir, repo, urlOverrides)
+	if p := localRepoPath(repo); p != "" {
+		if _, err := os.Stat(p); err == nil {
+			return true
+		}
+	}
+	// hashes are discarded in update mode, so the cache cannot be used.
+	if gitCache == nil || isLocalRepoPath(repo) || hash == nil || *hash == "" || hashMode == hashModeUpdate {
+		return false
+	}
+	return gitCache.has(repo, *hash)
+}
+
+// hgAvailableOffline returns true if the Mercurial repository, after applying
+// the overrides, is a local one. There is no cache of Mercurial repositories.
+func hgAvailableOffline(projectDir, repo string, urlOverrides *URLOverrides) bool {
+	p := localRepoPath(resolveRepo(projectDir, repo, urlOverrides))
+	if p == "" {
+		return false
+	}
+	_, err := os.Stat(p)
+	return err == nil
+}
+
+// proxyAvailableOffline returns true if one of the module proxies, after
+// applying the overrides, is a local directory. Only the proxies are checked,
+// the modules themselves are only known once go.sum is read.
+func proxyAvailableOffline(projectDir, proxies string, urlOverrides *URLOverrides) bool {
+	list, err := parseGoproxy(proxies, urlOverrides)
+	if err != nil {
+		return false
+	}
+	for _, p := range list {
+		if u, err := url.Parse(p.url); err == nil && isFileURL(u) {
+			if _, err := os.Stat(filePath(projectDir, u)); err == nil {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,73 @@
+// Copyright (c) Facebook, Inc. and its affiliates.
+//
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMissingOffline(t *testing.T) {
+	dir, err := ioutil.TempDir("", "getdeps-offline")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "local.tar.xz"), []byte("hello"), 0644))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "local.patch"), []byte("hello"), 0644))
+	repo := newTestGitRepo(t, map[string]string{"README": "vboot"})
+
+	downloadCache, err = NewDownloadCache(filepath.Join(dir, "cache"))
+	require.NoError(t, err)
+	defer func() { downloadCache = nil }()
+	tmp, err := downloadCache.TempFile()
+	require.NoError(t, err)
+	require.NoError(t, tmp.Close())
+	require.NoError(t, downloadCache.Commit(testHash, tmp.Name()))
+
+	overrides := URLOverrides{
+		"https://example.com/local.tar.xz":  "file:///local.tar.xz",
+		"https://review.coreboot.org/vboot": "file://" + repo,
+	}
+	n := Node{
+		Git: []Git{
+			{Label: "coreboot", URL: "https://review.coreboot.org/coreboot"},
+			{Label: "vboot", URL: "https://review.coreboot.org/vboot", Patches: []Patch{{Path: "local.patch"}, {Path: "missing.patch"}}},
+		},
+		Untar: []Untar{
+			{Label: "overridden", URL: "https://example.com/local.tar.xz", Patches: []Patch{{Path: "local.patch"}}},
+			{Label: "cached", URL: "https://example.com/cached.tar.xz", Hash: testHash},
+			{Label: "missing", URL: "https://example.com/missing.tar.xz", Hash: testHash[:len(testHash)-1] + "0"},
+		},
+	}
+	assert.Equal(t, []string{
+		"git coreboot: https://review.coreboot.org/coreboot",
+		"git vboot: patch missing.patch",
+		"untar missing: https://example.com/missing.tar.xz",
+	}, n.missingOffline(dir, &overrides, hashModeStrict))
+
+	// the cache cannot be used in update mode.
+	assert.Equal(t, []string{
+		"git coreboot: https://review.coreboot.org/coreboot",
+		"git vboot: patch missing.patch",
+		"untar cached: https://example.com/cached.tar.xz",
+		"untar missing: https://example.com/missing.tar.xz",
+	}, n.missingOffline(dir, &overrides, hashModeUpdate))
+}
+
+func TestFetchOffline(t *testing.T) {
+	offline = true
+	defer func() { offline = false }()
+	var sink bufferSink
+	err := fetch("test", "https://example.com/file.tar.xz", &sink)
+	assert.True(t, errors.Is(err, errOffline))
+	_, err = gitClone("test", "", "https://example.com/repo", "dest", "master", hashModeStrict, "", nil, "", nil)
+	assert.True(t, errors.Is(err, errOffline))
+}
@@ -0,0 +1,138 @@
+// Copyright (c) Facebook, Inc. and its affiliates.
+//
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// jobs limits the number of entries being fetched at the same time. See the
+// --jobs flag.
+var jobs = newJobLimiter(4)
+
+// jobLimiter is a counting semaphore.
+type jobLimiter chan struct{}
+
+func newJobLimiter(n int) jobLimiter {
+	return make(jobLimiter, n)
+}
+
+func (l jobLimiter) acquire() { l <- struct{}{} }
+func (l jobLimiter) release() { <-l }
+
+// errorList collects the errors of concurrent operations.
+type errorList []error
+
+func (el errorList) Error() string {
+	msgs := make([]string, 0, len(el))
+	for _, err := range el {
+		msgs = append(msgs, err.Error())
+	}
+	return strings.Join(msgs, "\n")
+}
+
+// errorOrNil returns nil if the list is empty, the only error if it has one,
+// or the list itself otherwise.
+func (el errorList) errorOrNil() error {
+	switch len(el) {
+	case 0:
+		return nil
+	case 1:
+		return el[0]
+	default:
+		return el
+	}
+}
+
+// task is an action of a Node that writes into a destination directory.
+type task struct {
+	name string
+	// destination, relative to the working directory.
+	dest string
+	// whether the task owns its destination directory, i.e. later tasks
+	// writing into it have to wait for it to complete.
+	owner bool
+	run   func(wait func() error) error
+	done  chan struct{}
+	err   error
+}
+
+// taskGroup runs tasks concurrently. A task may only write into the
+// destination of a previously added owner task, e.g. a file into a Git
+// checkout, once that task has completed: the wait function passed to it
+// blocks until then, and returns an error if that task failed. Tasks which
+// are not owners, e.g. tarballs, whose destinations overlap write in the
+// order they were added, so that the last one wins like when run one after
+// the other: the wait function also blocks until the previous ones have
+// completed, whether they failed or not. Tasks must not hold a job slot
+// while waiting.
+type taskGroup struct {
+	tasks []*task
+}
+
+func (tg *taskGroup) add(name, dest string, owner bool, run func(wait func() error) error) {
+	tg.tasks = append(tg.tasks, &task{
+		name:  name,
+		dest:  filepath.Clean(dest),
+		owner: owner,
+		run:   run,
+		done:  make(chan struct{}),
+	})
+}
+
+// run runs all the tasks and waits for them to complete. The errors are
+// returned in the order the tasks were added.
+func (tg *taskGroup) run() error {
+	var wg sync.WaitGroup
+	for i, t := range tg.tasks {
+		var deps, before []*task
+		for _, prev := range tg.tasks[:i] {
+			switch {
+			case prev.owner && isWithin(t.dest, prev.dest):
+				deps = append(deps, prev)
+			case !prev.owner && !t.owner && (isWithin(t.dest, prev.dest) || isWithin(prev.dest, t.dest)):
+				before = append(before, prev)
+			}
+		}
+		wait := func() error {
+			for _, dep := range deps {
+				<-dep.done
+				if dep.err != nil {
+					return fmt.Errorf("not processed because %s failed", dep.name)
+				}
+			}
+			for _, prev := range before {
+				<-prev.done
+			}
+			return nil
+		}
+		wg.Add(1)
+		go func(t *task) {
+			defer wg.Done()
+			defer close(t.done)
+			t.err = t.run(wait)
+		}(t)
+	}
+	wg.Wait()
+
+	var errs errorList
+	for _, t := range tg.tasks {
+		if t.err != nil {
+			errs = append(errs, fmt.Errorf("error processing %s: %w", t.name, t.err))
+		}
+	}
+	return errs.errorOrNil()
+}
+
+// isWithin returns true if the path is dir or one of its descendants. Both
+// are relative to the same directory.
+func isWithin(p, dir string) bool {
+	rel, err := filepath.Rel(dir, p)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
@@ -0,0 +1,149 @@
+// Copyright (c) Facebook, Inc. and its affiliates.
+//
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// Patch is a patch applied to the sources of a Git or Untar entry once they
+// are fetched.
+type Patch struct {
+	// Path of the patch. Relative paths are relative to the base directory.
+	Path string `json:"path"`
+	// Hash of the patch, in the same format as the hash of tarballs. Set by
+	// Get in update mode, or if missing.
+	Hash string `json:"hash,omitempty"`
+}
+
+// path returns the path of the patch file.
+func (p *Patch) path(projectDir string) string {
+	if filepath.IsAbs(p.Path) {
+		return p.Path
+	}
+	return filepath.Join(projectDir, p.Path)
+}
+
+// missingPatches returns a description of every patch of the entry whose file
+// does not exist, for the offline pre-check.
+func missingPatches(kind, label, projectDir string, patches []Patch) []string {
+	var missing []string
+	for i := range patches {
+		if _, err := os.Stat(patches[i].path(projectDir)); err != nil {
+			missing = append(missing, fmt.Sprintf("%s %s: patch %s", kind, label, patches[i].Path))
+		}
+	}
+	return missing
+}
+
+// read returns the content of the patch and its hash, after checking it
+// according to the hash mode.
+func (p *Patch) read(label, projectDir string, hashMode HashMode) ([]byte, string, error) {
+	data, err := ioutil.ReadFile(p.path(projectDir))
+	if err != nil {
+		return nil, "", fmt.Errorf("%s: failed to read patch: %w", label, err)
+	}
+	expected := p.Hash
+	if hashMode == hashModeUpdate {
+		expected = ""
+	} else if hashMode == hashModeStrict && expected == "" {
+		return nil, "", fmt.Errorf("%s: patch %s: hash mode is strict and no hash supplied", label, p.Path)
+	}
+	actual, err := verifyHash(bytes.NewReader(data), expected)
+	if err != nil {
+		return nil, "", fmt.Errorf("%s: patch %s: %w", label, p.Path, err)
+	}
+	return data, actual, nil
+}
+
+// isMailbox returns true if the patch was generated by git format-patch.
+func isMailbox(data []byte) bool {
+	return bytes.HasPrefix(data, []byte("From "))
+}
+
+// patchRejects returns the files to which some hunks of a patch do not apply,
+// or which do not exist, according to the output of patch --dry-run.
+func patchRejects(out []byte) []string {
+	var files []string
+	current := ""
+	for _, line := range strings.Split(string(out), "\n") {
+		switch {
+		case strings.HasPrefix(line, "checking file "):
+			current = strings.TrimPrefix(line, "checking file ")
+		case strings.HasPrefix(line, "|+++ "):
+			// the header of a patch to a missing file, whose first
+			// component is stripped by -p1.
+			if fields := strings.Fields(line[len("|+++ "):]); len(fields) > 0 {
+				current = fields[0]
+				if i := strings.IndexByte(current, '/'); i >= 0 {
+					current = current[i+1:]
+				}
+			}
+		case strings.Contains(line, "FAILED") || strings.HasPrefix(line, "No file to patch"):
+			if current != "" && (len(files) == 0 || files[len(files)-1] != current) {
+				files = append(files, current)
+			}
+		}
+	}
+	return files
+}
+
+// applyPatches applies the patches, in order, to the sources at dir, and
+// records their hashes. All the patches are checked against their hash
+// before any is applied, and the content checked is passed to the commands
+// on their standard input, so that changes to the files meanwhile do not
+// matter. In Git checkouts, patches generated by git format-patch are applied
+// with git am, so that they show up in the history; other patches are applied
+// with patch -p1, after a dry run so that a patch which does not apply leaves
+// no partial changes behind.
+func applyPatches(label, projectDir, dir string, patches []Patch, git bool, hashMode HashMode) error {
+	contents := make([][]byte, len(patches))
+	hashes := make([]string, len(patches))
+	for i := range patches {
+		var err error
+		if contents[i], hashes[i], err = patches[i].read(label, projectDir, hashMode); err != nil {
+			return err
+		}
+	}
+	for i := range patches {
+		p := &patches[i]
+		data := contents[i]
+		log.Printf("%s: Applying patch %s...", label, p.Path)
+		if git && isMailbox(data) {
+			args := append(append([]string{"-C", dir}, gitIdentity...), "am", "-q", "--committer-date-is-author-date")
+			if err := runCommandInput(label, bytes.NewReader(data), "git", args...); err != nil {
+				runCommand(label, "git", "-C", dir, "am", "--abort")
+				return fmt.Errorf("%s: patch %s does not apply: %w", label, p.Path, err)
+			}
+		} else {
+			args := []string{"-p1", "-N", "--batch", "--no-backup-if-mismatch", "-d", dir}
+			cmd := exec.Command("patch", append([]string{"--dry-run"}, args...)...)
+			cmd.Stdin = bytes.NewReader(data)
+			out, err := cmd.CombinedOutput()
+			if err != nil {
+				w := &logWriter{prefix: label}
+				w.Write(out)
+				w.Flush()
+				if rejected := patchRejects(out); len(rejected) > 0 {
+					return fmt.Errorf("%s: patch %s does not apply to %s", label, p.Path, strings.Join(rejected, ", "))
+				}
+				return fmt.Errorf("%s: patch %s does not apply: error running %v: %w", label, p.Path, cmd, err)
+			}
+			if err := runCommandInput(label, bytes.NewReader(data), "patch", args...); err != nil {
+				return fmt.Errorf("%s: patch %s: %w", label, p.Path, err)
+			}
+		}
+		p.Hash = hashes[i]
+	}
+	return nil
+}
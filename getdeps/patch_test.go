@@ -0,0 +1,135 @@
+// Copyright (c) Facebook, Inc. and its affiliates.
+//
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const (
+	testPatchA = `--- a/a.txt
++++ b/a.txt
+@@ -1 +1 @@
+-a
++a1
+`
+	testPatchB = `--- a/b.txt
++++ b/b.txt
+@@ -1 +1 @@
+-b
++b1
+`
+	testPatchReject = `--- a/a.txt
++++ b/a.txt
+@@ -1 +1 @@
+-x
++y
+`
+)
+
+func TestApplyPatches(t *testing.T) {
+	if _, err := exec.LookPath("patch"); err != nil {
+		t.Skip("patch not found")
+	}
+	projectDir, err := ioutil.TempDir("", "getdeps-project")
+	require.NoError(t, err)
+	defer os.RemoveAll(projectDir)
+	for name, content := range map[string]string{"a.patch": testPatchA, "b.patch": testPatchB, "reject.patch": testPatchReject} {
+		require.NoError(t, ioutil.WriteFile(filepath.Join(projectDir, name), []byte(content), 0644))
+	}
+	apply := func(patches []Patch, hashMode HashMode) (string, error) {
+		dir, err := ioutil.TempDir("", "getdeps-work")
+		require.NoError(t, err)
+		t.Cleanup(func() { os.RemoveAll(dir) })
+		require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "a.txt"), []byte("a\n"), 0644))
+		require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "b.txt"), []byte("b\n"), 0644))
+		return dir, applyPatches("linux", projectDir, dir, patches, false, hashMode)
+	}
+
+	patches := []Patch{{Path: "a.patch"}, {Path: "b.patch"}}
+	dir, err := apply(patches, hashModePermissive)
+	require.NoError(t, err)
+	for name, content := range map[string]string{"a.txt": "a1\n", "b.txt": "b1\n"} {
+		data, err := ioutil.ReadFile(filepath.Join(dir, name))
+		require.NoError(t, err)
+		assert.Equal(t, content, string(data))
+	}
+	for _, p := range patches {
+		assert.Regexp(t, "^sha256:[0-9a-f]{64}$", p.Hash)
+	}
+	_, err = apply(patches, hashModeStrict)
+	require.NoError(t, err)
+
+	// a modified patch is caught before anything is applied.
+	modified := []Patch{{Path: "b.patch", Hash: patches[1].Hash}, {Path: "a.patch", Hash: patches[1].Hash}}
+	dir, err = apply(modified, hashModePermissive)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "a.patch")
+	data, err := ioutil.ReadFile(filepath.Join(dir, "b.txt"))
+	require.NoError(t, err)
+	assert.Equal(t, "b\n", string(data))
+
+	// the hashes are required in strict mode.
+	_, err = apply([]Patch{{Path: "a.patch"}}, hashModeStrict)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "hash mode is strict")
+
+	// rejects name the files, and leave no partial changes behind.
+	rejected := []Patch{{Path: "a.patch"}, {Path: "reject.patch"}, {Path: "b.patch"}}
+	dir, err = apply(rejected, hashModeUpdate)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "patch reject.patch does not apply to a.txt")
+	assert.Equal(t, "", rejected[1].Hash)
+	assert.Equal(t, "", rejected[2].Hash)
+	data, err = ioutil.ReadFile(filepath.Join(dir, "b.txt"))
+	require.NoError(t, err)
+	assert.Equal(t, "b\n", string(data))
+	_, err = os.Stat(filepath.Join(dir, "a.txt.rej"))
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestGitPatches(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not found")
+	}
+	if _, err := exec.LookPath("patch"); err != nil {
+		t.Skip("patch not found")
+	}
+	repo := newTestGitRepo(t, map[string]string{"a.txt": "a\n", "b.txt": "b\n"})
+	base := runTestGit(t, repo, "rev-parse", "HEAD")
+	require.NoError(t, ioutil.WriteFile(filepath.Join(repo, "a.txt"), []byte("a1\n"), 0644))
+	runTestGit(t, repo, "commit", "-q", "-am", "Change a")
+	mbox := runTestGit(t, repo, "format-patch", "--stdout", "-1")
+
+	projectDir, err := ioutil.TempDir("", "getdeps-project")
+	require.NoError(t, err)
+	defer os.RemoveAll(projectDir)
+	require.NoError(t, ioutil.WriteFile(filepath.Join(projectDir, "a.patch"), []byte(mbox+"\n"), 0644))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(projectDir, "b.patch"), []byte(testPatchB), 0644))
+
+	workDir, err := ioutil.TempDir("", "getdeps-work")
+	require.NoError(t, err)
+	defer os.RemoveAll(workDir)
+	g := &Git{Label: "coreboot", URL: "file://" + repo, Hash: &base, Patches: []Patch{{Path: "a.patch"}, {Path: "b.patch"}}}
+	require.NoError(t, g.Get(projectDir, workDir, nil, hashModePermissive, nil))
+
+	// mailbox patches are committed, others are left in the working tree.
+	assert.Equal(t, "Change a", runTestGit(t, workDir, "log", "-1", "--format=%s"))
+	assert.Equal(t, "M b.txt", runTestGit(t, workDir, "status", "--porcelain"))
+	data, err := ioutil.ReadFile(filepath.Join(workDir, "a.txt"))
+	require.NoError(t, err)
+	assert.Equal(t, "a1\n", string(data))
+	for _, p := range g.Patches {
+		assert.NotEmpty(t, p.Hash)
+	}
+}
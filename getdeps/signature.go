@@ -0,0 +1,119 @@
+// Copyright (c) Facebook, Inc. and its affiliates.
+//
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+)
+
+// Signature describes the detached OpenPGP signature of a tarball or file.
+type Signature struct {
+	// URL of the detached signature, either binary (.sig) or ASCII-armored
+	// (.asc). URL overrides apply to it.
+	URL string `json:"url"`
+	// Path of the keyring containing the allowed signing keys, either binary
+	// or ASCII-armored. Relative paths are relative to the base directory.
+	Keyring string `json:"keyring"`
+	// Whether the signature covers the uncompressed content rather than the
+	// downloaded file, as is the case for kernel.org tarballs. Only meaningful
+	// for untar entries.
+	Uncompressed bool `json:"uncompressed,omitempty"`
+	// Fingerprint of the primary key that made the signature. Set once the
+	// signature is verified.
+	SignedBy string `json:"signed_by,omitempty"`
+}
+
+// verify checks the signature of the content read from r against the
+// keyring, and records the fingerprint of the signing key.
+func (sig *Signature) verify(label, projectDir string, r io.Reader, urlOverrides *URLOverrides) error {
+	if sig.URL == "" || sig.Keyring == "" {
+		return fmt.Errorf("%s: signature URL and keyring must be specified", label)
+	}
+	keyringPath := sig.Keyring
+	if !filepath.IsAbs(keyringPath) {
+		keyringPath = filepath.Join(projectDir, keyringPath)
+	}
+	keyring, err := readKeyring(keyringPath)
+	if err != nil {
+		return fmt.Errorf("%s: failed to read keyring '%s': %w", label, keyringPath, err)
+	}
+
+	// The signature itself needs no hash, it is only trusted if it verifies
+	// against the keyring.
+	sigFile, _, _, err := fetchAndVerify(label, projectDir, []string{sig.URL}, hashModePermissive, nil, urlOverrides)
+	if err != nil {
+		return fmt.Errorf("%s: failed to fetch signature: %w", label, err)
+	}
+	defer sigFile.Close()
+
+	if sig.Uncompressed {
+		uncompressed, err := decompress(r)
+		if err != nil {
+			return fmt.Errorf("%s: %w", label, err)
+		}
+		defer uncompressed.Close()
+		r = uncompressed
+	}
+
+	signer, err := checkDetachedSignature(keyring, r, sigFile)
+	if err != nil {
+		return fmt.Errorf("%s: signature verification failed: %w", label, err)
+	}
+	sig.SignedBy = fmt.Sprintf("%X", signer.PrimaryKey.Fingerprint)
+	log.Printf("%s: Signature verified, signed by %s", label, sig.SignedBy)
+	return nil
+}
+
+// verifySignature checks the downloaded file f against the signature, if
+// any, and rewinds it.
+func verifySignature(label, projectDir string, sig *Signature, f *os.File, urlOverrides *URLOverrides) error {
+	if sig == nil {
+		return nil
+	}
+	if err := sig.verify(label, projectDir, f, urlOverrides); err != nil {
+		return err
+	}
+	_, err := f.Seek(0, io.SeekStart)
+	return err
+}
+
+// readKeyring reads a binary or ASCII-armored OpenPGP keyring.
+func readKeyring(name string) (openpgp.EntityList, error) {
+	data, err := ioutil.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	if isArmored(data) {
+		return openpgp.ReadArmoredKeyRing(bytes.NewReader(data))
+	}
+	return openpgp.ReadKeyRing(bytes.NewReader(data))
+}
+
+// checkDetachedSignature checks a binary or ASCII-armored detached signature
+// and returns the signer. Signatures made by keys which are expired or revoked
+// at the time of the check are rejected.
+func checkDetachedSignature(keyring openpgp.KeyRing, signed, signature io.Reader) (*openpgp.Entity, error) {
+	br := bufio.NewReader(signature)
+	head, _ := br.Peek(64)
+	if isArmored(head) {
+		return openpgp.CheckArmoredDetachedSignature(keyring, signed, br, nil)
+	}
+	return openpgp.CheckDetachedSignature(keyring, signed, br, nil)
+}
+
+func isArmored(data []byte) bool {
+	return strings.HasPrefix(strings.TrimSpace(string(data)), "-----BEGIN")
+}
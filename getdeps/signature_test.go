@@ -0,0 +1,158 @@
+// Copyright (c) Facebook, Inc. and its affiliates.
+//
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"github.com/ProtonMail/go-crypto/openpgp/armor"
+	pgperrors "github.com/ProtonMail/go-crypto/openpgp/errors"
+	"github.com/ProtonMail/go-crypto/openpgp/packet"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newTestKeyring generates a signing key and writes its public part to an
+// ASCII-armored keyring in dir.
+func newTestKeyring(t *testing.T, dir, name string) (*openpgp.Entity, string) {
+	entity, err := openpgp.NewEntity(name, "", name+"@example.com", nil)
+	require.NoError(t, err)
+	keyring := filepath.Join(dir, name+".asc")
+	writeTestKeyring(t, entity, keyring)
+	return entity, keyring
+}
+
+// writeTestKeyring writes the public part of the key to an ASCII-armored
+// keyring.
+func writeTestKeyring(t *testing.T, entity *openpgp.Entity, keyring string) {
+	var buf bytes.Buffer
+	w, err := armor.Encode(&buf, openpgp.PublicKeyType, nil)
+	require.NoError(t, err)
+	require.NoError(t, entity.Serialize(w))
+	require.NoError(t, w.Close())
+	require.NoError(t, ioutil.WriteFile(keyring, buf.Bytes(), 0644))
+}
+
+func TestFilesSignature(t *testing.T) {
+	dir, err := ioutil.TempDir("", "getdeps-sig")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	signer, keyring := newTestKeyring(t, dir, "signer")
+	_, otherKeyring := newTestKeyring(t, dir, "other")
+
+	content := []byte("hello")
+	var binarySig, armoredSig bytes.Buffer
+	require.NoError(t, openpgp.DetachSign(&binarySig, signer, bytes.NewReader(content), nil))
+	require.NoError(t, openpgp.ArmoredDetachSign(&armoredSig, signer, bytes.NewReader(content), nil))
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/hello.txt.sig":
+			w.Write(binarySig.Bytes())
+		case "/hello.txt.asc":
+			w.Write(armoredSig.Bytes())
+		default:
+			w.Write(content)
+		}
+	}))
+	defer ts.Close()
+
+	fingerprint := fmt.Sprintf("%X", signer.PrimaryKey.Fingerprint)
+	for _, ext := range []string{"sig", "asc"} {
+		workDir := filepath.Join(dir, "work-"+ext)
+		ff := Files{
+			Label: "files",
+			Filelist: []File{{
+				URL: ts.URL + "/hello.txt",
+				// relative to the base directory.
+				Signature: &Signature{URL: ts.URL + "/hello.txt." + ext, Keyring: filepath.Base(keyring)},
+			}},
+		}
+		require.NoError(t, ff.Get(dir, workDir, nil, hashModeUpdate), ext)
+		assert.Equal(t, fingerprint, ff.Filelist[0].Signature.SignedBy, ext)
+		assert.FileExists(t, filepath.Join(workDir, "hello.txt"), ext)
+	}
+
+	// a signature made by a key which is not in the keyring is rejected, and
+	// the file is not written.
+	workDir := filepath.Join(dir, "work-other")
+	ff := Files{
+		Label: "files",
+		Filelist: []File{{
+			URL:       ts.URL + "/hello.txt",
+			Hash:      testHash,
+			Signature: &Signature{URL: ts.URL + "/hello.txt.sig", Keyring: otherKeyring},
+		}},
+	}
+	assert.Error(t, ff.Get(dir, workDir, nil, hashModeStrict))
+	assert.Equal(t, "", ff.Filelist[0].Signature.SignedBy)
+	assert.NoFileExists(t, filepath.Join(workDir, "hello.txt"))
+}
+
+func TestSignatureUncompressed(t *testing.T) {
+	dir, err := ioutil.TempDir("", "getdeps-sig")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	signer, keyring := newTestKeyring(t, dir, "signer")
+	content := []byte("uncompressed content")
+	var compressed, sig bytes.Buffer
+	gw := gzip.NewWriter(&compressed)
+	_, err = gw.Write(content)
+	require.NoError(t, err)
+	require.NoError(t, gw.Close())
+	require.NoError(t, openpgp.DetachSign(&sig, signer, bytes.NewReader(content), nil))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "content.sig"), sig.Bytes(), 0644))
+
+	s := Signature{URL: "file:///content.sig", Keyring: keyring}
+	assert.Error(t, s.verify("test", dir, bytes.NewReader(compressed.Bytes()), nil))
+	s.Uncompressed = true
+	require.NoError(t, s.verify("test", dir, bytes.NewReader(compressed.Bytes()), nil))
+	assert.Equal(t, fmt.Sprintf("%X", signer.PrimaryKey.Fingerprint), s.SignedBy)
+}
+
+func TestSignatureKeyValidity(t *testing.T) {
+	dir, err := ioutil.TempDir("", "getdeps-sig")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	content := []byte("hello")
+	sign := func(signer *openpgp.Entity, config *packet.Config) {
+		var sig bytes.Buffer
+		require.NoError(t, openpgp.DetachSign(&sig, signer, bytes.NewReader(content), config))
+		require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "hello.txt.sig"), sig.Bytes(), 0644))
+	}
+	s := Signature{URL: "file:///hello.txt.sig", Keyring: "signer.asc"}
+
+	// a signature made by a key which has since been revoked.
+	signer, keyring := newTestKeyring(t, dir, "signer")
+	sign(signer, nil)
+	require.NoError(t, s.verify("test", dir, bytes.NewReader(content), nil))
+	require.NoError(t, signer.RevokeKey(packet.KeySuperseded, "superseded", nil))
+	writeTestKeyring(t, signer, keyring)
+	assert.ErrorIs(t, s.verify("test", dir, bytes.NewReader(content), nil), pgperrors.ErrKeyRevoked)
+
+	// a signature made by a key which has since expired.
+	past := &packet.Config{
+		Time:            func() time.Time { return time.Now().Add(-48 * time.Hour) },
+		KeyLifetimeSecs: 3600,
+	}
+	signer, err = openpgp.NewEntity("signer", "", "signer@example.com", past)
+	require.NoError(t, err)
+	writeTestKeyring(t, signer, keyring)
+	sign(signer, past)
+	assert.ErrorIs(t, s.verify("test", dir, bytes.NewReader(content), nil), pgperrors.ErrKeyExpired)
+}
@@ -0,0 +1,361 @@
+// Copyright (c) Facebook, Inc. and its affiliates.
+//
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/url"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Submodules selects the submodules of a Git repository. In the
+// configuration, it is either "all", "none", or a list of submodule paths.
+type Submodules struct {
+	All   bool
+	Paths []string
+}
+
+// MarshalJSON implements json.Marshaler.
+func (s Submodules) MarshalJSON() ([]byte, error) {
+	switch {
+	case s.All:
+		return json.Marshal("all")
+	case len(s.Paths) > 0:
+		return json.Marshal(s.Paths)
+	}
+	return json.Marshal("none")
+}
+
+// UnmarshalJSON implements json.Unmarshaler.
+func (s *Submodules) UnmarshalJSON(data []byte) error {
+	var str string
+	if err := json.Unmarshal(data, &str); err == nil {
+		switch str {
+		case "all":
+			*s = Submodules{All: true}
+		case "none":
+			*s = Submodules{}
+		default:
+			return fmt.Errorf("invalid submodules %q, must be \"all\", \"none\" or a list of paths", str)
+		}
+		return nil
+	}
+	var paths []string
+	if err := json.Unmarshal(data, &paths); err != nil {
+		return fmt.Errorf("invalid submodules %s, must be \"all\", \"none\" or a list of paths", data)
+	}
+	*s = Submodules{Paths: paths}
+	return nil
+}
+
+// submodule is a submodule recorded in a commit of a Git repository.
+type submodule struct {
+	name string
+	path string
+	url  string
+	// commit recorded by the superproject.
+	hash string
+}
+
+// gitSubmodules returns the submodules recorded in the commit rev of the
+// repository at dir, which may be a bare repository, sorted by path.
+// Submodules listed in .gitmodules but missing from the tree are ignored.
+func gitSubmodules(dir, rev string) ([]submodule, error) {
+	if err := exec.Command("git", "-C", dir, "cat-file", "-e", rev+":.gitmodules").Run(); err != nil {
+		// no submodules.
+		return nil, nil
+	}
+	cmd := exec.Command("git", "-C", dir, "config", "--blob", rev+":.gitmodules", "-z", "--get-regexp", `^submodule\..*\.(path|url)$`)
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("error running %v: %w", cmd, err)
+	}
+	byName := map[string]*submodule{}
+	for _, entry := range strings.Split(string(out), "\x00") {
+		i := strings.IndexByte(entry, '\n')
+		if i < 0 {
+			continue
+		}
+		key, value := entry[:i], entry[i+1:]
+		dot := strings.LastIndexByte(key, '.')
+		name := key[len("submodule."):dot]
+		s, ok := byName[name]
+		if !ok {
+			s = &submodule{name: name}
+			byName[name] = s
+		}
+		if key[dot+1:] == "path" {
+			s.path = path.Clean(value)
+		} else {
+			s.url = value
+		}
+	}
+
+	byPath := map[string]*submodule{}
+	args := []string{"-C", dir, "ls-tree", "-z", rev, "--"}
+	for _, s := range byName {
+		if s.path != "" && s.url != "" {
+			byPath[s.path] = s
+			args = append(args, s.path)
+		}
+	}
+	if len(byPath) == 0 {
+		return nil, nil
+	}
+	cmd = exec.Command("git", args...)
+	if out, err = cmd.Output(); err != nil {
+		return nil, fmt.Errorf("error running %v: %w", cmd, err)
+	}
+	var subs []submodule
+	for _, entry := range strings.Split(string(out), "\x00") {
+		// <mode> SP <type> SP <object> TAB <path>
+		fields := strings.SplitN(entry, "\t", 2)
+		if len(fields) != 2 {
+			continue
+		}
+		info := strings.Fields(fields[0])
+		s, ok := byPath[fields[1]]
+		if !ok || len(info) != 3 || info[1] != "commit" {
+			continue
+		}
+		s.hash = info[2]
+		subs = append(subs, *s)
+	}
+	sort.Slice(subs, func(i, j int) bool { return subs[i].path < subs[j].path })
+	return subs, nil
+}
+
+// submoduleURL returns the URL of a submodule of the repository at repo. Like
+// Git, URLs starting with ./ or ../ are relative to the URL of the
+// superproject, e.g. ../vboot.git is a sibling of coreboot.git.
+func submoduleURL(repo, subURL string) string {
+	if !strings.HasPrefix(subURL, "./") && !strings.HasPrefix(subURL, "../") {
+		return subURL
+	}
+	if strings.Contains(repo, "://") {
+		if u, err := url.Parse(repo); err == nil {
+			u.Path = path.Join(u.Path, subURL)
+			return u.String()
+		}
+	}
+	if !isRelativeRepoPath(repo) && !filepath.IsAbs(repo) {
+		// scp-like URL.
+		i := strings.IndexByte(repo, ':')
+		return repo[:i+1] + path.Join(repo[i+1:], subURL)
+	}
+	return filepath.Join(repo, filepath.FromSlash(subURL))
+}
+
+// selectedSubmodules returns the submodules of the repository at dir to check
+// out in the commit rev, except those whose path, relative to the repository,
+// is listed in skip.
+func (g *Git) selectedSubmodules(dir, rev string, skip []string) ([]submodule, error) {
+	if g.Submodules == nil || (!g.Submodules.All && len(g.Submodules.Paths) == 0) {
+		return nil, nil
+	}
+	subs, err := gitSubmodules(dir, rev)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", g.Label, err)
+	}
+	selected := map[string]bool{}
+	for _, p := range g.Submodules.Paths {
+		selected[path.Clean(p)] = true
+	}
+	skipped := map[string]bool{}
+	for _, p := range skip {
+		skipped[p] = true
+	}
+	var ret []submodule
+	for _, s := range subs {
+		if !g.Submodules.All && !selected[s.path] {
+			continue
+		}
+		delete(selected, s.path)
+		if skipped[s.path] {
+			log.Printf("%s: Not checking out submodule %s, it is fetched by another entry", g.Label, s.path)
+			continue
+		}
+		ret = append(ret, s)
+	}
+	if len(selected) > 0 {
+		missing := make([]string, 0, len(selected))
+		for p := range selected {
+			missing = append(missing, p)
+		}
+		sort.Strings(missing)
+		return nil, fmt.Errorf("%s: submodules not found: %s", g.Label, strings.Join(missing, ", "))
+	}
+	return ret, nil
+}
+
+// submoduleRepo returns the repository to clone the submodule from, and
+// whether it is a local one. Since .gitmodules may come from an untrusted
+// repository, local repositories are only allowed when set by a URL override,
+// e.g. of a bundle: Git disables them by default for submodules, see
+// CVE-2022-39253.
+func (g *Git) submoduleRepo(projectDir string, s submodule, urlOverrides *URLOverrides) (string, bool, error) {
+	subURL := submoduleURL(g.URL, s.url)
+	repo := resolveRepo(projectDir, subURL, urlOverrides)
+	if localRepoPath(repo) == "" {
+		return repo, false, nil
+	}
+	if urlOverrides == nil || urlOverrides.Override(subURL) == subURL {
+		return "", false, fmt.Errorf("%s: submodule %s: local repository %s is only allowed through a URL override", g.Label, s.path, redactURL(repo))
+	}
+	return repo, true, nil
+}
+
+// updateSubmodules checks out the selected submodules of the repository at
+// dest at the commits recorded by the superproject, and records them in
+// SubmoduleHashes. URL overrides apply to the submodule URLs, relative ones
+// being resolved against the URL of the superproject before overrides.
+func (g *Git) updateSubmodules(projectDir, dest string, urlOverrides *URLOverrides, skip []string) error {
+	g.SubmoduleHashes = nil
+	subs, err := g.selectedSubmodules(dest, "HEAD", skip)
+	if err != nil || len(subs) == 0 {
+		return err
+	}
+	var paths []string
+	allowLocal := false
+	hashes := map[string]string{}
+	for _, s := range subs {
+		repo, local, err := g.submoduleRepo(projectDir, s, urlOverrides)
+		if err != nil {
+			return err
+		}
+		if offline && !local {
+			return fmt.Errorf("%s: cannot clone submodule %s from %s: %w", g.Label, s.path, redactURL(repo), errOffline)
+		}
+		allowLocal = allowLocal || local
+		// submodule update --init keeps the URL already configured.
+		if err := runCommand(g.Label, "git", "-C", dest, "config", "submodule."+s.name+".url", repo); err != nil {
+			return fmt.Errorf("%s: %w", g.Label, err)
+		}
+		paths = append(paths, s.path)
+		hashes[s.path] = s.hash
+	}
+	args := []string{"-C", dest}
+	if allowLocal {
+		// local repositories are not allowed by default for submodules, the
+		// ones set by URL overrides are trusted.
+		args = append(args, "-c", "protocol.file.allow=always")
+	}
+	args = append(append(args, "submodule", "update", "--init", "--"), paths...)
+	log.Printf("%s: Checking out %d submodules...", g.Label, len(subs))
+	if err := runCommand(g.Label, "git", args...); err != nil {
+		return fmt.Errorf("%s: %w", g.Label, err)
+	}
+	g.SubmoduleHashes = hashes
+	return nil
+}
+
+// missingSubmodulesOffline returns a description of every selected submodule
+// which cannot be cloned without network access. The submodules are listed
+// from the local repository or the Git cache mirror of the superproject; if
+// neither has the commit, the superproject itself is missing.
+func (g *Git) missingSubmodulesOffline(projectDir string, urlOverrides *URLOverrides, hashMode HashMode, skip []string) []string {
+	if g.Submodules == nil || (!g.Submodules.All && len(g.Submodules.Paths) == 0) {
+		return nil
+	}
+	rev := ""
+	if g.Hash != nil && hashMode != hashModeUpdate {
+		rev = *g.Hash
+	}
+	repo := resolveRepo(projectDir, g.URL, urlOverrides)
+	dir := localRepoPath(repo)
+	if dir == "" {
+		// hashes are discarded in update mode, so the cache cannot be used.
+		if gitCache == nil || rev == "" || !gitCache.has(repo, rev) {
+			return nil
+		}
+		dir = gitCache.path(repo)
+	} else if rev == "" {
+		rev = defaultBranch
+		if g.Tag != nil && *g.Tag != "" {
+			rev = *g.Tag
+		} else if g.Branch != nil && *g.Branch != "" {
+			rev = *g.Branch
+		}
+	}
+	subs, err := gitSubmodules(dir, rev)
+	if err != nil {
+		return []string{fmt.Sprintf("git %s: %v", g.Label, err)}
+	}
+	selected := map[string]bool{}
+	for _, p := range g.Submodules.Paths {
+		selected[path.Clean(p)] = true
+	}
+	skipped := map[string]bool{}
+	for _, p := range skip {
+		skipped[p] = true
+	}
+	var missing []string
+	for _, s := range subs {
+		if (!g.Submodules.All && !selected[s.path]) || skipped[s.path] {
+			continue
+		}
+		if subRepo, local, err := g.submoduleRepo(projectDir, s, urlOverrides); err == nil && local {
+			if _, err := os.Stat(localRepoPath(subRepo)); err == nil {
+				continue
+			}
+		}
+		missing = append(missing, fmt.Sprintf("git %s: submodule %s: %s", g.Label, s.path, redactURL(submoduleURL(g.URL, s.url))))
+	}
+	return missing
+}
+
+// nestedGitDests returns the destinations of the Git entries of the node
+// inside the destination of entry i, relative to it.
+func (n *Node) nestedGitDests(i int) []string {
+	var dests []string
+	for j := range n.Git {
+		rel, err := filepath.Rel(filepath.Clean(n.Git[i].Dest), filepath.Clean(n.Git[j].Dest))
+		if j == i || err != nil || rel == "." || rel == ".." || strings.HasPrefix(rel, "../") {
+			continue
+		}
+		dests = append(dests, filepath.ToSlash(rel))
+	}
+	return dests
+}
+
+// submoduleDrift returns a description of every Git entry checked out under
+// workDir whose hash differs from the commit recorded for its path by the
+// superproject, another Git entry containing it, e.g. a separate vboot entry
+// not matching coreboot's 3rdparty/vboot submodule.
+func (n *Node) submoduleDrift(workDir string) []string {
+	var drift []string
+	for i := range n.Git {
+		super := &n.Git[i]
+		nested := n.nestedGitDests(i)
+		if len(nested) == 0 {
+			continue
+		}
+		subs, err := gitSubmodules(filepath.Join(workDir, super.Dest), "HEAD")
+		if err != nil {
+			log.Printf("%s: Cannot list submodules: %v", super.Label, err)
+			continue
+		}
+		for _, s := range subs {
+			for j := range n.Git {
+				g := &n.Git[j]
+				if j == i || g.Hash == nil || path.Join(filepath.ToSlash(super.Dest), s.path) != path.Clean(filepath.ToSlash(g.Dest)) {
+					continue
+				}
+				if *g.Hash != s.hash {
+					drift = append(drift, fmt.Sprintf("%s: hash %s differs from %s, recorded for submodule %s by %s", g.Label, *g.Hash, s.hash, s.path, super.Label))
+				}
+			}
+		}
+	}
+	return drift
+}
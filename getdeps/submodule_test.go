@@ -0,0 +1,167 @@
+// Copyright (c) Facebook, Inc. and its affiliates.
+//
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// runTestGit runs a git command in dir and returns its trimmed output.
+func runTestGit(t *testing.T, dir string, args ...string) string {
+	cmd := exec.Command("git", append([]string{"-C", dir, "-c", "user.name=test", "-c", "user.email=test@example.com", "-c", "protocol.file.allow=always"}, args...)...)
+	out, err := cmd.CombinedOutput()
+	require.NoError(t, err, string(out))
+	return strings.TrimSpace(string(out))
+}
+
+func TestSubmodulesJSON(t *testing.T) {
+	for _, tc := range []struct {
+		json string
+		s    Submodules
+	}{
+		{`"all"`, Submodules{All: true}},
+		{`"none"`, Submodules{}},
+		{`["3rdparty/vboot","3rdparty/blobs"]`, Submodules{Paths: []string{"3rdparty/vboot", "3rdparty/blobs"}}},
+	} {
+		var s Submodules
+		require.NoError(t, json.Unmarshal([]byte(tc.json), &s))
+		assert.Equal(t, tc.s, s)
+		data, err := json.Marshal(s)
+		require.NoError(t, err)
+		assert.Equal(t, tc.json, string(data))
+	}
+	var s Submodules
+	assert.Error(t, json.Unmarshal([]byte(`"some"`), &s))
+	assert.Error(t, json.Unmarshal([]byte(`true`), &s))
+}
+
+func TestSubmoduleURL(t *testing.T) {
+	for _, tc := range []struct {
+		repo, url, want string
+	}{
+		{"https://review.coreboot.org/coreboot.git", "../vboot.git", "https://review.coreboot.org/vboot.git"},
+		{"https://review.coreboot.org/coreboot", "./blobs", "https://review.coreboot.org/coreboot/blobs"},
+		{"git@github.com:osf/coreboot.git", "../vboot.git", "git@github.com:osf/vboot.git"},
+		{"/srv/git/coreboot.git", "../vboot.git", "/srv/git/vboot.git"},
+		{"mirrors/coreboot", "../vboot", "mirrors/vboot"},
+		{"https://review.coreboot.org/coreboot.git", "https://chromium.googlesource.com/vboot.git", "https://chromium.googlesource.com/vboot.git"},
+	} {
+		assert.Equal(t, tc.want, submoduleURL(tc.repo, tc.url), "%s %s", tc.repo, tc.url)
+	}
+}
+
+func TestGitSubmodules(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not found")
+	}
+	vboot := newTestGitRepo(t, map[string]string{"README": "vboot"})
+	vbootHash := runTestGit(t, vboot, "rev-parse", "HEAD")
+	coreboot := newTestGitRepo(t, map[string]string{"README": "coreboot"})
+	runTestGit(t, coreboot, "submodule", "add", "-q", "file://"+vboot, "3rdparty/vboot")
+	// relative URLs are resolved against the superproject URL.
+	runTestGit(t, coreboot, "config", "-f", ".gitmodules", "submodule.3rdparty/vboot.url", "../vboot.git")
+	runTestGit(t, coreboot, "commit", "-q", "-a", "-m", "add vboot")
+	// a later vboot commit, not recorded by coreboot.
+	require.NoError(t, ioutil.WriteFile(filepath.Join(vboot, "README"), []byte("vboot 2"), 0644))
+	runTestGit(t, vboot, "commit", "-q", "-a", "-m", "update")
+	newHash := runTestGit(t, vboot, "rev-parse", "HEAD")
+
+	overrides := URLOverrides{
+		"https://review.coreboot.org/coreboot.git": "file://" + coreboot,
+		"https://review.coreboot.org/vboot.git":    "file://" + vboot,
+	}
+	get := func(n *Node) (string, error) {
+		workDir, err := ioutil.TempDir("", "getdeps-work")
+		require.NoError(t, err)
+		t.Cleanup(func() { os.RemoveAll(workDir) })
+		return workDir, n.Get("", workDir, &overrides, hashModePermissive)
+	}
+
+	n := &Node{Git: []Git{{Label: "coreboot", URL: "https://review.coreboot.org/coreboot.git", Submodules: &Submodules{All: true}}}}
+	workDir, err := get(n)
+	require.NoError(t, err)
+	data, err := ioutil.ReadFile(filepath.Join(workDir, "3rdparty/vboot/README"))
+	require.NoError(t, err)
+	assert.Equal(t, "vboot", string(data))
+	assert.Equal(t, map[string]string{"3rdparty/vboot": vbootHash}, n.Git[0].SubmoduleHashes)
+
+	// submodules are not checked out by default.
+	n.Git[0].Submodules = nil
+	workDir, err = get(n)
+	require.NoError(t, err)
+	assert.NoFileExists(t, filepath.Join(workDir, "3rdparty/vboot/README"))
+	assert.Nil(t, n.Git[0].SubmoduleHashes)
+
+	n.Git[0].Submodules = &Submodules{Paths: []string{"3rdparty/blobs"}}
+	_, err = get(n)
+	assert.Error(t, err)
+
+	// local submodule URLs from .gitmodules are only allowed through
+	// overrides.
+	evil := newTestGitRepo(t, map[string]string{"README": "evil"})
+	runTestGit(t, evil, "submodule", "add", "-q", "file://"+vboot, "vboot")
+	runTestGit(t, evil, "commit", "-q", "-a", "-m", "add vboot")
+	_, err = get(&Node{Git: []Git{{Label: "evil", URL: "file://" + evil, Submodules: &Submodules{All: true}}}})
+	assert.Contains(t, fmt.Sprint(err), "only allowed through a URL override")
+
+	// an explicit entry takes precedence over the submodule, and its drift is
+	// reported.
+	n.Git[0].Submodules = &Submodules{Paths: []string{"3rdparty/vboot"}}
+	n.Git = append(n.Git, Git{Label: "vboot", URL: "file://" + vboot, Dest: "3rdparty/vboot"})
+	workDir, err = get(n)
+	require.NoError(t, err)
+	data, err = ioutil.ReadFile(filepath.Join(workDir, "3rdparty/vboot/README"))
+	require.NoError(t, err)
+	assert.Equal(t, "vboot 2", string(data))
+	assert.Nil(t, n.Git[0].SubmoduleHashes)
+	assert.Equal(t, []string{
+		"vboot: hash " + newHash + " differs from " + vbootHash + ", recorded for submodule 3rdparty/vboot by coreboot",
+	}, n.submoduleDrift(workDir))
+
+	n.Git[1].Hash = &vbootHash
+	workDir, err = get(n)
+	require.NoError(t, err)
+	assert.Empty(t, n.submoduleDrift(workDir))
+
+	// submodules are vendored along with their superproject.
+	n = &Node{Git: []Git{{Label: "coreboot", URL: "https://review.coreboot.org/coreboot.git", Submodules: &Submodules{All: true}}}}
+	bundle := filepath.Join(workDir, "bundle")
+	require.NoError(t, vendorBundle(bundle, &Config{Coreboot: n}, []string{"coreboot"}, "", &overrides, hashModeUpdate))
+	data, err = ioutil.ReadFile(filepath.Join(bundle, bundleConfigFile))
+	require.NoError(t, err)
+	bundleConfig, err := NewConfig(data)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"3rdparty/vboot": vbootHash}, bundleConfig.Coreboot.Git[0].SubmoduleHashes)
+	data, err = ioutil.ReadFile(filepath.Join(bundle, bundleURLOverridesFile))
+	require.NoError(t, err)
+	bundleOverrides, err := NewURLOverrides(data)
+	require.NoError(t, err)
+	assert.Equal(t, "coreboot/git/coreboot/submodules/3rdparty/vboot.git", (*bundleOverrides)["https://review.coreboot.org/vboot.git"])
+
+	assert.Empty(t, bundleConfig.Coreboot.missingOffline(bundle, bundleOverrides, hashModeStrict))
+	delete(*bundleOverrides, "https://review.coreboot.org/vboot.git")
+	assert.Equal(t, []string{
+		"git coreboot: submodule 3rdparty/vboot: https://review.coreboot.org/vboot.git",
+	}, bundleConfig.Coreboot.missingOffline(bundle, bundleOverrides, hashModeStrict))
+	(*bundleOverrides)["https://review.coreboot.org/vboot.git"] = "coreboot/git/coreboot/submodules/3rdparty/vboot.git"
+
+	offline = true
+	defer func() { offline = false }()
+	bundleWorkDir := filepath.Join(workDir, "work")
+	require.NoError(t, os.Mkdir(bundleWorkDir, 0755))
+	require.NoError(t, bundleConfig.Coreboot.Get(bundle, bundleWorkDir, bundleOverrides, hashModeStrict))
+	assert.FileExists(t, filepath.Join(bundleWorkDir, "3rdparty/vboot/README"))
+}
@@ -0,0 +1,286 @@
+// Copyright (c) Facebook, Inc. and its affiliates.
+//
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// version is a numeric version, e.g. 5.10.3. Missing components are zero.
+type version []int
+
+// tagVersionRe matches the tags which are release versions, e.g. 4.14 or
+// v5.10.3 but not v5.11-rc1.
+var tagVersionRe = regexp.MustCompile(`^v?([0-9]+(\.[0-9]+)*)$`)
+
+// parseVersion parses a dot-separated list of numbers.
+func parseVersion(s string) (version, error) {
+	var v version
+	for _, part := range strings.Split(s, ".") {
+		n, err := strconv.Atoi(part)
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("invalid version %q", s)
+		}
+		v = append(v, n)
+	}
+	return v, nil
+}
+
+// tagVersion returns the version of a release tag.
+func tagVersion(tag string) (version, bool) {
+	m := tagVersionRe.FindStringSubmatch(tag)
+	if m == nil {
+		return nil, false
+	}
+	v, err := parseVersion(m[1])
+	return v, err == nil
+}
+
+func (v version) compare(o version) int {
+	for i := 0; i < len(v) || i < len(o); i++ {
+		var a, b int
+		if i < len(v) {
+			a = v[i]
+		}
+		if i < len(o) {
+			b = o[i]
+		}
+		if a != b {
+			if a < b {
+				return -1
+			}
+			return 1
+		}
+	}
+	return 0
+}
+
+// next returns the version following v in its last component, e.g. 5.11 for
+// 5.10.
+func (v version) next() version {
+	n := append(version{}, v...)
+	n[len(n)-1]++
+	return n
+}
+
+// versionComparator compares a version to a bound.
+type versionComparator struct {
+	op    string
+	bound version
+}
+
+func (c versionComparator) match(v version) bool {
+	cmp := v.compare(c.bound)
+	switch c.op {
+	case ">=":
+		return cmp >= 0
+	case ">":
+		return cmp > 0
+	case "<=":
+		return cmp <= 0
+	case "<":
+		return cmp < 0
+	}
+	return cmp == 0
+}
+
+// versionConstraint is a version constraint, matched by versions matching all
+// of its comparators.
+type versionConstraint []versionComparator
+
+// parseVersionConstraint parses a version constraint. It is a list of
+// comparisons separated by commas or spaces, all of which must match:
+//   - ">=5.10", ">5.10", "<=5.10", "<5.10": comparisons.
+//   - "5.10", "=5.10", "5.10.x": the 5.10 series, i.e. >=5.10 <5.11.
+//   - "~5.10": patch updates, i.e. >=5.10 <5.11; "~5" is >=5 <6.
+//   - "^5.10": minor updates, i.e. >=5.10 <6; "^0.10" is >=0.10 <0.11.
+//
+// Versions may start with "v".
+func parseVersionConstraint(s string) (versionConstraint, error) {
+	fields := strings.FieldsFunc(s, func(r rune) bool { return r == ',' || unicode.IsSpace(r) })
+	if len(fields) == 0 {
+		return nil, fmt.Errorf("empty version constraint")
+	}
+	var c versionConstraint
+	for _, f := range fields {
+		op := ""
+		for _, prefix := range []string{">=", "<=", ">", "<", "=", "~", "^"} {
+			if strings.HasPrefix(f, prefix) {
+				op = prefix
+				break
+			}
+		}
+		parts := strings.Split(strings.TrimPrefix(f[len(op):], "v"), ".")
+		for len(parts) > 1 && (parts[len(parts)-1] == "x" || parts[len(parts)-1] == "X" || parts[len(parts)-1] == "*") {
+			parts = parts[:len(parts)-1]
+		}
+		v, err := parseVersion(strings.Join(parts, "."))
+		if err != nil {
+			return nil, fmt.Errorf("invalid version constraint %q: %w", s, err)
+		}
+		switch op {
+		case ">=", ">", "<=", "<":
+			c = append(c, versionComparator{op, v})
+		case "", "=":
+			c = append(c, versionComparator{">=", v}, versionComparator{"<", v.next()})
+		case "~":
+			upper := v
+			if len(upper) > 2 {
+				upper = upper[:2]
+			}
+			c = append(c, versionComparator{">=", v}, versionComparator{"<", upper.next()})
+		case "^":
+			// the first non-zero component may not change.
+			i := 0
+			for i < len(v)-1 && v[i] == 0 {
+				i++
+			}
+			c = append(c, versionComparator{">=", v}, versionComparator{"<", v[:i+1].next()})
+		}
+	}
+	return c, nil
+}
+
+func (c versionConstraint) match(v version) bool {
+	for _, comparator := range c {
+		if !comparator.match(v) {
+			return false
+		}
+	}
+	return true
+}
+
+// newestTag returns the tag with the highest version matching the
+// constraint, or an empty string if there is none.
+func newestTag(tags map[string]string, c versionConstraint) string {
+	var (
+		newest        string
+		newestVersion version
+	)
+	for tag := range tags {
+		v, ok := tagVersion(tag)
+		if !ok || !c.match(v) {
+			continue
+		}
+		// for determinism, v5.10 wins over 5.10.
+		if cmp := v.compare(newestVersion); newest == "" || cmp > 0 || (cmp == 0 && tag > newest) {
+			newest, newestVersion = tag, v
+		}
+	}
+	return newest
+}
+
+// gitTags returns the commit every tag of the repository points at, by tag
+// name. In offline mode, the tags of the mirror in the Git cache are used.
+func gitTags(label, repo string) (map[string]string, error) {
+	if offline && localRepoPath(repo) == "" {
+		if gitCache == nil {
+			return nil, fmt.Errorf("%s: cannot list the tags of %s: %w", label, redactURL(repo), errOffline)
+		}
+		p := gitCache.path(repo)
+		if _, err := os.Stat(p); err != nil {
+			return nil, fmt.Errorf("%s: %s not in the Git cache: %w", label, redactURL(repo), errOffline)
+		}
+		repo = p
+	}
+	var refs [][2]string
+	if gitBackend == gitBackendGoGit {
+		var err error
+		if refs, err = goGitLsRemote(repo); err != nil {
+			return nil, fmt.Errorf("%s: %w", label, err)
+		}
+	} else {
+		cmd := exec.Command("git", "ls-remote", "--tags", repo)
+		cmd.Env = gitCommandEnv()
+		out, err := cmd.Output()
+		if err != nil {
+			return nil, fmt.Errorf("%s: error running %v: %w", label, cmd, err)
+		}
+		for _, line := range strings.Split(string(out), "\n") {
+			if fields := strings.Fields(line); len(fields) == 2 {
+				refs = append(refs, [2]string{fields[0], fields[1]})
+			}
+		}
+	}
+	tags := map[string]string{}
+	for _, ref := range refs {
+		if !strings.HasPrefix(ref[1], "refs/tags/") {
+			continue
+		}
+		name := strings.TrimPrefix(ref[1], "refs/tags/")
+		if peeled := strings.TrimSuffix(name, "^{}"); peeled != name {
+			// the commit an annotated tag points at.
+			tags[peeled] = ref[0]
+		} else if _, ok := tags[name]; !ok {
+			tags[name] = ref[0]
+		}
+	}
+	return tags, nil
+}
+
+// resolveRef returns the ref to check out for an entry of the repository:
+// its tag if any, or the newest tag matching its version constraint, or the
+// branch otherwise. The tag is returned too, empty if there is none. In update
+// mode, the version constraint always selects the tag. In strict mode, the tag
+// is verified to still point at the pinned hash, catching moved tags.
+func resolveRef(label, projectDir, repo, branch string, tag, ver *string, hash string, hashMode HashMode, urlOverrides *URLOverrides) (string, string, error) {
+	var tagName, constraint string
+	if tag != nil {
+		tagName = *tag
+	}
+	if ver != nil {
+		constraint = *ver
+	}
+	if tagName == "" && constraint == "" {
+		return branch, "", nil
+	}
+	repo = resolveRepo(projectDir, repo, urlOverrides)
+
+	var tags map[string]string
+	if constraint != "" {
+		c, err := parseVersionConstraint(constraint)
+		if err != nil {
+			return "", "", fmt.Errorf("%s: %w", label, err)
+		}
+		if tagName != "" && hashMode != hashModeUpdate {
+			if v, ok := tagVersion(tagName); !ok || !c.match(v) {
+				return "", "", fmt.Errorf("%s: tag %s does not match version %s, update the configuration", label, tagName, constraint)
+			}
+		} else {
+			if tags, err = gitTags(label, repo); err != nil {
+				return "", "", err
+			}
+			if tagName = newestTag(tags, c); tagName == "" {
+				return "", "", fmt.Errorf("%s: %s: no tag matches version %s", label, redactURL(repo), constraint)
+			}
+			log.Printf("%s: Version %s resolves to tag %s", label, constraint, tagName)
+		}
+	}
+
+	if hashMode == hashModeStrict && hash != "" {
+		if tags == nil {
+			var err error
+			if tags, err = gitTags(label, repo); err != nil {
+				return "", "", err
+			}
+		}
+		commit, ok := tags[tagName]
+		if !ok {
+			return "", "", fmt.Errorf("%s: %s: tag %s not found", label, redactURL(repo), tagName)
+		}
+		if !strings.HasPrefix(commit, hash) {
+			return "", "", fmt.Errorf("%s: %s: tag %s points at %s, not at the pinned hash %s", label, redactURL(repo), tagName, commit, hash)
+		}
+	}
+	return tagName, tagName, nil
+}
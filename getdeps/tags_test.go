@@ -0,0 +1,111 @@
+// Copyright (c) Facebook, Inc. and its affiliates.
+//
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestVersionConstraint(t *testing.T) {
+	for _, tc := range []struct {
+		constraint string
+		match      []string
+		noMatch    []string
+	}{
+		{"~5.10", []string{"5.10", "5.10.0", "v5.10.3"}, []string{"5.9.9", "5.11", "6.0"}},
+		{"~5", []string{"5.0", "5.10"}, []string{"4.20", "6.0"}},
+		{"^5.10", []string{"5.10", "5.19.2"}, []string{"5.9", "6.0"}},
+		{"^0.10", []string{"0.10.1"}, []string{"0.9", "0.11"}},
+		{"4.14", []string{"4.14", "4.14.2"}, []string{"4.13", "4.15"}},
+		{"5.10.x", []string{"5.10.8"}, []string{"5.11"}},
+		{">=4.14, <5", []string{"4.14", "4.20"}, []string{"4.13", "5.0"}},
+		{">4.14 <=4.16", []string{"4.14.1", "4.16"}, []string{"4.14", "4.16.1"}},
+	} {
+		c, err := parseVersionConstraint(tc.constraint)
+		require.NoError(t, err, tc.constraint)
+		for _, s := range tc.match {
+			v, ok := tagVersion(s)
+			require.True(t, ok, s)
+			assert.True(t, c.match(v), "%s %s", tc.constraint, s)
+		}
+		for _, s := range tc.noMatch {
+			v, ok := tagVersion(s)
+			require.True(t, ok, s)
+			assert.False(t, c.match(v), "%s %s", tc.constraint, s)
+		}
+	}
+	for _, s := range []string{"", "~", "5.x.1", "latest", ">=5.10-rc1"} {
+		_, err := parseVersionConstraint(s)
+		assert.Error(t, err, s)
+	}
+	_, ok := tagVersion("v5.11-rc1")
+	assert.False(t, ok)
+}
+
+func TestGitTags(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not found")
+	}
+	repo := newTestGitRepo(t, map[string]string{"README": "linux"})
+	commit := func(content string) string {
+		require.NoError(t, ioutil.WriteFile(filepath.Join(repo, "README"), []byte(content), 0644))
+		runTestGit(t, repo, "commit", "-q", "-a", "-m", content)
+		return runTestGit(t, repo, "rev-parse", "HEAD")
+	}
+	runTestGit(t, repo, "tag", "v5.9")
+	v510 := commit("5.10")
+	runTestGit(t, repo, "tag", "-a", "-m", "Linux 5.10", "v5.10")
+	v5103 := commit("5.10.3")
+	runTestGit(t, repo, "tag", "-a", "-m", "Linux 5.10.3", "v5.10.3")
+	commit("5.11-rc1")
+	runTestGit(t, repo, "tag", "v5.11-rc1")
+
+	get := func(g *Git, hashMode HashMode) error {
+		workDir, err := ioutil.TempDir("", "getdeps-work")
+		require.NoError(t, err)
+		defer os.RemoveAll(workDir)
+		return g.Get("", workDir, nil, hashMode, nil)
+	}
+
+	// the newest matching tag is selected, and recorded.
+	version := "~5.10"
+	g := &Git{Label: "linux", URL: "file://" + repo, Version: &version}
+	require.NoError(t, get(g, hashModeUpdate))
+	require.NotNil(t, g.Tag)
+	assert.Equal(t, "v5.10.3", *g.Tag)
+	assert.Equal(t, v5103, *g.Hash)
+	require.NoError(t, get(g, hashModeStrict))
+
+	// a tag without a version constraint.
+	tag := "v5.10"
+	g2 := &Git{Label: "linux", URL: "file://" + repo, Tag: &tag}
+	require.NoError(t, get(g2, hashModeUpdate))
+	assert.Equal(t, v510, *g2.Hash)
+
+	// moved tags are caught in strict mode only.
+	runTestGit(t, repo, "tag", "-f", "-a", "-m", "Linux 5.10.3", "v5.10.3", v510)
+	err := get(g, hashModeStrict)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "tag v5.10.3 points at "+v510)
+	require.NoError(t, get(g, hashModePermissive))
+	assert.Equal(t, v5103, *g.Hash)
+
+	// the recorded tag must match the version constraint.
+	version = "~5.9"
+	assert.Error(t, get(g, hashModePermissive))
+	require.NoError(t, get(g, hashModeUpdate))
+	assert.Equal(t, "v5.9", *g.Tag)
+
+	version = "^6"
+	assert.Error(t, get(g, hashModeUpdate))
+}
@@ -7,23 +7,50 @@ package main
 
 import (
 	"archive/tar"
+	"archive/zip"
+	"bufio"
 	"bytes"
+	"compress/bzip2"
 	"compress/gzip"
 	"errors"
+	"fmt"
+	"github.com/klauspost/compress/zstd"
 	"github.com/ulikunitz/xz"
 	"io"
+	"io/ioutil"
 	"log"
 	"os"
+	"path"
 	"path/filepath"
 	"strings"
 )
 
 // Untar represents a tarball
 type Untar struct {
-	Label  string `json:"label"`
-	URL    string `json:"url"`
-	Hash   string `json:"hash,omitempty"`
-	Subdir string `json:"subdir,omitempty"`
+	Label string `json:"label"`
+	URL   string `json:"url"`
+	// Alternative URLs serving the same content, see fetchAndVerify.
+	Mirrors []string `json:"mirrors,omitempty"`
+	Hash    string   `json:"hash,omitempty"`
+	Subdir  string   `json:"subdir,omitempty"`
+	// Number of leading path components removed from the entries, after
+	// Subdir. Entries with fewer components are not extracted.
+	StripComponents int `json:"strip_components,omitempty"`
+	// Glob patterns selecting the entries to extract, and those not to
+	// extract, see matchGlob. They are matched against the paths after
+	// Subdir and StripComponents are applied. If Include is empty, all the
+	// entries are extracted.
+	Include []string `json:"include,omitempty"`
+	Exclude []string `json:"exclude,omitempty"`
+	// Directory the archive is extracted to, relative to the working
+	// directory.
+	Dest string `json:"dest,omitempty"`
+	// Patches applied, in order, to the extracted files in Dest.
+	Patches []Patch `json:"patches,omitempty"`
+	// Optional detached signature, verified before extracting.
+	Signature *Signature `json:"signature,omitempty"`
+	// URL the tarball was actually fetched from. Set by Get.
+	FetchedFrom string `json:"fetched_from,omitempty"`
 }
 
 // CompressionType is the type that defines compression types.
@@ -34,67 +61,183 @@ const (
 	CompressionTypeUnsupported = iota
 	CompressionTypeGzip
 	CompressionTypeXz
+	CompressionTypeBzip2
+	CompressionTypeZstd
+	CompressionTypeLz4
+	// uncompressed tar archive.
+	CompressionTypeNone
 )
 
 var (
-	magicBytesGzip = []byte{0x1f, 0x8b}
-	magicBytesXz   = []byte{0xfd, 0x37, 0x7a, 0x58, 0x5a, 0x00}
+	magicBytesGzip      = []byte{0x1f, 0x8b}
+	magicBytesXz        = []byte{0xfd, 0x37, 0x7a, 0x58, 0x5a, 0x00}
+	magicBytesBzip2     = []byte("BZh")
+	magicBytesZstd      = []byte{0x28, 0xb5, 0x2f, 0xfd}
+	magicBytesLz4       = []byte{0x04, 0x22, 0x4d, 0x18}
+	magicBytesLz4Legacy = []byte{0x02, 0x21, 0x4c, 0x18}
+	// the ustar magic of tar headers, followed by the version ("00") for
+	// POSIX tar, or by a space for GNU tar.
+	magicBytesTar       = []byte("ustar")
+	magicBytesTarOffset = 257
+	magicBytesZip       = []byte("PK\x03\x04")
+	magicBytesZipEmpty  = []byte("PK\x05\x06")
 )
 
+// magicLen is the number of bytes needed by detectCompressionType.
+const magicLen = 512
+
 func detectCompressionType(data []byte) CompressionType {
 	switch {
-	case len(data) >= len(magicBytesGzip) && bytes.Equal(data[:len(magicBytesGzip)], magicBytesGzip):
+	case bytes.HasPrefix(data, magicBytesGzip):
 		return CompressionTypeGzip
-	case len(data) >= len(magicBytesXz) && bytes.Equal(data[:len(magicBytesXz)], magicBytesXz):
+	case bytes.HasPrefix(data, magicBytesXz):
 		return CompressionTypeXz
+	case bytes.HasPrefix(data, magicBytesBzip2):
+		return CompressionTypeBzip2
+	case bytes.HasPrefix(data, magicBytesZstd):
+		return CompressionTypeZstd
+	case bytes.HasPrefix(data, magicBytesLz4), bytes.HasPrefix(data, magicBytesLz4Legacy):
+		return CompressionTypeLz4
+	case len(data) > magicBytesTarOffset && bytes.HasPrefix(data[magicBytesTarOffset:], magicBytesTar):
+		return CompressionTypeNone
 	default:
 		return CompressionTypeUnsupported
 	}
 }
 
-// Get downloads a tar.gz file and uncompresses it
-func (pkg *Untar) Get(projectDir string, urlOverrides *URLOverrides, hashMode HashMode) error {
-	// ignore file info, will use permissions from the tar metadata
-	data, _, err := fetchAndVerify(pkg.Label, projectDir, pkg.URL, hashMode, &pkg.Hash, urlOverrides)
-	if err != nil {
-		return err
-	}
-
-	dir, _ := os.Getwd()
-	log.Printf("%s: Uncompressing into %s...", pkg.Label, dir)
+// isZip returns true if data is the beginning of a zip archive.
+func isZip(data []byte) bool {
+	return bytes.HasPrefix(data, magicBytesZip) || bytes.HasPrefix(data, magicBytesZipEmpty)
+}
 
-	// uncompress. We support gzip and xz.
-	reader := bytes.NewReader(data)
+// decompress returns a reader of the uncompressed content of r. The
+// compression type is detected from the content. The returned reader must be
+// closed.
+func decompress(r io.Reader) (io.ReadCloser, error) {
+	// uncompress. We support gzip, xz, bzip2, zstd and lz4, and uncompressed
+	// tar archives.
+	reader := bufio.NewReader(r)
 
-	var archive io.Reader
-	// gzip can be detected with http.DetectContentType, but xz is not
-	// supported. So we match the magic bytes in the xz header, as specified in
-	// the XZ file format Section 2.1.1.1, see
+	// gzip can be detected with http.DetectContentType, but the other formats
+	// are not supported. So we match the magic bytes in their headers, e.g. as
+	// specified in the XZ file format Section 2.1.1.1, see
 	// https://tukaani.org/xz/xz-file-format.txt .
 	//
 	// For gzip, the magic bytes are 1F 8B (starting at 0)
 	// for xz the magic bytes are FD 37 7A 58 5A 00 (starting at 0)
-	compressionType := detectCompressionType(data)
+	// Uncompressed tar archives are recognized by the magic of the header
+	// of their first entry, at offset 257.
+	// Peek may return less data than requested for short files, this is
+	// handled by detectCompressionType.
+	magic, _ := reader.Peek(magicLen)
+	compressionType := detectCompressionType(magic)
 	switch compressionType {
 	case CompressionTypeGzip:
-		archive, err = gzip.NewReader(reader)
-		// Close only required for gzip package
-		defer archive.(io.ReadCloser).Close()
+		return gzip.NewReader(reader)
 	case CompressionTypeXz:
-		archive, err = xz.NewReader(reader)
+		xzReader, err := xz.NewReader(reader)
+		if err != nil {
+			return nil, err
+		}
+		return ioutil.NopCloser(xzReader), nil
+	case CompressionTypeBzip2:
+		return ioutil.NopCloser(bzip2.NewReader(reader)), nil
+	case CompressionTypeZstd:
+		zstdReader, err := zstd.NewReader(reader)
+		if err != nil {
+			return nil, err
+		}
+		return zstdReader.IOReadCloser(), nil
+	case CompressionTypeLz4:
+		return ioutil.NopCloser(newLz4Reader(reader)), nil
+	case CompressionTypeNone:
+		return ioutil.NopCloser(reader), nil
 	case CompressionTypeUnsupported:
 		fallthrough
 	default:
-		return errors.New("unsupported compression type")
+		return nil, errors.New("unsupported compression type")
 	}
+}
+
+// Get downloads a tarball or zip archive and uncompresses it into workDir.
+func (pkg *Untar) Get(projectDir, workDir string, urlOverrides *URLOverrides, hashMode HashMode) error {
+	f, err := pkg.fetch(projectDir, urlOverrides, hashMode)
 	if err != nil {
 		return err
 	}
+	defer f.Close()
+	return pkg.extract(f, workDir)
+}
+
+// fetch downloads the tarball. The caller must close the returned file.
+func (pkg *Untar) fetch(projectDir string, urlOverrides *URLOverrides, hashMode HashMode) (*os.File, error) {
+	// ignore file info, will use permissions from the tar metadata
+	f, _, fetchedFrom, err := fetchAndVerify(pkg.Label, projectDir, append([]string{pkg.URL}, pkg.Mirrors...), hashMode, &pkg.Hash, urlOverrides)
+	if err != nil {
+		return nil, err
+	}
+	// entries cached before their origin was recorded keep the configured one.
+	if fetchedFrom != "" {
+		pkg.FetchedFrom = fetchedFrom
+	}
+	if err := verifySignature(pkg.Label, projectDir, pkg.Signature, f, urlOverrides); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return f, nil
+}
+
+// extract uncompresses the tarball read from f into workDir. Zip archives are
+// supported too.
+func (pkg *Untar) extract(f *os.File, workDir string) error {
+	for _, pattern := range append(append([]string{}, pkg.Include...), pkg.Exclude...) {
+		if _, err := matchGlob(pattern, ""); err != nil {
+			return fmt.Errorf("%s: invalid pattern %q: %w", pkg.Label, pattern, err)
+		}
+	}
+	if pkg.StripComponents < 0 {
+		return fmt.Errorf("%s: invalid strip_components %d", pkg.Label, pkg.StripComponents)
+	}
+	dest, err := cleanEntryName(pkg.Dest)
+	if err != nil {
+		return fmt.Errorf("%s: invalid dest: %w", pkg.Label, err)
+	}
+	dest = filepath.Join(workDir, dest)
+	log.Printf("%s: Uncompressing into %s...", pkg.Label, dest)
+	if err := os.MkdirAll(dest, os.ModePerm); err != nil {
+		return err
+	}
+
+	x, err := newExtractor(pkg.Label, dest)
+	if err != nil {
+		return err
+	}
+	magic := make([]byte, magicLen)
+	n, err := f.ReadAt(magic, 0)
+	if err != nil && err != io.EOF {
+		return err
+	}
+	if isZip(magic[:n]) {
+		err = pkg.extractZip(f, x)
+	} else {
+		err = pkg.extractTar(f, x)
+	}
+	if err != nil {
+		return fmt.Errorf("%s: %w", pkg.Label, err)
+	}
+	return x.finish()
+}
+
+// extractTar extracts the tarball read from f.
+func (pkg *Untar) extractTar(f io.Reader, x *extractor) error {
+	archive, err := decompress(f)
+	if err != nil {
+		return err
+	}
+	defer archive.Close()
 
 	// untar
 	tarReader := tar.NewReader(archive)
-	subdirParts := strings.Split(pkg.Subdir, "/")
-entry:
 	for {
 		header, err := tarReader.Next()
 		if err == io.EOF {
@@ -102,46 +245,173 @@ entry:
 		} else if err != nil {
 			return err
 		}
-
-		var name string
-		if len(pkg.Subdir) > 0 {
-			nameParts := strings.Split(header.Name, "/")
-			if len(nameParts) <= len(subdirParts) {
-				continue entry
-			}
-			for i, p := range subdirParts {
-				if nameParts[i] != p {
-					continue entry
-				}
-			}
-			name = filepath.Join(nameParts[len(subdirParts):]...)
-			if len(name) == 0 {
-				continue entry
-			}
-		} else {
-			name = header.Name
+		if header.Typeflag == tar.TypeXGlobalHeader {
+			// e.g. the commit ID added by git archive.
+			continue
 		}
+		e := archiveEntry{
+			name:  header.Name,
+			mode:  header.FileInfo().Mode(),
+			mtime: header.ModTime,
+			r:     tarReader,
+		}
+		switch header.Typeflag {
+		case tar.TypeLink:
+			e.linkname, e.hardlink = header.Linkname, true
+		case tar.TypeSymlink:
+			e.linkname = header.Linkname
+		}
+		if err := pkg.writeEntry(x, e); err != nil {
+			return err
+		}
+	}
+	return nil
+}
 
-		info := header.FileInfo()
-
-		if info.IsDir() {
-			if err = os.MkdirAll(name, info.Mode()); err != nil {
+// extractZip extracts the zip archive read from f.
+func (pkg *Untar) extractZip(f *os.File, x *extractor) error {
+	fileInfo, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	zipReader, err := zip.NewReader(f, fileInfo.Size())
+	if err != nil {
+		return err
+	}
+	for _, zf := range zipReader.File {
+		r, err := zf.Open()
+		if err != nil {
+			return err
+		}
+		e := archiveEntry{
+			name:  zf.Name,
+			mode:  zf.Mode(),
+			mtime: zf.Modified,
+			r:     r,
+		}
+		if e.mode&os.ModeSymlink != 0 {
+			// the target of a symbolic link is its content.
+			target, err := ioutil.ReadAll(io.LimitReader(r, 4096))
+			if err != nil {
+				r.Close()
 				return err
 			}
-			continue
+			e.linkname = string(target)
 		}
-
-		file, err := os.OpenFile(name, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, info.Mode())
+		err = pkg.writeEntry(x, e)
+		r.Close()
 		if err != nil {
 			return err
 		}
-		if _, err = io.Copy(file, tarReader); err != nil {
+	}
+	return nil
+}
+
+// writeEntry extracts an archive entry, if it is selected, see entryName.
+func (pkg *Untar) writeEntry(x *extractor, e archiveEntry) error {
+	var (
+		ok  bool
+		err error
+	)
+	if e.name, ok, err = pkg.entryName(e.name); err != nil || !ok {
+		return err
+	}
+	if e.hardlink {
+		target := e.linkname
+		if e.linkname, ok, err = pkg.entryName(target); err != nil {
 			return err
+		} else if !ok {
+			log.Printf("%s: Skipping hard link %s, its target %s is not extracted", pkg.Label, e.name, target)
+			return nil
 		}
-		if err = file.Close(); err != nil {
-			return err
+	}
+	return x.write(e)
+}
+
+// entryName returns the cleaned path an archive entry is extracted to,
+// relative to the destination directory, and false if the entry is not
+// selected by Subdir, StripComponents, Include and Exclude. Entries which would
+// be written outside of the destination directory are rejected.
+func (pkg *Untar) entryName(name string) (string, bool, error) {
+	name, err := cleanEntryName(name)
+	if err != nil {
+		return "", false, err
+	}
+	parts := strings.Split(name, "/")
+	if len(pkg.Subdir) > 0 {
+		subdirParts := strings.Split(path.Clean(pkg.Subdir), "/")
+		if len(parts) <= len(subdirParts) {
+			return "", false, nil
+		}
+		for i, p := range subdirParts {
+			if parts[i] != p {
+				return "", false, nil
+			}
+		}
+		parts = parts[len(subdirParts):]
+	}
+	if pkg.StripComponents > 0 {
+		if len(parts) <= pkg.StripComponents {
+			return "", false, nil
 		}
+		parts = parts[pkg.StripComponents:]
 	}
+	name = path.Join(parts...)
 
-	return err
+	if len(pkg.Include) > 0 && !matchAny(pkg.Include, name) {
+		return "", false, nil
+	}
+	if matchAny(pkg.Exclude, name) {
+		return "", false, nil
+	}
+	return name, true, nil
+}
+
+// matchAny returns true if the name matches any of the patterns, which must
+// be valid.
+func matchAny(patterns []string, name string) bool {
+	for _, pattern := range patterns {
+		if ok, _ := matchGlob(pattern, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// matchGlob reports whether the slash-separated name, or one of its parent
+// directories, matches the pattern. Patterns have the syntax of path.Match,
+// where "*" does not match "/", and "**" as a path component matches any
+// number of path components. For example "drivers/gpu", "drivers/*/Kconfig"
+// and "**/*.h" all match "drivers/gpu/Kconfig".
+func matchGlob(pattern, name string) (bool, error) {
+	patternParts := strings.Split(path.Clean(pattern), "/")
+	for _, p := range patternParts {
+		// path.Match may not report malformed patterns that do not match.
+		if _, err := path.Match(p, ""); err != nil {
+			return false, err
+		}
+	}
+	return matchParts(patternParts, strings.Split(name, "/")), nil
+}
+
+func matchParts(patternParts, nameParts []string) bool {
+	for len(patternParts) > 0 {
+		if patternParts[0] == "**" {
+			for i := 0; i <= len(nameParts); i++ {
+				if matchParts(patternParts[1:], nameParts[i:]) {
+					return true
+				}
+			}
+			return false
+		}
+		if len(nameParts) == 0 {
+			return false
+		}
+		if ok, _ := path.Match(patternParts[0], nameParts[0]); !ok {
+			return false
+		}
+		patternParts, nameParts = patternParts[1:], nameParts[1:]
+	}
+	// the pattern matches the name or one of its parent directories.
+	return true
 }
@@ -0,0 +1,329 @@
+// Copyright (c) Facebook, Inc. and its affiliates.
+//
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime/debug"
+	"testing"
+	"time"
+
+	"github.com/pierrec/lz4/v4"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/mod/semver"
+)
+
+// The archives in testdata/archives contain the same tree:
+//
+//	hello/README       "hello\n"
+//	hello/sub/words.txt  ~80 KiB of text, spanning multiple lz4 blocks.
+const wordsHash = "05d7af8b0c3a9912150ffcfdf77e36364c554a46d8c1f5035113ff59a87e0433"
+
+func TestUntarFormats(t *testing.T) {
+	dir, err := ioutil.TempDir("", "getdeps-untar")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	// uncompressed tar, from the gzipped one.
+	data, err := ioutil.ReadFile("testdata/archives/hello.tar.gz")
+	require.NoError(t, err)
+	gr, err := gzip.NewReader(bytes.NewReader(data))
+	require.NoError(t, err)
+	data, err = ioutil.ReadAll(gr)
+	require.NoError(t, err)
+	plainTar := filepath.Join(dir, "hello.tar")
+	require.NoError(t, ioutil.WriteFile(plainTar, data, 0644))
+
+	for _, name := range []string{
+		"testdata/archives/hello.tar.gz",
+		"testdata/archives/hello.tar.xz",
+		"testdata/archives/hello.tar.bz2",
+		"testdata/archives/hello.tar.zst",
+		"testdata/archives/hello.tar.lz4",
+		"testdata/archives/hello-legacy.tar.lz4",
+		"testdata/archives/hello.zip",
+		plainTar,
+	} {
+		workDir := filepath.Join(dir, "work-"+filepath.Base(name))
+		require.NoError(t, os.Mkdir(workDir, 0755))
+		f, err := os.Open(name)
+		require.NoError(t, err)
+		pkg := Untar{Label: filepath.Base(name)}
+		err = pkg.extract(f, workDir)
+		f.Close()
+		require.NoError(t, err, name)
+
+		readme, err := ioutil.ReadFile(filepath.Join(workDir, "hello/README"))
+		require.NoError(t, err, name)
+		assert.Equal(t, "hello\n", string(readme), name)
+		words, err := ioutil.ReadFile(filepath.Join(workDir, "hello/sub/words.txt"))
+		require.NoError(t, err, name)
+		assert.Equal(t, wordsHash, fmt.Sprintf("%x", sha256.Sum256(words)), name)
+	}
+
+	// Subdir applies to zip archives too.
+	workDir := filepath.Join(dir, "work-subdir")
+	require.NoError(t, os.Mkdir(workDir, 0755))
+	f, err := os.Open("testdata/archives/hello.zip")
+	require.NoError(t, err)
+	defer f.Close()
+	pkg := Untar{Label: "zip", Subdir: "hello/sub"}
+	require.NoError(t, pkg.extract(f, workDir))
+	assert.FileExists(t, filepath.Join(workDir, "words.txt"))
+	assert.NoFileExists(t, filepath.Join(workDir, "README"))
+}
+
+func TestLz4Version(t *testing.T) {
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		t.Skip("no build information")
+	}
+	for _, dep := range info.Deps {
+		if dep.Path == "github.com/pierrec/lz4/v4" {
+			assert.True(t, semver.Compare(dep.Version, "v4.1.22") >= 0, "github.com/pierrec/lz4/v4 %s rejects valid block checksums, v4.1.22 or later is required", dep.Version)
+		}
+	}
+}
+
+func TestLz4Corrupt(t *testing.T) {
+	data, err := ioutil.ReadFile("testdata/archives/hello.tar.lz4")
+	require.NoError(t, err)
+	for _, corrupt := range [][]byte{
+		data[:len(data)/2],
+		// invalid frame version.
+		append(append([]byte{}, data[:4]...), append([]byte{0x00}, data[5:]...)...),
+		// block larger than the maximum block size, after the magic number,
+		// the frame descriptor, the content size and the header checksum.
+		append(append([]byte{}, data[:15]...), 0xff, 0xff, 0xff, 0x7f),
+	} {
+		_, err := ioutil.ReadAll(newLz4Reader(bytes.NewReader(corrupt)))
+		assert.Error(t, err)
+	}
+	_, err = ioutil.ReadAll(newLz4Reader(bytes.NewReader(nil)))
+	assert.Error(t, err)
+
+	// the checksums of the blocks and of the content are verified.
+	corrupt := func(i int) []byte {
+		c := append([]byte{}, data...)
+		c[i] ^= 0xff
+		return c
+	}
+	// the checksum of the first block follows its size, after the frame
+	// header, and its data.
+	blockSize := int(binary.LittleEndian.Uint32(data[15:19]) &^ (1 << 31))
+	_, err = ioutil.ReadAll(newLz4Reader(bytes.NewReader(corrupt(19 + blockSize))))
+	assert.ErrorIs(t, err, lz4.ErrInvalidBlockChecksum)
+	_, err = ioutil.ReadAll(newLz4Reader(bytes.NewReader(corrupt(len(data) - 1))))
+	assert.ErrorIs(t, err, lz4.ErrInvalidFrameChecksum)
+}
+
+func TestLz4Frames(t *testing.T) {
+	data, err := ioutil.ReadFile("testdata/archives/hello.tar.lz4")
+	require.NoError(t, err)
+	single, err := ioutil.ReadAll(newLz4Reader(bytes.NewReader(data)))
+	require.NoError(t, err)
+	// concatenated frames, with a skippable frame in between.
+	skippable := []byte{0x50, 0x2a, 0x4d, 0x18, 0x02, 0x00, 0x00, 0x00, 0xaa, 0xbb}
+	concatenated := append(append(append([]byte{}, data...), skippable...), data...)
+	got, err := ioutil.ReadAll(newLz4Reader(bytes.NewReader(concatenated)))
+	require.NoError(t, err)
+	assert.Equal(t, append(append([]byte{}, single...), single...), got)
+}
+
+// writeTestTar writes a gzipped tarball with the specified entries. The
+// content of regular files is their name.
+func writeTestTar(t *testing.T, name string, headers []*tar.Header) {
+	var buf bytes.Buffer
+	gw := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gw)
+	for _, h := range headers {
+		if h.Typeflag == tar.TypeReg {
+			h.Size = int64(len(h.Name))
+		}
+		require.NoError(t, tw.WriteHeader(h))
+		if h.Typeflag == tar.TypeReg {
+			_, err := tw.Write([]byte(h.Name))
+			require.NoError(t, err)
+		}
+	}
+	require.NoError(t, tw.Close())
+	require.NoError(t, gw.Close())
+	require.NoError(t, ioutil.WriteFile(name, buf.Bytes(), 0644))
+}
+
+func TestUntarEntryTypes(t *testing.T) {
+	dir, err := ioutil.TempDir("", "getdeps-untar")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	defer func() { clampMtime = time.Time{} }()
+
+	old := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	recent := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	tarball := filepath.Join(dir, "linux.tar.gz")
+	writeTestTar(t, tarball, []*tar.Header{
+		{Typeflag: tar.TypeXGlobalHeader, Name: "pax_global_header", PAXRecords: map[string]string{"comment": "abc"}},
+		{Typeflag: tar.TypeDir, Name: "linux/", Mode: 0555, ModTime: old},
+		{Typeflag: tar.TypeReg, Name: "linux/Makefile", Mode: 0644, ModTime: old},
+		{Typeflag: tar.TypeReg, Name: "linux/scripts/run.sh", Mode: 0755, ModTime: recent},
+		{Typeflag: tar.TypeSymlink, Name: "linux/run", Linkname: "scripts/run.sh", ModTime: old},
+		{Typeflag: tar.TypeLink, Name: "linux/Kbuild", Linkname: "linux/Makefile", ModTime: old},
+		{Typeflag: tar.TypeSymlink, Name: "linux/replaced", Linkname: "Makefile", ModTime: old},
+		// replaces the symlink instead of writing through it.
+		{Typeflag: tar.TypeReg, Name: "linux/replaced", Mode: 0644, ModTime: old},
+		{Typeflag: tar.TypeFifo, Name: "linux/fifo", Mode: 0644, ModTime: old},
+	})
+
+	clampMtime = time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)
+	f, err := os.Open(tarball)
+	require.NoError(t, err)
+	defer f.Close()
+	workDir := filepath.Join(dir, "work")
+	require.NoError(t, os.Mkdir(workDir, 0755))
+	pkg := Untar{Label: "linux"}
+	require.NoError(t, pkg.extract(f, workDir))
+
+	assert.NoFileExists(t, filepath.Join(workDir, "pax_global_header"))
+	assert.NoFileExists(t, filepath.Join(workDir, "linux/fifo"))
+	target, err := os.Readlink(filepath.Join(workDir, "linux/run"))
+	require.NoError(t, err)
+	assert.Equal(t, "scripts/run.sh", target)
+	data, err := ioutil.ReadFile(filepath.Join(workDir, "linux/run"))
+	require.NoError(t, err)
+	assert.Equal(t, "linux/scripts/run.sh", string(data))
+
+	makefile, err := os.Stat(filepath.Join(workDir, "linux/Makefile"))
+	require.NoError(t, err)
+	kbuild, err := os.Stat(filepath.Join(workDir, "linux/Kbuild"))
+	require.NoError(t, err)
+	assert.True(t, os.SameFile(makefile, kbuild))
+	assert.True(t, makefile.ModTime().Equal(old))
+
+	replaced, err := os.Lstat(filepath.Join(workDir, "linux/replaced"))
+	require.NoError(t, err)
+	assert.True(t, replaced.Mode().IsRegular())
+	data, err = ioutil.ReadFile(filepath.Join(workDir, "linux/Makefile"))
+	require.NoError(t, err)
+	assert.Equal(t, "linux/Makefile", string(data))
+
+	script, err := os.Stat(filepath.Join(workDir, "linux/scripts/run.sh"))
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0755), script.Mode().Perm())
+	assert.True(t, script.ModTime().Equal(clampMtime), script.ModTime())
+
+	linuxDir, err := os.Stat(filepath.Join(workDir, "linux"))
+	require.NoError(t, err)
+	assert.True(t, linuxDir.ModTime().Equal(old), linuxDir.ModTime())
+	// directories stay writable by the owner.
+	assert.Equal(t, os.FileMode(0755), linuxDir.Mode().Perm())
+}
+
+func TestUntarMalicious(t *testing.T) {
+	files, err := filepath.Glob("testdata/malicious/*")
+	require.NoError(t, err)
+	require.NotEmpty(t, files)
+	for _, name := range files {
+		dir, err := ioutil.TempDir("", "getdeps-untar")
+		require.NoError(t, err)
+		defer os.RemoveAll(dir)
+		workDir := filepath.Join(dir, "work")
+		require.NoError(t, os.Mkdir(workDir, 0755))
+		outside := filepath.Join(dir, "outside")
+		require.NoError(t, os.Mkdir(outside, 0755))
+		// e.g. created by a Git entry extracted to the same directory.
+		require.NoError(t, os.Symlink(outside, filepath.Join(workDir, "link")))
+
+		f, err := os.Open(name)
+		require.NoError(t, err)
+		pkg := Untar{Label: filepath.Base(name)}
+		err = pkg.extract(f, workDir)
+		f.Close()
+		assert.True(t, errors.Is(err, errUnsafePath), "%s: %v", name, err)
+
+		entries, err := ioutil.ReadDir(dir)
+		require.NoError(t, err)
+		assert.Len(t, entries, 2, name)
+		entries, err = ioutil.ReadDir(outside)
+		require.NoError(t, err)
+		assert.Empty(t, entries, name)
+	}
+	assert.NoFileExists(t, "/tmp/getdeps-evil")
+}
+
+func TestMatchGlob(t *testing.T) {
+	for _, tc := range []struct {
+		pattern, name string
+		match         bool
+	}{
+		{"drivers/gpu", "drivers/gpu/Kconfig", true},
+		{"drivers/gpu", "drivers/gpu", true},
+		{"drivers/gpu", "drivers/gpio/Kconfig", false},
+		{"drivers/*/Kconfig", "drivers/gpu/Kconfig", true},
+		{"drivers/*", "drivers/gpu/drm/Kconfig", true},
+		{"*.h", "include/linux/types.h", false},
+		{"**/*.h", "include/linux/types.h", true},
+		{"**/*.h", "types.h", true},
+		{"include/**/types.h", "include/types.h", true},
+		{"include/**/types.h", "include/uapi/linux/types.h", true},
+		{"include/**/types.h", "arch/include/types.h", false},
+		{"**", "anything/at/all", true},
+	} {
+		ok, err := matchGlob(tc.pattern, tc.name)
+		require.NoError(t, err)
+		assert.Equal(t, tc.match, ok, "%s %s", tc.pattern, tc.name)
+	}
+	_, err := matchGlob("drivers/[", "drivers/gpu")
+	assert.Error(t, err)
+}
+
+func TestUntarFilters(t *testing.T) {
+	dir, err := ioutil.TempDir("", "getdeps-untar")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	f, err := os.Open("testdata/archives/hello.tar.gz")
+	require.NoError(t, err)
+	defer f.Close()
+
+	// several archives are extracted side by side.
+	for _, pkg := range []Untar{
+		{Label: "strip", Dest: "a", StripComponents: 1, Exclude: []string{"sub"}},
+		{Label: "include", Dest: "b/c", Include: []string{"*/sub/*.txt"}},
+		{Label: "subdir", Dest: "d", Subdir: "hello", Include: []string{"**/words.txt"}, Exclude: []string{"README"}},
+	} {
+		_, err := f.Seek(0, io.SeekStart)
+		require.NoError(t, err)
+		require.NoError(t, pkg.extract(f, dir), pkg.Label)
+	}
+	var files []string
+	require.NoError(t, filepath.Walk(dir, func(p string, info os.FileInfo, err error) error {
+		if err == nil && !info.IsDir() {
+			rel, _ := filepath.Rel(dir, p)
+			files = append(files, filepath.ToSlash(rel))
+		}
+		return err
+	}))
+	assert.Equal(t, []string{"a/README", "b/c/hello/sub/words.txt", "d/sub/words.txt"}, files)
+
+	for _, pkg := range []Untar{
+		{Label: "bad pattern", Include: []string{"["}},
+		{Label: "bad strip", StripComponents: -1},
+		{Label: "bad dest", Dest: "../outside"},
+	} {
+		_, err := f.Seek(0, io.SeekStart)
+		require.NoError(t, err)
+		assert.Error(t, pkg.extract(f, dir), pkg.Label)
+	}
+}
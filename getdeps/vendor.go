@@ -0,0 +1,569 @@
+// Copyright (c) Facebook, Inc. and its affiliates.
+//
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"golang.org/x/mod/module"
+)
+
+// Names of the files generated at the root of a bundle.
+const (
+	bundleConfigFile       = "config.json"
+	bundleURLOverridesFile = "url-overrides.json"
+)
+
+// bundleModuleProxy is the module proxy of the bundle, shared by all the goget
+// entries in module mode.
+const bundleModuleProxy = "goproxy"
+
+// vendorer exports the sources of a configuration into a bundle directory.
+// Git repositories are stored as bare mirrors, tarballs, files, signatures,
+// keyrings and allowed signers files as they are. Paths in the bundle are relative to its root.
+type vendorer struct {
+	dir          string
+	projectDir   string
+	urlOverrides *URLOverrides
+	hashMode     HashMode
+
+	mu sync.Mutex
+	// overrides pointing the original URLs at the bundle.
+	overrides URLOverrides
+	// path in the bundle of every keyring copied so far, by source path.
+	keyrings map[string]string
+}
+
+// vendorBundle fetches the sources of the specified components of config and
+// writes them to a bundle at output, along with a configuration and a URL
+// overrides file pointing at it. The bundle is a directory, or a gzipped
+// tarball if output ends in .tar.gz or .tgz. The hashes in the generated
+// configuration are updated according to the hash mode, config itself is not
+// modified.
+//
+// The bundle is self-contained: it can be moved, and passing its
+// configuration to getdeps fetches the same sources without network access.
+func vendorBundle(output string, config *Config, components []string, projectDir string, urlOverrides *URLOverrides, hashMode HashMode) (err error) {
+	if _, err := os.Stat(output); err == nil {
+		return fmt.Errorf("'%s' already exists", output)
+	}
+	archive := strings.HasSuffix(output, ".tar.gz") || strings.HasSuffix(output, ".tgz")
+	dir := output
+	if archive {
+		tmpDir, err := ioutil.TempDir("", "getdeps-vendor")
+		if err != nil {
+			return err
+		}
+		defer os.RemoveAll(tmpDir)
+		dir = tmpDir
+	} else {
+		if err := os.Mkdir(dir, os.ModePerm); err != nil {
+			return err
+		}
+		// do not leave an incomplete bundle behind.
+		defer func() {
+			if err != nil {
+				os.RemoveAll(dir)
+			}
+		}()
+	}
+
+	// the generated configuration differs from config, e.g. in keyring paths,
+	// so work on a copy.
+	data, err := json.Marshal(config)
+	if err != nil {
+		return err
+	}
+	if config, err = NewConfig(data); err != nil {
+		return err
+	}
+
+	v := &vendorer{
+		dir:          dir,
+		projectDir:   projectDir,
+		urlOverrides: urlOverrides,
+		hashMode:     hashMode,
+		overrides:    URLOverrides{},
+		keyrings:     map[string]string{},
+	}
+	bundleConfig := Config{BuildID: config.BuildID}
+	var errs errorList
+	for _, componentName := range components {
+		var node *Node
+		switch componentName {
+		case "coreboot":
+			node, bundleConfig.Coreboot = config.Coreboot, config.Coreboot
+		case "kernel":
+			node, bundleConfig.Kernel = config.Kernel, config.Kernel
+		case "initramfs":
+			node, bundleConfig.Initramfs = config.Initramfs, config.Initramfs
+		}
+		if err := node.vendor(v, componentName); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", componentName, err))
+		}
+	}
+	if err := errs.errorOrNil(); err != nil {
+		return err
+	}
+
+	for name, obj := range map[string]interface{}{
+		bundleConfigFile:       bundleConfig,
+		bundleURLOverridesFile: v.overrides,
+	} {
+		data, err := json.MarshalIndent(obj, "", "  ")
+		if err != nil {
+			return fmt.Errorf("failed to marshal %s: %w", name, err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(dir, name), data, 0644); err != nil {
+			return err
+		}
+	}
+
+	if archive {
+		return writeTarball(output, dir)
+	}
+	return nil
+}
+
+// vendor exports the sources of the node into the bundle, under a directory
+// named after the component.
+func (n *Node) vendor(v *vendorer, component string) error {
+	if n == nil {
+		return nil
+	}
+	// Every entry is stored in its own location, so there are no dependencies
+	// between the tasks.
+	var tg taskGroup
+	for i := range n.Git {
+		g := &n.Git[i]
+		skip := n.nestedGitDests(i)
+		tg.add(fmt.Sprintf("%s entry %d", "git", i), "", false, func(func() error) error {
+			jobs.acquire()
+			defer jobs.release()
+			return g.vendor(v, path.Join(component, "git", g.Label+".git"), skip)
+		})
+	}
+	for i := range n.Hg {
+		h := &n.Hg[i]
+		tg.add(fmt.Sprintf("%s entry %d", "hg", i), "", false, func(func() error) error {
+			jobs.acquire()
+			defer jobs.release()
+			return h.vendor(v, path.Join(component, "hg", h.Label+".hg"))
+		})
+	}
+	for i := range n.Goget {
+		gg := &n.Goget[i]
+		tg.add(fmt.Sprintf("%s entry %d", "goget", i), "", false, func(func() error) error {
+			jobs.acquire()
+			defer jobs.release()
+			return gg.vendor(v, path.Join(component, "goget", gg.Label+".git"))
+		})
+	}
+	for i := range n.Untar {
+		u := &n.Untar[i]
+		tg.add(fmt.Sprintf("%s entry %d", "untar", i), "", false, func(func() error) error {
+			jobs.acquire()
+			defer jobs.release()
+			f, err := u.fetch(v.projectDir, v.urlOverrides, v.hashMode)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			dir := path.Join(component, "untar", u.Label)
+			if err := v.addFile(f, path.Join(dir, urlBaseName(u.URL)), append([]string{u.URL}, u.Mirrors...)); err != nil {
+				return err
+			}
+			if err := v.addPatches(u.Label, u.Patches, path.Join(dir, "patches")); err != nil {
+				return err
+			}
+			return v.addSignature(u.Label, u.Signature, dir)
+		})
+	}
+	if n.Files != nil {
+		for i := range n.Files.Filelist {
+			i := i
+			tg.add(fmt.Sprintf("%s entry %d", "files", i), "", false, func(func() error) error {
+				jobs.acquire()
+				defer jobs.release()
+				f, _, err := n.Files.fetch(i, v.projectDir, v.urlOverrides, v.hashMode)
+				if err != nil {
+					return err
+				}
+				defer f.Close()
+				file := &n.Files.Filelist[i]
+				dir := path.Join(component, "files", n.Files.Label)
+				if err := v.addFile(f, path.Join(dir, file.name()), append([]string{file.URL}, file.Mirrors...)); err != nil {
+					return err
+				}
+				return v.addSignature(n.Files.Label, file.Signature, dir)
+			})
+		}
+	}
+	return tg.run()
+}
+
+// vendor mirrors the repository into the bundle at rel, and its selected
+// submodules next to it, except those listed in skip.
+func (g *Git) vendor(v *vendorer, rel string, skip []string) error {
+	branch := defaultBranch
+	if g.Branch != nil && *g.Branch != "" {
+		branch = *g.Branch
+	} else {
+		g.Branch = &branch
+	}
+	hash := ""
+	if g.Hash != nil {
+		hash = *g.Hash
+	}
+	ref, tag, err := resolveRef(g.Label, v.projectDir, g.URL, branch, g.Tag, g.Version, hash, v.hashMode, v.urlOverrides)
+	if err != nil {
+		return err
+	}
+	if tag != "" {
+		g.Tag = &tag
+	}
+	currentHash, err := gitMirror(g.Label, v.projectDir, g.URL, filepath.Join(v.dir, rel), ref, v.hashMode, hash, v.urlOverrides, tag, g.VerifySignatures)
+	if err != nil {
+		return err
+	}
+	g.Hash = &currentHash
+	v.addRepo(g.URL, rel)
+	if err := v.addPolicy(g.Label, g.VerifySignatures); err != nil {
+		return err
+	}
+
+	// the changes to cherry-pick are in the mirror, record their commits.
+	repo := resolveRepo(v.projectDir, g.URL, v.urlOverrides)
+	for i := range g.CherryPicks {
+		cp := &g.CherryPicks[i]
+		ref := cp.Ref
+		if cp.Hash != nil && *cp.Hash != "" && v.hashMode != hashModeUpdate {
+			ref = *cp.Hash
+		}
+		commit, err := mirrorCommit(g.Label, filepath.Join(v.dir, rel), repo, ref)
+		if err != nil {
+			return fmt.Errorf("%s: cherry-pick of %s: %w", g.Label, cp.Ref, err)
+		}
+		cp.Hash = &commit
+	}
+	if err := v.addPatches(g.Label, g.Patches, path.Join(strings.TrimSuffix(rel, ".git"), "patches")); err != nil {
+		return err
+	}
+
+	g.SubmoduleHashes = nil
+	subs, err := g.selectedSubmodules(filepath.Join(v.dir, rel), currentHash, skip)
+	if err != nil || len(subs) == 0 {
+		return err
+	}
+	g.SubmoduleHashes = map[string]string{}
+	for _, s := range subs {
+		subURL := submoduleURL(g.URL, s.url)
+		subRel := path.Join(strings.TrimSuffix(rel, ".git"), "submodules", s.path+".git")
+		repo := resolveRepo(v.projectDir, subURL, v.urlOverrides)
+		if offline && localRepoPath(repo) == "" {
+			return fmt.Errorf("%s: cannot mirror submodule %s from %s: %w", g.Label, s.path, redactURL(repo), errOffline)
+		}
+		log.Printf("%s: Mirroring submodule %s from %s...", g.Label, s.path, redactURL(repo))
+		if err := runCommand(g.Label, "git", "clone", "-q", "--mirror", repo, filepath.Join(v.dir, subRel)); err != nil {
+			return fmt.Errorf("%s: %w", g.Label, err)
+		}
+		if stripped := stripUserinfo(repo); stripped != repo {
+			if err := runCommand(g.Label, "git", "-C", filepath.Join(v.dir, subRel), "remote", "set-url", "origin", stripped); err != nil {
+				return fmt.Errorf("%s: %w", g.Label, err)
+			}
+		}
+		if err := exec.Command("git", "-C", filepath.Join(v.dir, subRel), "cat-file", "-e", s.hash+"^{commit}").Run(); err != nil {
+			return fmt.Errorf("%s: submodule %s: %s not found in %s", g.Label, s.path, s.hash, redactURL(repo))
+		}
+		g.SubmoduleHashes[s.path] = s.hash
+		v.addRepo(subURL, subRel)
+	}
+	return nil
+}
+
+// vendor mirrors the repository of the package into the bundle at rel. In
+// module mode, the module and its dependencies are added to the module proxy
+// of the bundle instead.
+func (pkg *Gopkg) vendor(v *vendorer, rel string) error {
+	if pkg.Module {
+		return pkg.vendorModule(v)
+	}
+	branch := defaultBranch
+	if pkg.Branch != nil && *pkg.Branch != "" {
+		branch = *pkg.Branch
+	} else {
+		pkg.Branch = &branch
+	}
+	hash := ""
+	if pkg.Hash != nil {
+		hash = *pkg.Hash
+	}
+	repo, err := pkg.repo()
+	if err != nil {
+		return err
+	}
+	pkg.Repo = repo
+	ref, tag, err := resolveRef(pkg.Label, v.projectDir, repo, branch, pkg.Tag, pkg.Version, hash, v.hashMode, v.urlOverrides)
+	if err != nil {
+		return err
+	}
+	if tag != "" {
+		pkg.Tag = &tag
+	}
+	currentHash, err := gitMirror(pkg.Label, v.projectDir, repo, filepath.Join(v.dir, rel), ref, v.hashMode, hash, v.urlOverrides, tag, pkg.VerifySignatures)
+	if err != nil {
+		return err
+	}
+	pkg.Hash = &currentHash
+	v.addRepo(repo, rel)
+	return v.addPolicy(pkg.Label, pkg.VerifySignatures)
+}
+
+// vendorModule adds the module of the package and its dependencies to the
+// module proxy of the bundle, and points the module proxies of the package at
+// it.
+func (pkg *Gopkg) vendorModule(v *vendorer) error {
+	proxies, err := parseGoproxy(pkg.proxy(), nil)
+	if err != nil {
+		return fmt.Errorf("%s: %w", pkg.Label, err)
+	}
+	// the configuration of the bundle must not depend on --goproxy.
+	pkg.Proxy = pkg.proxy()
+	mod, _, err := pkg.fetchModule(v.projectDir, filepath.Join(v.dir, bundleModuleProxy), v.urlOverrides, v.hashMode)
+	if err != nil {
+		return err
+	}
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	// list the version, for version constraints to be resolved offline.
+	escPath, err := module.EscapePath(mod.Path)
+	if err != nil {
+		return err
+	}
+	list := filepath.Join(v.dir, bundleModuleProxy, escPath, "@v", "list")
+	data, err := ioutil.ReadFile(list)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if !strings.Contains("\n"+string(data), "\n"+mod.Version+"\n") {
+		data = append(data, mod.Version+"\n"...)
+		if err := ioutil.WriteFile(list, data, 0o644); err != nil {
+			return err
+		}
+	}
+	for _, p := range proxies {
+		v.overrides[p.orig] = "file:///" + bundleModuleProxy
+	}
+	return nil
+}
+
+// addRepo overrides the repository URL with the mirror at rel. Relative
+// repository paths are relative to the base directory, i.e. the root of the
+// bundle when using its configuration.
+func (v *vendorer) addRepo(repo, rel string) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	v.overrides[repo] = rel
+}
+
+// addFile copies the content of src into the bundle at rel, and overrides
+// the URLs with a file URL pointing at it.
+func (v *vendorer) addFile(src io.Reader, rel string, urls []string) error {
+	if err := writeFile(filepath.Join(v.dir, rel), src, nil); err != nil {
+		return err
+	}
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	for _, u := range urls {
+		v.overrides[u] = "file:///" + rel
+	}
+	return nil
+}
+
+// addPatches copies the patches into the bundle, in dir, and updates their
+// paths and hashes. The copies are numbered, so that they keep their order and
+// patches with the same name do not collide.
+func (v *vendorer) addPatches(label string, patches []Patch, dir string) error {
+	for i := range patches {
+		p := &patches[i]
+		data, hash, err := p.read(label, v.projectDir, v.hashMode)
+		if err != nil {
+			return err
+		}
+		rel := path.Join(dir, fmt.Sprintf("%02d-%s", i, filepath.Base(p.Path)))
+		if err := writeFile(filepath.Join(v.dir, rel), bytes.NewReader(data), nil); err != nil {
+			return err
+		}
+		p.Path, p.Hash = rel, hash
+	}
+	return nil
+}
+
+// addSignature copies the signature and its keyring into the bundle. The
+// signature is stored in dir, and the keyring path of sig is updated to point
+// at the copy, so that the bundle does not depend on the base directory it was
+// created from.
+func (v *vendorer) addSignature(label string, sig *Signature, dir string) error {
+	if sig == nil {
+		return nil
+	}
+	f, _, _, err := fetchAndVerify(label, v.projectDir, []string{sig.URL}, hashModePermissive, nil, v.urlOverrides)
+	if err != nil {
+		return fmt.Errorf("%s: failed to fetch signature: %w", label, err)
+	}
+	defer f.Close()
+	if err := v.addFile(f, path.Join(dir, urlBaseName(sig.URL)), []string{sig.URL}); err != nil {
+		return err
+	}
+
+	rel, err := v.addKeyring(label, sig.Keyring)
+	if err != nil {
+		return err
+	}
+	sig.Keyring = rel
+	return nil
+}
+
+// addPolicy copies the keyring and the allowed signers file of the signature
+// policy into the bundle, and updates their paths in policy.
+func (v *vendorer) addPolicy(label string, policy *SignaturePolicy) error {
+	if policy == nil {
+		return nil
+	}
+	for _, keyring := range []*string{&policy.Keyring, &policy.AllowedSigners} {
+		if *keyring == "" {
+			continue
+		}
+		rel, err := v.addKeyring(label, *keyring)
+		if err != nil {
+			return err
+		}
+		*keyring = rel
+	}
+	return nil
+}
+
+// addKeyring copies the keyring into the bundle, once, and returns its path
+// in the bundle.
+func (v *vendorer) addKeyring(label, keyring string) (string, error) {
+	if !filepath.IsAbs(keyring) {
+		keyring = filepath.Join(v.projectDir, keyring)
+	}
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	rel, ok := v.keyrings[keyring]
+	if !ok {
+		// keyrings are shared by all the components, and may have the same
+		// name in different directories.
+		base := filepath.Base(keyring)
+		rel = path.Join("keyrings", base)
+		for i := 1; v.hasKeyring(rel); i++ {
+			rel = path.Join("keyrings", fmt.Sprintf("%d-%s", i, base))
+		}
+		src, err := os.Open(keyring)
+		if err != nil {
+			return "", fmt.Errorf("%s: failed to read keyring: %w", label, err)
+		}
+		err = writeFile(filepath.Join(v.dir, rel), src, nil)
+		src.Close()
+		if err != nil {
+			return "", err
+		}
+		v.keyrings[keyring] = rel
+	}
+	return rel, nil
+}
+
+// hasKeyring returns true if a keyring was already copied to rel. Must be
+// called with mu held.
+func (v *vendorer) hasKeyring(rel string) bool {
+	for _, r := range v.keyrings {
+		if r == rel {
+			return true
+		}
+	}
+	return false
+}
+
+// writeTarball writes the content of dir to a gzipped tarball at name. The
+// paths in the tarball are relative to dir.
+func writeTarball(name, dir string) (err error) {
+	out, err := os.Create(name)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if cerr := out.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			os.Remove(name)
+		}
+	}()
+	gw := gzip.NewWriter(out)
+	tw := tar.NewWriter(gw)
+	err = filepath.Walk(dir, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(dir, p)
+		if err != nil || rel == "." {
+			return err
+		}
+		link := ""
+		if info.Mode()&os.ModeSymlink != 0 {
+			if link, err = os.Readlink(p); err != nil {
+				return err
+			}
+		}
+		header, err := tar.FileInfoHeader(info, link)
+		if err != nil {
+			return err
+		}
+		header.Name = filepath.ToSlash(rel)
+		if info.IsDir() {
+			header.Name += "/"
+		}
+		if err := tw.WriteHeader(header); err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		f, err := os.Open(p)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		_, err = io.Copy(tw, f)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	if err := gw.Close(); err != nil {
+		return err
+	}
+	log.Printf("Wrote %s", name)
+	return nil
+}
@@ -0,0 +1,137 @@
+// Copyright (c) Facebook, Inc. and its affiliates.
+//
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestVendorBundle(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not found")
+	}
+	dir, err := ioutil.TempDir("", "getdeps-vendor")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	repo := newTestGitRepo(t, map[string]string{"README": "coreboot"})
+	signer, keyring := newTestKeyring(t, dir, "signer")
+	var tarball bytes.Buffer
+	gw := gzip.NewWriter(&tarball)
+	tw := tar.NewWriter(gw)
+	require.NoError(t, tw.WriteHeader(&tar.Header{Name: "linux/", Typeflag: tar.TypeDir, Mode: 0755}))
+	require.NoError(t, tw.WriteHeader(&tar.Header{Name: "linux/Makefile", Mode: 0644, Size: 5}))
+	_, err = tw.Write([]byte("hello"))
+	require.NoError(t, err)
+	require.NoError(t, tw.Close())
+	require.NoError(t, gw.Close())
+	var sig bytes.Buffer
+	require.NoError(t, openpgp.DetachSign(&sig, signer, bytes.NewReader([]byte("hello")), nil))
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/linux.tar.gz":
+			w.Write(tarball.Bytes())
+		case "/hello.txt.sig":
+			w.Write(sig.Bytes())
+		case "/nonexistent":
+			http.NotFound(w, r)
+		default:
+			w.Write([]byte("hello"))
+		}
+	}))
+	defer ts.Close()
+
+	config := &Config{
+		BuildID: "test",
+		Coreboot: &Node{
+			Git: []Git{{Label: "coreboot", URL: "https://review.coreboot.org/coreboot"}},
+			Files: &Files{
+				Label: "tarballs",
+				Filelist: []File{{
+					URL:       ts.URL + "/hello.txt",
+					Signature: &Signature{URL: ts.URL + "/hello.txt.sig", Keyring: filepath.Base(keyring)},
+				}},
+			},
+		},
+		Kernel: &Node{
+			Untar: []Untar{{Label: "linux", URL: "https://cdn.kernel.org/linux.tar.gz", Mirrors: []string{ts.URL + "/linux.tar.gz"}}},
+		},
+	}
+	overrides := URLOverrides{
+		"https://review.coreboot.org/coreboot": "file://" + repo,
+		"https://cdn.kernel.org/linux.tar.gz":  ts.URL + "/nonexistent",
+	}
+	bundle := filepath.Join(dir, "bundle")
+	components := []string{"coreboot", "kernel"}
+	require.NoError(t, vendorBundle(bundle, config, components, dir, &overrides, hashModeUpdate))
+	// an existing bundle is not overwritten.
+	assert.Error(t, vendorBundle(bundle, config, components, dir, &overrides, hashModeUpdate))
+
+	require.NoError(t, vendorBundle(filepath.Join(dir, "bundle.tar.gz"), config, components, dir, &overrides, hashModeUpdate))
+	assert.FileExists(t, filepath.Join(dir, "bundle.tar.gz"))
+
+	// the bundle does not depend on its location, nor on the network.
+	moved := filepath.Join(dir, "moved")
+	require.NoError(t, os.Rename(bundle, moved))
+	ts.Close()
+	offline = true
+	defer func() { offline = false }()
+
+	data, err := ioutil.ReadFile(filepath.Join(moved, bundleConfigFile))
+	require.NoError(t, err)
+	bundleConfig, err := NewConfig(data)
+	require.NoError(t, err)
+	require.NotNil(t, bundleConfig.Coreboot.Git[0].Hash)
+	assert.Len(t, *bundleConfig.Coreboot.Git[0].Hash, 40)
+	assert.Equal(t, testHash, bundleConfig.Coreboot.Files.Filelist[0].Hash)
+	assert.Equal(t, "keyrings/signer.asc", bundleConfig.Coreboot.Files.Filelist[0].Signature.Keyring)
+	data, err = ioutil.ReadFile(filepath.Join(moved, bundleURLOverridesFile))
+	require.NoError(t, err)
+	bundleOverrides, err := NewURLOverrides(data)
+	require.NoError(t, err)
+	assert.Equal(t, "coreboot/git/coreboot.git", (*bundleOverrides)["https://review.coreboot.org/coreboot"])
+	assert.Equal(t, "file:///kernel/untar/linux/linux.tar.gz", (*bundleOverrides)["https://cdn.kernel.org/linux.tar.gz"])
+
+	for _, component := range components {
+		var node *Node
+		if component == "coreboot" {
+			node = bundleConfig.Coreboot
+		} else {
+			node = bundleConfig.Kernel
+		}
+		assert.Empty(t, node.missingOffline(moved, bundleOverrides, hashModeStrict), component)
+		workDir := filepath.Join(dir, component)
+		require.NoError(t, os.Mkdir(workDir, 0755))
+		require.NoError(t, node.Get(moved, workDir, bundleOverrides, hashModeStrict), component)
+	}
+	assert.FileExists(t, filepath.Join(dir, "coreboot", "README"))
+	assert.FileExists(t, filepath.Join(dir, "coreboot", "hello.txt"))
+	assert.FileExists(t, filepath.Join(dir, "kernel", "linux", "Makefile"))
+	// the origin recorded when vendoring is kept, not the bundle path.
+	assert.Equal(t, ts.URL+"/linux.tar.gz", bundleConfig.Kernel.Untar[0].FetchedFrom)
+
+	// the content of the bundle is checked against the pinned hashes.
+	require.NoError(t, ioutil.WriteFile(filepath.Join(moved, "kernel", "untar", "linux", "linux.tar.gz"), []byte("tampered"), 0644))
+	workDir := filepath.Join(dir, "tampered")
+	require.NoError(t, os.Mkdir(workDir, 0755))
+	err = bundleConfig.Kernel.Get(moved, workDir, bundleOverrides, hashModeStrict)
+	assert.ErrorContains(t, err, "hash mismatch")
+	assert.NoFileExists(t, filepath.Join(workDir, "linux", "Makefile"))
+}